@@ -0,0 +1,10 @@
+package backplane
+
+// ABackplane A message bus between cluster nodes
+type ABackplane interface {
+	// Publish Send message to all subscribers of topic
+	Publish(topic string, message []byte) error
+	// Subscribe Call handler for each message of topic, handler is called from one goroutine per subscription
+	Subscribe(topic string, handler func(message []byte)) error
+	Close() error
+}
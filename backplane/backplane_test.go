@@ -0,0 +1,91 @@
+package backplane
+
+import (
+	"bytes"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stepan-s/ws-bro/log"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.Init(ioutil.Discard, log.NONE)
+	os.Exit(m.Run())
+}
+
+// Messages of topic are delivered in order and as is
+func testBackplane(t *testing.T, bus ABackplane) {
+	received := make(chan []byte, 10)
+	err := bus.Subscribe("wsbro.test", func(message []byte) {
+		received <- message
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bus.Subscribe("wsbro.other", func(message []byte) {
+		t.Errorf("other topic got %q", message)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := [][]byte{[]byte(`{"N":1}`), {0, 1, 0xff}, {}}
+	for _, message := range messages {
+		err = bus.Publish("wsbro.test", message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range messages {
+		select {
+		case got := <-received:
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("message is not delivered")
+		}
+	}
+
+	err = bus.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testBackplane(t, NewMemory())
+}
+
+// Needs a redis server at REDIS_ADDR or localhost:6379
+func TestRedis(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	bus, err := NewRedis(addr)
+	if err != nil {
+		t.Skipf("no redis at %s: %v", addr, err)
+	}
+	testBackplane(t, bus)
+}
+
+func TestNats(t *testing.T) {
+	options := natsserver.DefaultTestOptions
+	options.Port = -1
+	server := natsserver.RunServer(&options)
+	defer server.Shutdown()
+	conn, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bus := NewNats(conn)
+	testBackplane(t, bus)
+	if conn.IsClosed() || conn.NumSubscriptions() != 0 {
+		t.Errorf("connection closed %v, subscriptions %d", conn.IsClosed(), conn.NumSubscriptions())
+	}
+}
@@ -0,0 +1,73 @@
+package backplane
+
+import (
+	"errors"
+	"github.com/stepan-s/ws-bro/log"
+	"sync"
+)
+
+type memorySubscription struct {
+	messages chan []byte
+}
+
+// Memory An in-process backplane, nodes of one process share the instance
+type Memory struct {
+	lock          sync.RWMutex
+	subscriptions map[string][]*memorySubscription
+	closed        bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		subscriptions: make(map[string][]*memorySubscription),
+	}
+}
+
+func (m *Memory) Publish(topic string, message []byte) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if m.closed {
+		return errors.New("backplane closed")
+	}
+	for _, subscription := range m.subscriptions[topic] {
+		select {
+		case subscription.messages <- message:
+		default:
+			log.Error("Backplane subscription overflow, topic: %s", topic)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(topic string, handler func(message []byte)) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return errors.New("backplane closed")
+	}
+	subscription := &memorySubscription{make(chan []byte, 10000)}
+	m.subscriptions[topic] = append(m.subscriptions[topic], subscription)
+	go func() {
+		for message := range subscription.messages {
+			handler(message)
+		}
+	}()
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		for _, subscriptions := range m.subscriptions {
+			for _, subscription := range subscriptions {
+				close(subscription.messages)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package backplane
+
+import (
+	"github.com/nats-io/nats.go"
+	"sync"
+)
+
+// Nats A backplane over nats, connection may be shared with other users
+type Nats struct {
+	conn          *nats.Conn
+	lock          sync.Mutex
+	subscriptions []*nats.Subscription
+}
+
+func NewNats(conn *nats.Conn) *Nats {
+	return &Nats{conn: conn}
+}
+
+func (n *Nats) Publish(topic string, message []byte) error {
+	return n.conn.Publish(topic, message)
+}
+
+func (n *Nats) Subscribe(topic string, handler func(message []byte)) error {
+	subscription, err := n.conn.Subscribe(topic, func(msg *nats.Msg) {
+		handler(msg.Data)
+	})
+	if err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.subscriptions = append(n.subscriptions, subscription)
+	return nil
+}
+
+// Close Unsubscribe, connection is left open
+func (n *Nats) Close() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, subscription := range n.subscriptions {
+		err := subscription.Unsubscribe()
+		if err != nil {
+			return err
+		}
+	}
+	n.subscriptions = nil
+	return nil
+}
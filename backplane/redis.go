@@ -0,0 +1,54 @@
+package backplane
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis A backplane over redis pub/sub
+type Redis struct {
+	client *redis.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewRedis(addr string) (*Redis, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	err := client.Ping(ctx).Err()
+	if err != nil {
+		cancel()
+		_ = client.Close()
+		return nil, err
+	}
+	return &Redis{client, ctx, cancel}, nil
+}
+
+func (r *Redis) Publish(topic string, message []byte) error {
+	return r.client.Publish(r.ctx, topic, message).Err()
+}
+
+func (r *Redis) Subscribe(topic string, handler func(message []byte)) error {
+	pubsub := r.client.Subscribe(r.ctx, topic)
+	// wait for confirmation
+	_, err := pubsub.Receive(r.ctx)
+	if err != nil {
+		_ = pubsub.Close()
+		return err
+	}
+	go func() {
+		for message := range pubsub.Channel() {
+			handler([]byte(message.Payload))
+		}
+	}()
+	go func() {
+		<-r.ctx.Done()
+		_ = pubsub.Close()
+	}()
+	return nil
+}
+
+func (r *Redis) Close() error {
+	r.cancel()
+	return r.client.Close()
+}
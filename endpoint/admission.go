@@ -0,0 +1,83 @@
+package endpoint
+
+import (
+	"context"
+	"github.com/stepan-s/ws-bro/hive"
+	"github.com/stepan-s/ws-bro/log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// AdmissionRetryAfter Suggested retry delay in seconds for refused handshakes, each client gets up to twice as much
+var AdmissionRetryAfter int64 = 2
+
+// Admission Handshake admission control, refused handshakes get 503 with Retry-After
+type Admission struct {
+	maxHandshakes int64
+	handshakes    int64
+	limiter       *hive.RateLimiter
+	maxQueue      int
+	queue         func() int
+}
+
+// NewAdmission Limit concurrent handshakes and new connections per second,
+// refuse while queue is longer than maxQueue, zero - no limit
+func NewAdmission(ctx context.Context, maxHandshakes int, rate float64, maxQueue int, queue func() int) *Admission {
+	return &Admission{
+		maxHandshakes: int64(maxHandshakes),
+		limiter:       hive.NewRateLimiter(ctx, rate, 0),
+		maxQueue:      maxQueue,
+		queue:         queue,
+	}
+}
+
+// Start handshake or write 503, leave must follow the admitted handshake
+func (a *Admission) enter(w http.ResponseWriter) bool {
+	if a == nil {
+		return true
+	}
+	if a.maxQueue > 0 && a.queue != nil && a.queue() > a.maxQueue {
+		log.Debug("Decline connection, reason: queue is full")
+		serviceUnavailable(w, "Server busy", jitter(AdmissionRetryAfter))
+		return false
+	}
+	// a handshake refused by concurrency does not spend the rate
+	if atomic.AddInt64(&a.handshakes, 1) > a.maxHandshakes && a.maxHandshakes > 0 {
+		atomic.AddInt64(&a.handshakes, -1)
+		log.Debug("Decline connection, reason: too many handshakes")
+		serviceUnavailable(w, "Server busy", jitter(AdmissionRetryAfter))
+		return false
+	}
+	if !a.limiter.Allow("", 0) {
+		atomic.AddInt64(&a.handshakes, -1)
+		log.Debug("Decline connection, reason: too many new connections")
+		serviceUnavailable(w, "Server busy", jitter(AdmissionRetryAfter))
+		return false
+	}
+	return true
+}
+
+// Handshake is done
+func (a *Admission) leave() {
+	if a == nil {
+		return
+	}
+	atomic.AddInt64(&a.handshakes, -1)
+}
+
+// Refuse handshake, client may retry after seconds
+func serviceUnavailable(w http.ResponseWriter, reason string, retryAfter int64) {
+	w.Header().Add("X-Error", reason)
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// Spread retries of refused clients
+func jitter(seconds int64) int64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return seconds + rand.Int63n(seconds+1)
+}
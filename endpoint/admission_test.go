@@ -0,0 +1,95 @@
+package endpoint
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestAdmission(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxHandshakes int
+		rate          float64
+		maxQueue      int
+		queue         int
+		// + admitted, - refused, l leave
+		steps string
+	}{
+		{"no limits", 0, 0, 0, 0, "+++"},
+		{"handshakes", 2, 0, 0, 0, "++-l+-"},
+		{"rate", 0, 0.5, 0, 0, "+-"},
+		// refused by concurrency, the rate is left for the next handshake
+		{"handshakes before rate", 1, 1.5, 0, 0, "+-l+"},
+		// refused by rate, the handshake slot is freed
+		{"rate frees handshake", 1, 0.5, 0, 0, "+l-"},
+		{"queue is full", 0, 0, 10, 11, "-"},
+		{"queue at limit", 0, 0, 10, 10, "+"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, stop := context.WithCancel(context.Background())
+			defer stop()
+			queue := test.queue
+			open := int64(0)
+			admission := NewAdmission(ctx, test.maxHandshakes, test.rate, test.maxQueue, func() int { return queue })
+			for i, step := range test.steps {
+				if step == 'l' {
+					admission.leave()
+					open--
+					continue
+				}
+				w := httptest.NewRecorder()
+				admitted := admission.enter(w)
+				if admitted != (step == '+') {
+					t.Fatalf("step %d: admitted %v", i, admitted)
+				}
+				if admitted {
+					open++
+					continue
+				}
+				retryAfter, err := strconv.ParseInt(w.Header().Get("Retry-After"), 10, 64)
+				if w.Code != http.StatusServiceUnavailable || err != nil || retryAfter < AdmissionRetryAfter || retryAfter > 2*AdmissionRetryAfter {
+					t.Errorf("step %d: status %d, retry after %s", i, w.Code, w.Header().Get("Retry-After"))
+				}
+			}
+			// refused handshakes are not counted
+			if admission.handshakes != open {
+				t.Errorf("%d handshakes, want %d", admission.handshakes, open)
+			}
+		})
+	}
+}
+
+func TestAdmissionDisabled(t *testing.T) {
+	var admission *Admission
+	if !admission.enter(httptest.NewRecorder()) {
+		t.Error("refused without admission")
+	}
+	admission.leave()
+}
+
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		name    string
+		seconds int64
+		min     int64
+		max     int64
+	}{
+		{"disabled", 0, 0, 0},
+		{"negative", -1, 0, 0},
+		{"spread", 3, 3, 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				seconds := jitter(test.seconds)
+				if seconds < test.min || seconds > test.max {
+					t.Fatalf("jitter %d, want %d..%d", seconds, test.min, test.max)
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package endpoint
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/stepan-s/ws-bro/hive"
@@ -11,6 +12,39 @@ import (
 	"time"
 )
 
+type userBatchItem struct {
+	Target  uint32
+	Message json.RawMessage
+}
+
+type appBatchItem struct {
+	Target  uuid.UUID
+	Message json.RawMessage
+}
+
+type uidsBody struct {
+	Uids  []uint32
+	Roles map[uint32]string
+}
+
+type aidsBody struct {
+	Aids []uuid.UUID
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	response, err := json.Marshal(value)
+	if err != nil {
+		log.Error("Fail pack response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(response)
+	if err != nil {
+		log.Error("Fail write response: %v", err)
+	}
+}
+
 func BindApi(users *hive.Users, apps *hive.Apps, pattern string, apiKey string, authKey string) {
 	http.HandleFunc(pattern+"/user/send", func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Auth") != apiKey {
@@ -32,7 +66,22 @@ func BindApi(users *hive.Users, apps *hive.Apps, pattern string, apiKey string,
 			return
 		}
 
-		users.SendEvent(hive.UserMessageEvent{Uid: uint32(uid), RawMessage: body})
+		var cid uint64 = 0
+		if r.URL.Query().Get("cid") != "" {
+			cid, err = strconv.ParseUint(r.URL.Query().Get("cid"), 10, 64)
+			if err != nil {
+				w.Header().Add("X-Error", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		users.SendEvent(hive.UserMessageEvent{
+			Uid:        uint32(uid),
+			RawMessage: body,
+			Binary:     r.Header.Get("Content-Type") == "application/octet-stream",
+			Cid:        cid,
+		})
 	})
 
 	http.HandleFunc(pattern+"/app/send", func(w http.ResponseWriter, r *http.Request) {
@@ -55,7 +104,145 @@ func BindApi(users *hive.Users, apps *hive.Apps, pattern string, apiKey string,
 			return
 		}
 
-		apps.SendEvent(hive.AppMessageToEvent{Aid: aid, Uid: hive.SYSUID, RawMessage: body})
+		apps.SendEvent(hive.AppMessageToEvent{
+			Aid:        aid,
+			Uid:        hive.SYSUID,
+			RawMessage: body,
+			Binary:     r.Header.Get("Content-Type") == "application/octet-stream",
+			Instance:   r.URL.Query().Get("instance"),
+		})
+	})
+
+	http.HandleFunc(pattern+"/user/send-batch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var items []userBatchItem
+		err = json.Unmarshal(body, &items)
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		events := make([]hive.UserMessageEvent, len(items))
+		for i, item := range items {
+			if len(item.Message) == 0 {
+				w.Header().Add("X-Error", fmt.Sprintf("Empty message of item %d", i))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			events[i] = hive.UserMessageEvent{Uid: item.Target, RawMessage: item.Message}
+		}
+		users.SendBatch(events)
+	})
+
+	http.HandleFunc(pattern+"/app/send-batch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var items []appBatchItem
+		err = json.Unmarshal(body, &items)
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		events := make([]hive.AppMessageToEvent, len(items))
+		for i, item := range items {
+			if len(item.Message) == 0 {
+				w.Header().Add("X-Error", fmt.Sprintf("Empty message of item %d", i))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			events[i] = hive.AppMessageToEvent{Aid: item.Target, Uid: hive.SYSUID, RawMessage: item.Message}
+		}
+		apps.SendBatch(events)
+	})
+
+	http.HandleFunc(pattern+"/user/broadcast", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		users.Broadcast(body)
+	})
+
+	http.HandleFunc(pattern+"/app/broadcast", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		apps.Broadcast(body)
+	})
+
+	http.HandleFunc(pattern+"/app/send-attached", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		aid, err := uuid.Parse(r.URL.Query().Get("aid"))
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		uids := apps.GetUids(aid)
+		if uids == nil {
+			w.Header().Add("X-Error", "App not connected")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		events := make([]hive.UserMessageEvent, len(uids))
+		for i, uid := range uids {
+			events[i] = hive.UserMessageEvent{Uid: uid, RawMessage: body}
+		}
+		users.SendBatch(events)
 	})
 
 	http.HandleFunc(pattern+"/user/sign-auth", func(w http.ResponseWriter, r *http.Request) {
@@ -126,6 +313,17 @@ func BindApi(users *hive.Users, apps *hive.Apps, pattern string, apiKey string,
 			return
 		}
 
+		var role uint8 = hive.ROLE_OWNER
+		if r.URL.Query().Get("role") != "" {
+			var valid bool
+			role, valid = hive.RoleParse(r.URL.Query().Get("role"))
+			if !valid {
+				w.Header().Add("X-Error", "Invalid role")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
 		attachMessage, err := hive.MessageUserAttachedPack(&hive.MessageUserAttached{
 			Action: hive.ACTION_ATTACHED,
 			List:   []uuid.UUID{aid},
@@ -137,9 +335,10 @@ func BindApi(users *hive.Users, apps *hive.Apps, pattern string, apiKey string,
 		}
 
 		apps.UpdateUids(hive.AppUidsEvent{
-			Cmd: hive.ADD,
-			Aid:  aid,
-			Uids: []uint32{uint32(uid)},
+			Cmd:   hive.ADD,
+			Aid:   aid,
+			Uids:  []uint32{uint32(uid)},
+			Roles: map[uint32]uint8{uint32(uid): role},
 		})
 	})
 
@@ -179,4 +378,238 @@ func BindApi(users *hive.Users, apps *hive.Apps, pattern string, apiKey string,
 			users.SendEvent(hive.UserMessageEvent{Uid: uint32(uid), RawMessage: detachMessage});
 		}
 	})
+
+	http.HandleFunc(pattern+"/app/uids", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		aid, err := uuid.Parse(r.URL.Query().Get("aid"))
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			info := apps.GetApp(aid)
+			if info == nil {
+				w.Header().Add("X-Error", "App not connected")
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			writeJson(w, uidsBody{Uids: info.Uids, Roles: info.Roles})
+		case http.MethodPut:
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.Header().Add("X-Error", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			var request uidsBody
+			err = json.Unmarshal(body, &request)
+			if err != nil {
+				w.Header().Add("X-Error", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			roles := make(map[uint32]uint8, len(request.Roles))
+			for uid, name := range request.Roles {
+				role, valid := hive.RoleParse(name)
+				if !valid {
+					w.Header().Add("X-Error", "Invalid role")
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				roles[uid] = role
+			}
+
+			if apps.GetUids(aid) == nil {
+				w.Header().Add("X-Error", "App not connected")
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			apps.UpdateUids(hive.AppUidsEvent{
+				Cmd:   hive.SET,
+				Aid:   aid,
+				Uids:  request.Uids,
+				Roles: roles,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc(pattern+"/app/info", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		aid, err := uuid.Parse(r.URL.Query().Get("aid"))
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		info := apps.GetApp(aid)
+		if info == nil {
+			w.Header().Add("X-Error", "App not connected")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJson(w, info)
+	})
+
+	http.HandleFunc(pattern+"/app/list", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var offset int64 = 0
+		if r.URL.Query().Get("offset") != "" {
+			var err error
+			offset, err = strconv.ParseInt(r.URL.Query().Get("offset"), 10, 32)
+			if err != nil || offset < 0 {
+				w.Header().Add("X-Error", "Invalid offset")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		var limit int64 = 100
+		if r.URL.Query().Get("limit") != "" {
+			var err error
+			limit, err = strconv.ParseInt(r.URL.Query().Get("limit"), 10, 32)
+			if err != nil || limit < 1 || limit > 1000 {
+				w.Header().Add("X-Error", "Invalid limit")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		writeJson(w, apps.GetApps(int(offset), int(limit)))
+	})
+
+	http.HandleFunc(pattern+"/user/info", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		uid, err := strconv.ParseInt(r.URL.Query().Get("uid"), 10, 32)
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		info := users.GetUser(uint32(uid))
+		if info == nil {
+			w.Header().Add("X-Error", "User not connected")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJson(w, info)
+	})
+
+	http.HandleFunc(pattern+"/user/apps", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		uid, err := strconv.ParseInt(r.URL.Query().Get("uid"), 10, 32)
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		writeJson(w, aidsBody{Aids: apps.GetAids(uint32(uid))})
+	})
+
+	http.HandleFunc(pattern+"/app/share", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		aid, err := uuid.Parse(r.URL.Query().Get("aid"))
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var role uint8 = hive.ROLE_VIEWER
+		if r.URL.Query().Get("role") != "" {
+			var valid bool
+			role, valid = hive.RoleParse(r.URL.Query().Get("role"))
+			if !valid || role == hive.ROLE_OWNER {
+				w.Header().Add("X-Error", "Invalid role")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		ttl, err := strconv.ParseInt(r.URL.Query().Get("ttl"), 10, 64)
+		if err != nil || ttl <= 0 {
+			w.Header().Add("X-Error", "Invalid ttl")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var maxUses int64 = 0
+		if r.URL.Query().Get("max-uses") != "" {
+			maxUses, err = strconv.ParseInt(r.URL.Query().Get("max-uses"), 10, 32)
+			if err != nil || maxUses < 0 {
+				w.Header().Add("X-Error", "Invalid max-uses")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		grant := hive.ShareGrant{
+			Id:      uuid.New(),
+			Aid:     aid,
+			Role:    role,
+			Expires: time.Now().Add(time.Duration(ttl) * time.Second),
+			MaxUses: uint32(maxUses),
+		}
+		apps.AddGrant(grant)
+
+		expires := grant.Expires.Unix()
+		sign := SignGuestAuth(grant.Id, expires, authKey)
+
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		_, err = w.Write([]byte(fmt.Sprintf("grant=%s&expires=%d&sign=%s", grant.Id.String(), expires, sign)))
+		if err != nil {
+			log.Error("Fail share app: %v", err)
+		}
+	})
+
+	http.HandleFunc(pattern+"/app/unshare", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth") != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		grant, err := uuid.Parse(r.URL.Query().Get("grant"))
+		if err != nil {
+			w.Header().Add("X-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		apps.RevokeGrant(grant)
+	})
 }
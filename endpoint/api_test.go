@@ -0,0 +1,212 @@
+package endpoint
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestApiSendBatch(t *testing.T) {
+	alice := testUser(t, 101)
+	bob := testUser(t, 102)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		alice  []string
+		bob    []string
+	}{
+		{"to each", `[{"Target":101,"Message":{"N":1}},{"Target":102,"Message":{"N":2}}]`, http.StatusOK, []string{`{"N":1}`}, []string{`{"N":2}`}},
+		{"in order", `[{"Target":101,"Message":{"N":1}},{"Target":101,"Message":{"N":2}}]`, http.StatusOK, []string{`{"N":1}`, `{"N":2}`}, nil},
+		{"unknown user", `[{"Target":103,"Message":{"N":1}}]`, http.StatusOK, nil, nil},
+		{"empty", `[]`, http.StatusOK, nil, nil},
+		{"invalid json", `[{"Target":`, http.StatusBadRequest, nil, nil},
+		{"no message", `[{"Target":101,"Message":{"N":1}},{"Target":102}]`, http.StatusBadRequest, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := testApi(http.MethodPost, "/api/user/send-batch", test.body)
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+			for _, want := range test.alice {
+				if got := alice.next(t); got != want {
+					t.Errorf("alice got %s, want %s", got, want)
+				}
+			}
+			for _, want := range test.bob {
+				if got := bob.next(t); got != want {
+					t.Errorf("bob got %s, want %s", got, want)
+				}
+			}
+			alice.none(t)
+			bob.none(t)
+		})
+	}
+}
+
+func TestApiAppSendBatch(t *testing.T) {
+	aid := uuid.New()
+	app := testApp(t, aid)
+
+	body := fmt.Sprintf(`[{"Target":"%s","Message":{"Action":"batch"}}]`, aid)
+	w := testApi(http.MethodPost, "/api/app/send-batch", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if got := app.next(t); got != `{"Action":"batch"}` {
+		t.Errorf("app got %s", got)
+	}
+
+	body = fmt.Sprintf(`[{"Target":"%s"}]`, aid)
+	w = testApi(http.MethodPost, "/api/app/send-batch", body)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("no message status %d", w.Code)
+	}
+	app.none(t)
+}
+
+func TestApiBroadcast(t *testing.T) {
+	conns := []*testConnection{testUser(t, 201), testUser(t, 202), testUser(t, 203)}
+
+	tests := []struct {
+		name   string
+		key    string
+		status int
+	}{
+		{"sent", testApiKey, http.StatusOK},
+		{"forbidden", "wrong", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := testRequest(http.MethodPost, "/api/user/broadcast", `{"Action":"news"}`)
+			r.Header.Set("Auth", test.key)
+			w := testServe(r)
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+			for _, conn := range conns {
+				if test.status == http.StatusOK {
+					if got := conn.next(t); got != `{"Action":"news"}` {
+						t.Errorf("user got %s", got)
+					}
+				} else {
+					conn.none(t)
+				}
+			}
+		})
+	}
+}
+
+func TestApiUids(t *testing.T) {
+	aid := uuid.New()
+	testApp(t, aid)
+
+	tests := []struct {
+		name   string
+		method string
+		aid    uuid.UUID
+		body   string
+		status int
+		want   string
+	}{
+		{"set", http.MethodPut, aid, `{"Uids":[1,2],"Roles":{"2":"viewer"}}`, http.StatusOK, `{"Uids":[1,2],"Roles":{"1":"owner","2":"viewer"}}`},
+		{"replace", http.MethodPut, aid, `{"Uids":[2,3]}`, http.StatusOK, `{"Uids":[2,3],"Roles":{"2":"owner","3":"owner"}}`},
+		{"invalid role", http.MethodPut, aid, `{"Uids":[4],"Roles":{"4":"admin"}}`, http.StatusBadRequest, ""},
+		{"invalid body", http.MethodPut, aid, `{"Uids":`, http.StatusBadRequest, ""},
+		{"not connected", http.MethodPut, uuid.New(), `{"Uids":[1]}`, http.StatusNotFound, ""},
+		{"get not connected", http.MethodGet, uuid.New(), "", http.StatusNotFound, ""},
+		{"method", http.MethodDelete, aid, "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := testApi(test.method, "/api/app/uids?aid="+test.aid.String(), test.body)
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+			if test.want == "" {
+				return
+			}
+			// the update is applied by the hive
+			deadline := time.Now().Add(time.Second)
+			got := ""
+			for time.Now().Before(deadline) && got != test.want {
+				got = testApi(http.MethodGet, "/api/app/uids?aid="+aid.String(), "").Body.String()
+			}
+			if got != test.want {
+				t.Errorf("uids %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApiQueries(t *testing.T) {
+	aid := uuid.New()
+	testApp(t, aid)
+	testUser(t, 301)
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"app info", "/api/app/info?aid=" + aid.String(), http.StatusOK},
+		{"app info not connected", "/api/app/info?aid=" + uuid.New().String(), http.StatusNotFound},
+		{"app info invalid aid", "/api/app/info?aid=app", http.StatusBadRequest},
+		{"app list", "/api/app/list?offset=0&limit=10", http.StatusOK},
+		{"app list invalid offset", "/api/app/list?offset=-1", http.StatusBadRequest},
+		{"app list invalid limit", "/api/app/list?limit=1001", http.StatusBadRequest},
+		{"user info", "/api/user/info?uid=301", http.StatusOK},
+		{"user info not connected", "/api/user/info?uid=302", http.StatusNotFound},
+		{"user apps", "/api/user/apps?uid=301", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := testApi(http.MethodGet, test.target, "")
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+			if w.Code == http.StatusOK && w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("content type %s", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestApiAttachRole(t *testing.T) {
+	aid := uuid.New()
+	testApp(t, aid)
+
+	tests := []struct {
+		name   string
+		uid    uint32
+		role   string
+		status int
+		want   string
+	}{
+		{"default", 401, "", http.StatusOK, "owner"},
+		{"viewer", 402, "viewer", http.StatusOK, "viewer"},
+		{"operator", 403, "operator", http.StatusOK, "operator"},
+		{"invalid", 404, "admin", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := fmt.Sprintf("/api/app/attach?aid=%s&uid=%d&role=%s", aid, test.uid, test.role)
+			w := testApi(http.MethodPost, target, "")
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+			role := ""
+			deadline := time.Now().Add(time.Second)
+			for time.Now().Before(deadline) && role != test.want {
+				role = testApps.GetApp(aid).Roles[test.uid]
+			}
+			if role != test.want {
+				t.Errorf("role %q, want %q", role, test.want)
+			}
+		})
+	}
+}
@@ -14,6 +14,9 @@ import (
 
 var AppAuthSignTTL int64 = 60
 
+// AppMultiInstance Allow several connections of one app tagged by instance
+var AppMultiInstance = false
+
 func SignAppAuth(aid uuid.UUID, ts int64, authKey string) string {
 	hash := sha256.New()
 	hash.Write([]byte(fmt.Sprintf("%s:%d:%s", aid.String(), ts, authKey)))
@@ -21,10 +24,21 @@ func SignAppAuth(aid uuid.UUID, ts int64, authKey string) string {
 }
 
 // BindApps Bind http handler
-func BindApps(apps *hive.Apps, pattern string, authKey string) {
-	var upgrader = websocket.Upgrader{}
+func BindApps(apps *hive.Apps, pattern string, authKey string, options hive.ConnectionOptions, admission *Admission) {
+	var upgrader = websocket.Upgrader{
+		Subprotocols:      hive.CodecSubprotocols,
+		EnableCompression: options.Compression,
+	}
 
 	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if refuseDraining(w) {
+			return
+		}
+		if !admission.enter(w) {
+			return
+		}
+		defer admission.leave()
+
 		// Auth
 
 		var aid uuid.UUID
@@ -67,14 +81,37 @@ func BindApps(apps *hive.Apps, pattern string, authKey string) {
 			}
 		}
 
+		instance := ""
+		if AppMultiInstance {
+			instance = r.URL.Query().Get("instance")
+			if len(instance) > 64 {
+				w.Header().Add("X-Error", "Invalid instance")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
 		// Accept connection
-		conn, err := upgrader.Upgrade(w, r, nil)
+		if Netpoll != nil {
+			conn, protocol, err := upgradePolled(w, r)
+			if err != nil {
+				log.Error("Upgrade connection error: %v", err)
+				return
+			}
+			_, err = hive.NewPolledAppConnection(Netpoll, apps, aid, instance, conn, protocol, options)
+			if err != nil {
+				log.Error("Poll connection error: %v", err)
+				_ = conn.Close()
+			}
+			return
+		}
+		conn, err := upgrader.Upgrade(compressionResponseWriter(w, r, options), r, nil)
 		if err != nil {
 			log.Error("Upgrade connection error: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		hive.NewAppConnection(apps, aid, conn)
+		hive.NewAppConnection(apps, aid, instance, conn, options)
 	})
 }
@@ -0,0 +1,130 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"github.com/google/uuid"
+	"github.com/stepan-s/ws-bro/hive"
+	"github.com/stepan-s/ws-bro/log"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const testApiKey = "api-key"
+const testAuthKey = "auth-key"
+
+// Hives behind the api handlers, handlers are bound once per process
+var testUsers *hive.Users
+var testApps *hive.Apps
+
+func TestMain(m *testing.M) {
+	log.Init(ioutil.Discard, log.NONE)
+	ctx, stop := context.WithCancel(context.Background())
+	testUsers = hive.NewUsers(ctx, hive.NewUsersStats())
+	testApps = hive.NewApps(ctx, "", hive.NewAppsStats())
+	hive.RouterStart(ctx, testUsers, testApps)
+	BindApi(testUsers, testApps, "/api", testApiKey, testAuthKey)
+	BindUsers(testUsers, testApps, "/bro", "example.com", testAuthKey, hive.ConnectionOptions{}, nil)
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+// Connection recording sent frames
+type testConnection struct {
+	frames chan hive.Frame
+}
+
+func newTestConnection() *testConnection {
+	return &testConnection{make(chan hive.Frame, 100)}
+}
+
+func (c *testConnection) Start() {}
+
+func (c *testConnection) Id() uint64 {
+	return 1
+}
+
+func (c *testConnection) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+}
+
+func (c *testConnection) Send(frame hive.Frame) {
+	c.frames <- frame
+}
+
+func (c *testConnection) Close() {}
+
+func (c *testConnection) CloseWithCode(code int, text string) {}
+
+// Next sent frame data, fails after a second
+func (c *testConnection) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case frame := <-c.frames:
+		return string(frame.Data)
+	case <-time.After(time.Second):
+		t.Fatal("no frame sent")
+		return ""
+	}
+}
+
+// No frames are sent for a while
+func (c *testConnection) none(t *testing.T) {
+	t.Helper()
+	select {
+	case frame := <-c.frames:
+		t.Fatalf("unexpected frame sent: %s", frame.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Connect user and skip hello
+func testUser(t *testing.T, uid uint32) *testConnection {
+	t.Helper()
+	conn := newTestConnection()
+	testUsers.ConnectionAdd(uid, conn)
+	conn.next(t)
+	t.Cleanup(func() {
+		testUsers.ConnectionRemove(uid, conn)
+	})
+	return conn
+}
+
+// Connect app and wait for it is registered
+func testApp(t *testing.T, aid uuid.UUID) *testConnection {
+	t.Helper()
+	conn := newTestConnection()
+	testApps.ConnectionAdd(aid, "", conn)
+	for testApps.GetApp(aid) == nil {
+		time.Sleep(time.Millisecond)
+	}
+	t.Cleanup(func() {
+		testApps.ConnectionRemove(aid, "", conn)
+	})
+	return conn
+}
+
+// Request with api key
+func testRequest(method string, target string, body string) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+	r.Header.Set("Auth", testApiKey)
+	return r
+}
+
+// Call bound handler
+func testServe(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	return w
+}
+
+// Call api handler
+func testApi(method string, target string, body string) *httptest.ResponseRecorder {
+	return testServe(testRequest(method, target, body))
+}
@@ -0,0 +1,35 @@
+package endpoint
+
+import (
+	"bufio"
+	"errors"
+	"github.com/stepan-s/ws-bro/hive"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Response writer handing a counting connection to the websocket upgrader
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack is not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return hive.NewCountingConn(conn), rw, nil
+}
+
+// Wrap response writer to measure compression if client supports it
+func compressionResponseWriter(w http.ResponseWriter, r *http.Request, options hive.ConnectionOptions) http.ResponseWriter {
+	if !options.Compression || !strings.Contains(r.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		return w
+	}
+	return countingResponseWriter{w}
+}
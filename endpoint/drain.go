@@ -0,0 +1,25 @@
+package endpoint
+
+import (
+	"github.com/stepan-s/ws-bro/hive"
+	"net/http"
+	"sync/atomic"
+)
+
+// Handshakes are refused while the server shuts down
+var draining int32
+
+// Drain Refuse new connections, the server is shutting down
+func Drain() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+// Write 503 while draining, true if the handshake is refused
+func refuseDraining(w http.ResponseWriter) bool {
+	if atomic.LoadInt32(&draining) == 0 {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	serviceUnavailable(w, "Server shutdown", jitter(hive.DrainReconnectDelay))
+	return true
+}
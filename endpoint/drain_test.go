@@ -0,0 +1,59 @@
+package endpoint
+
+import (
+	"fmt"
+	"github.com/stepan-s/ws-bro/hive"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefuseDraining(t *testing.T) {
+	tests := []struct {
+		name     string
+		draining bool
+		refused  bool
+	}{
+		{"serving", false, false},
+		{"draining", true, true},
+	}
+	defer atomic.StoreInt32(&draining, 0)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt32(&draining, 0)
+			if test.draining {
+				Drain()
+			}
+			w := httptest.NewRecorder()
+			refused := refuseDraining(w)
+			if refused != test.refused {
+				t.Fatalf("refused %v, want %v", refused, test.refused)
+			}
+			if !refused {
+				return
+			}
+			if w.Code != http.StatusServiceUnavailable || w.Header().Get("Connection") != "close" {
+				t.Errorf("status %d, connection %s", w.Code, w.Header().Get("Connection"))
+			}
+			retryAfter, err := strconv.ParseInt(w.Header().Get("Retry-After"), 10, 64)
+			if err != nil || retryAfter < hive.DrainReconnectDelay || retryAfter > 2*hive.DrainReconnectDelay {
+				t.Errorf("retry after %s", w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestDrainHandshake(t *testing.T) {
+	defer atomic.StoreInt32(&draining, 0)
+	Drain()
+	now := time.Now().Unix()
+	r := testRequest(http.MethodGet, fmt.Sprintf("/bro?uid=5&ts=%d&sign=%s", now, SignUserAuth(5, now, testAuthKey)), "")
+	r.Header.Set("Origin", "https://example.com")
+	w := testServe(r)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("X-Error") != "Server shutdown" {
+		t.Errorf("status %d, error %s", w.Code, w.Header().Get("X-Error"))
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package endpoint
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenHandoff Not supported on this platform
+func ListenHandoff(path string, addr string, handoff func()) (net.Listener, error) {
+	return nil, errors.New("listener handoff is supported on linux only")
+}
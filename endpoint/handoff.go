@@ -0,0 +1,143 @@
+//go:build linux
+
+package endpoint
+
+import (
+	"errors"
+	"github.com/stepan-s/ws-bro/log"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"time"
+)
+
+// The running process passes its listening socket to a new one over a local unix socket:
+// the new process connects and receives the descriptor, starts accepting and confirms,
+// then the old one drains its connections and the new one serves the next handoff.
+
+// Wait for the descriptor and for the confirmation
+const handoffTimeout = 60 * time.Second
+
+const handoffReady = 1
+
+// ListenHandoff Take the listening socket from the process serving handoffs on path or listen addr,
+// handoff is called once the socket is taken by a next process
+func ListenHandoff(path string, addr string, handoff func()) (net.Listener, error) {
+	listener, err := inheritListener(path)
+	if err != nil {
+		return nil, err
+	}
+	if listener == nil {
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Info("Listener taken over: %s", listener.Addr())
+	}
+
+	// stale socket or the socket of the previous process, it does not accept anymore
+	_ = os.Remove(path)
+	control, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	// the path belongs to the next process after handoff
+	control.SetUnlinkOnClose(false)
+
+	go func() {
+		for {
+			conn, err := control.AcceptUnix()
+			if err != nil {
+				log.Error("Handoff accept error: %v", err)
+				return
+			}
+			err = handOver(conn, listener)
+			_ = conn.Close()
+			if err != nil {
+				log.Error("Handoff error: %v", err)
+				continue
+			}
+			_ = control.Close()
+			log.Info("Listener handed off")
+			handoff()
+			return
+		}
+	}()
+	return listener, nil
+}
+
+// Receive listening socket and confirm, nil if there is no running process
+func inheritListener(path string) (net.Listener, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		// nobody to take over
+		return nil, nil
+	}
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(handoffTimeout))
+	buf := make([]byte, 1)
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) != 1 {
+		return nil, errors.New("handoff without descriptor")
+	}
+	fds, err := unix.ParseUnixRights(&messages[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		return nil, errors.New("handoff without descriptor")
+	}
+	file := os.NewFile(uintptr(fds[0]), "listener")
+	listener, err := net.FileListener(file)
+	_ = file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// connections queued on the socket are accepted from now
+	_, err = conn.Write([]byte{handoffReady})
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Send listening socket, nil when the new process confirmed
+func handOver(conn *net.UnixConn, listener net.Listener) error {
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		return errors.New("listener is not tcp")
+	}
+	file, err := tcpListener.File()
+	if err != nil {
+		return err
+	}
+	_, _, err = conn.WriteMsgUnix([]byte{handoffReady}, unix.UnixRights(int(file.Fd())), nil)
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(handoffTimeout))
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if buf[0] != handoffReady {
+		return errors.New("handoff not confirmed")
+	}
+	return nil
+}
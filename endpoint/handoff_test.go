@@ -0,0 +1,131 @@
+//go:build linux
+
+package endpoint
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testListenHandoff(t *testing.T, path string, addr string) (net.Listener, chan bool) {
+	t.Helper()
+	handedOff := make(chan bool, 1)
+	listener, err := ListenHandoff(path, addr, func() { handedOff <- true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener, handedOff
+}
+
+// Connection dialed to addr is accepted by listener
+func testAccepts(t *testing.T, listener net.Listener, addr string) {
+	t.Helper()
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case err = <-accepted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		_ = listener.Close()
+		t.Fatal("connection is not accepted")
+	}
+}
+
+func TestListenHandoff(t *testing.T) {
+	tests := []struct {
+		name  string
+		stale bool
+	}{
+		{"fresh", false},
+		// a file left by a crashed process
+		{"stale socket", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "handoff.sock")
+			if test.stale {
+				err := os.WriteFile(path, nil, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			listener, handedOff := testListenHandoff(t, path, "127.0.0.1:0")
+			testAccepts(t, listener, listener.Addr().String())
+			select {
+			case <-handedOff:
+				t.Error("handed off without a next process")
+			default:
+			}
+		})
+	}
+}
+
+func TestHandoffTakeOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	first, firstHandedOff := testListenHandoff(t, path, "127.0.0.1:0")
+	addr := first.Addr().String()
+
+	// the address is not listened again, the socket is taken
+	second, secondHandedOff := testListenHandoff(t, path, "127.0.0.1:1")
+	select {
+	case <-firstHandedOff:
+	case <-time.After(2 * time.Second):
+		t.Fatal("first process is not notified")
+	}
+	if second.Addr().String() != addr {
+		t.Fatalf("second listens %s, want %s", second.Addr(), addr)
+	}
+	// the old process stops accepting on drain
+	_ = first.Close()
+	testAccepts(t, second, addr)
+
+	// the next restart takes the socket from the second process
+	third, _ := testListenHandoff(t, path, "127.0.0.1:1")
+	select {
+	case <-secondHandedOff:
+	case <-time.After(2 * time.Second):
+		t.Fatal("second process is not notified")
+	}
+	_ = second.Close()
+	testAccepts(t, third, addr)
+}
+
+func TestInheritWithoutDescriptor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	control, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	go func() {
+		conn, err := control.AcceptUnix()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte{handoffReady})
+	}()
+
+	listener, err := inheritListener(path)
+	if err == nil {
+		_ = listener.Close()
+		t.Fatal("listener without descriptor")
+	}
+}
@@ -0,0 +1,75 @@
+package endpoint
+
+import (
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stepan-s/ws-bro/hive"
+	"github.com/stepan-s/ws-bro/log"
+	"strconv"
+	"strings"
+)
+
+const natsUserSubject = "wsbro.to.user."
+const natsAppSubject = "wsbro.to.app."
+
+// NatsExporter Publish hive events to nats
+type NatsExporter struct {
+	conn *nats.Conn
+}
+
+func NewNatsExporter(conn *nats.Conn) *NatsExporter {
+	return &NatsExporter{conn}
+}
+
+// Export Publish payload, binary payload is marked with Content-Type header
+func (e *NatsExporter) Export(subject string, payload []byte, binary bool) {
+	// client buffers messages, does not wait for server
+	var err error
+	if binary {
+		msg := nats.NewMsg(subject)
+		msg.Data = payload
+		msg.Header.Set("Content-Type", "application/octet-stream")
+		err = e.conn.PublishMsg(msg)
+	} else {
+		err = e.conn.Publish(subject, payload)
+	}
+	if err != nil {
+		log.Error("Fail export: %v, subject:%s", err, subject)
+	}
+}
+
+// BindNats Send messages published to wsbro.to.user.<uid> and wsbro.to.app.<aid>,
+// a message is taken by one node of the queue group and reaches other nodes over the cluster
+func BindNats(users *hive.Users, apps *hive.Apps, conn *nats.Conn, queue string) error {
+	_, err := conn.QueueSubscribe(natsUserSubject+"*", queue, func(msg *nats.Msg) {
+		uid, err := strconv.ParseUint(strings.TrimPrefix(msg.Subject, natsUserSubject), 10, 32)
+		if err != nil {
+			log.Error("Invalid uid: %v, subject:%s", err, msg.Subject)
+			return
+		}
+		users.SendEvent(hive.UserMessageEvent{
+			Uid:        uint32(uid),
+			RawMessage: msg.Data,
+			Binary:     msg.Header.Get("Content-Type") == "application/octet-stream",
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.QueueSubscribe(natsAppSubject+"*", queue, func(msg *nats.Msg) {
+		aid, err := uuid.Parse(strings.TrimPrefix(msg.Subject, natsAppSubject))
+		if err != nil {
+			log.Error("Invalid aid: %v, subject:%s", err, msg.Subject)
+			return
+		}
+		apps.SendEvent(hive.AppMessageToEvent{
+			Aid:        aid,
+			Uid:        hive.SYSUID,
+			RawMessage: msg.Data,
+			Binary:     msg.Header.Get("Content-Type") == "application/octet-stream",
+			Instance:   msg.Header.Get("Instance"),
+		})
+	})
+	return err
+}
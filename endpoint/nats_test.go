@@ -0,0 +1,275 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stepan-s/ws-bro/backplane"
+	"github.com/stepan-s/ws-bro/hive"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Nats server on a random port, stopped with the test
+func testNatsServer(t *testing.T) string {
+	options := natsserver.DefaultTestOptions
+	options.Port = -1
+	server := natsserver.RunServer(&options)
+	t.Cleanup(server.Shutdown)
+	return server.ClientURL()
+}
+
+func testNatsConnect(t *testing.T, url string) *nats.Conn {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+// Hives exporting to and injected from nats
+func testNatsHives(t *testing.T) (*hive.Users, *hive.Apps, *nats.Conn, chan *nats.Msg) {
+	url := testNatsServer(t)
+	conn := testNatsConnect(t, url)
+	listener := testNatsConnect(t, url)
+	exported := make(chan *nats.Msg, 100)
+	_, err := listener.ChanSubscribe("wsbro.*.*.data", exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = listener.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	t.Cleanup(stop)
+	users := hive.NewUsers(ctx, hive.NewUsersStats())
+	apps := hive.NewApps(ctx, "", hive.NewAppsStats())
+	hive.RouterStart(ctx, users, apps)
+	exporter := NewNatsExporter(conn)
+	users.SetExporter(exporter)
+	apps.SetExporter(exporter)
+	err = BindNats(users, apps, conn, "wsbro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users, apps, conn, exported
+}
+
+func TestNatsInject(t *testing.T) {
+	tests := []struct {
+		name   string
+		binary bool
+	}{
+		{"json", false},
+		{"binary", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, _, conn, _ := testNatsHives(t)
+			user := newTestConnection()
+			users.ConnectionAdd(201, user)
+			user.next(t)
+
+			msg := nats.NewMsg("wsbro.to.user.201")
+			msg.Data = []byte(`{"N":1}`)
+			if test.binary {
+				msg.Header.Set("Content-Type", "application/octet-stream")
+			}
+			err := conn.PublishMsg(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case frame := <-user.frames:
+				if string(frame.Data) != `{"N":1}` || frame.Binary != test.binary {
+					t.Errorf("user got %s, binary %v", frame.Data, frame.Binary)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("no frame sent")
+			}
+		})
+	}
+}
+
+func TestNatsExport(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    uint8
+		subject string
+	}{
+		{"user data", hive.ROLE_OPERATOR, "wsbro.user.202.data"},
+		// rejected data is not exported
+		{"user data not allowed", hive.ROLE_VIEWER, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps, _, exported := testNatsHives(t)
+			aid := uuid.New()
+			app := newTestConnection()
+			apps.ConnectionAdd(aid, "", app)
+			user := newTestConnection()
+			users.ConnectionAdd(202, user)
+			user.next(t)
+			apps.UpdateUids(hive.AppUidsEvent{Cmd: hive.ADD, Aid: aid, Uids: []uint32{202}, Roles: map[uint32]uint8{202: test.role}})
+			user.next(t)
+
+			users.ConnectionMessage(202, user, []byte(fmt.Sprintf(`{"Action":"sendData","To":"%s","Data":{"N":1}}`, aid)), false)
+			select {
+			case msg := <-exported:
+				if test.subject == "" {
+					t.Fatalf("exported %s: %s", msg.Subject, msg.Data)
+				}
+				if msg.Subject != test.subject || !strings.Contains(string(msg.Data), `"Action":"receivedData"`) {
+					t.Errorf("exported %s: %s", msg.Subject, msg.Data)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if test.subject != "" {
+					t.Fatal("nothing exported")
+				}
+			}
+		})
+	}
+}
+
+func TestNatsExportApp(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		exported bool
+	}{
+		{"data", `{"Action":"sendData","Data":{"N":1}}`, true},
+		{"invalid action", `{"Action":"unknown","Data":{"N":1}}`, false},
+		{"forged notice", `{"Action":"sentData","Data":{"N":1}}`, false},
+		{"invalid json", `{"Action":`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, apps, _, exported := testNatsHives(t)
+			aid := uuid.New()
+			app := newTestConnection()
+			apps.ConnectionAdd(aid, "", app)
+			for apps.GetApp(aid) == nil {
+				time.Sleep(time.Millisecond)
+			}
+
+			apps.ConnectionMessage(aid, "", []byte(test.message), false)
+			select {
+			case msg := <-exported:
+				if !test.exported {
+					t.Fatalf("exported %s: %s", msg.Subject, msg.Data)
+				}
+				if msg.Subject != "wsbro.app."+aid.String()+".data" {
+					t.Errorf("subject %s", msg.Subject)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if test.exported {
+					t.Fatal("nothing exported")
+				}
+			}
+		})
+	}
+}
+
+// Exported app data published back to a user by a nats client
+func TestNatsRoundTrip(t *testing.T) {
+	users, apps, conn, exported := testNatsHives(t)
+	aid := uuid.New()
+	app := newTestConnection()
+	apps.ConnectionAdd(aid, "", app)
+	for apps.GetApp(aid) == nil {
+		time.Sleep(time.Millisecond)
+	}
+	user := newTestConnection()
+	users.ConnectionAdd(204, user)
+	user.next(t)
+
+	apps.ConnectionMessage(aid, "", []byte(`{"Action":"sendData","Data":{"N":1}}`), false)
+	var data []byte
+	select {
+	case msg := <-exported:
+		data = msg.Data
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing exported")
+	}
+	err := conn.Publish("wsbro.to.user.204", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := user.next(t)
+	if got != string(data) {
+		t.Errorf("user got %s, exported %s", got, data)
+	}
+}
+
+// Injected message is taken by one node, the other node gets it over the cluster
+func TestNatsInjectCluster(t *testing.T) {
+	url := testNatsServer(t)
+	ctx, stop := context.WithCancel(context.Background())
+	t.Cleanup(stop)
+	var nodes []*hive.Users
+	for _, node := range []string{"node1", "node2"} {
+		conn := testNatsConnect(t, url)
+		users := hive.NewUsers(ctx, hive.NewUsersStats())
+		apps := hive.NewApps(ctx, "", hive.NewAppsStats())
+		hive.RouterStart(ctx, users, apps)
+		_, err := hive.NewCluster(ctx, node, backplane.NewNats(conn), users, apps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = BindNats(users, apps, conn, "wsbro")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = conn.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, users)
+	}
+	// both nodes listen to presence before users connect
+	var tabs []*testConnection
+	for _, users := range nodes {
+		tab := newTestConnection()
+		users.ConnectionAdd(205, tab)
+		tab.next(t)
+		tabs = append(tabs, tab)
+	}
+
+	publisher := testNatsConnect(t, url)
+	// nodes learn presence of each other, probe until both tabs get a message
+	deadline := time.Now().Add(2 * time.Second)
+	for (len(tabs[0].frames) == 0 || len(tabs[1].frames) == 0) && time.Now().Before(deadline) {
+		err := publisher.Publish("wsbro.to.user.205", []byte(`{"Probe":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, tab := range tabs {
+		for len(tab.frames) > 0 {
+			<-tab.frames
+		}
+	}
+
+	err := publisher.Publish("wsbro.to.user.205", []byte(`{"N":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	for i, tab := range tabs {
+		if len(tab.frames) != 1 {
+			t.Errorf("tab %d got %d frames", i, len(tab.frames))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package endpoint
+
+import (
+	"errors"
+	"github.com/gobwas/ws"
+	"github.com/gorilla/websocket"
+	"github.com/stepan-s/ws-bro/hive"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Netpoll Serve connections by netpoll workers instead of goroutines, nil - disabled
+var Netpoll *hive.Netpoll
+
+// Upgrade connection for netpoll, returns negotiated subprotocol, the error response is written on fail
+func upgradePolled(w http.ResponseWriter, r *http.Request) (net.Conn, string, error) {
+	// server preference as for the goroutine connections
+	protocol := ""
+	offered := websocket.Subprotocols(r)
+	for _, supported := range hive.CodecSubprotocols {
+		for _, item := range offered {
+			if item == supported && protocol == "" {
+				protocol = item
+			}
+		}
+	}
+
+	upgrader := ws.HTTPUpgrader{
+		Timeout: 5 * time.Second,
+		Protocol: func(item string) bool {
+			return item == protocol
+		},
+	}
+	conn, rw, _, err := upgrader.Upgrade(r, w)
+	if err != nil {
+		if conn != nil {
+			_ = conn.Close()
+		}
+		return nil, "", err
+	}
+	if rw.Reader.Buffered() > 0 {
+		// the read buffer is not kept
+		_ = conn.Close()
+		return nil, "", errors.New("data before handshake completed")
+	}
+	return conn, protocol, nil
+}
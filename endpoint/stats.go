@@ -87,6 +87,76 @@ func BindMetrics(u UsersStats, a AppsStats, pattern string) {
 		}, func() float64 {
 			return float64(u.GetData().MessagesTransmitted)
 		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_users_compressed_bytes_in",
+			Help: "The total number of user message bytes before compression",
+		}, func() float64 {
+			return float64(u.GetData().CompressedBytesIn)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_users_compressed_bytes_out",
+			Help: "The total number of user message bytes after compression",
+		}, func() float64 {
+			return float64(u.GetData().CompressedBytesOut)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_users_messages_dropped",
+			Help: "The total number of messages to user dropped by slow consumer policy",
+		}, func() float64 {
+			return float64(u.GetData().MessagesDropped)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_users_messages_conflated",
+			Help: "The total number of queued messages to user replaced by newer ones",
+		}, func() float64 {
+			return float64(u.GetData().MessagesConflated)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_users_slow_disconnects",
+			Help: "The total number of user connections closed as slow consumers",
+		}, func() float64 {
+			return float64(u.GetData().SlowDisconnects)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_users_messages_throttled",
+			Help: "The total number of messages from user rejected by rate limits",
+		}, func() float64 {
+			return float64(u.GetData().MessagesThrottled)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_users_abuse_disconnects",
+			Help: "The total number of user connections closed for rate limit abuse",
+		}, func() float64 {
+			return float64(u.GetData().AbuseDisconnects)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_users_messages_rejected",
+			Help: "The total number of too big or complex messages from user",
+		}, func() float64 {
+			return float64(u.GetData().MessagesRejected)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_users_compression_bytes_in",
+			Help: "The total number of bytes of compressed user messages before compression",
+		}, func() float64 {
+			return float64(u.GetData().CompressedBytesIn)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_users_compression_bytes_out",
+			Help: "The total number of bytes of compressed user messages after compression",
+		}, func() float64 {
+			return float64(u.GetData().CompressedBytesOut)
+		}))
 
 	prometheus.MustRegister(prometheus.NewCounterFunc(
 		prometheus.CounterOpts{
@@ -116,6 +186,76 @@ func BindMetrics(u UsersStats, a AppsStats, pattern string) {
 		}, func() float64 {
 			return float64(a.GetData().MessagesTransmitted)
 		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_apps_compressed_bytes_in",
+			Help: "The total number of app message bytes before compression",
+		}, func() float64 {
+			return float64(a.GetData().CompressedBytesIn)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_apps_compressed_bytes_out",
+			Help: "The total number of app message bytes after compression",
+		}, func() float64 {
+			return float64(a.GetData().CompressedBytesOut)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_apps_messages_dropped",
+			Help: "The total number of messages to app dropped by slow consumer policy",
+		}, func() float64 {
+			return float64(a.GetData().MessagesDropped)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_apps_messages_conflated",
+			Help: "The total number of queued messages to app replaced by newer ones",
+		}, func() float64 {
+			return float64(a.GetData().MessagesConflated)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_apps_slow_disconnects",
+			Help: "The total number of app connections closed as slow consumers",
+		}, func() float64 {
+			return float64(a.GetData().SlowDisconnects)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_apps_messages_throttled",
+			Help: "The total number of messages from app rejected by rate limits",
+		}, func() float64 {
+			return float64(a.GetData().MessagesThrottled)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_apps_abuse_disconnects",
+			Help: "The total number of app connections closed for rate limit abuse",
+		}, func() float64 {
+			return float64(a.GetData().AbuseDisconnects)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_apps_messages_rejected",
+			Help: "The total number of too big or complex messages from app",
+		}, func() float64 {
+			return float64(a.GetData().MessagesRejected)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_apps_compression_bytes_in",
+			Help: "The total number of bytes of compressed app messages before compression",
+		}, func() float64 {
+			return float64(a.GetData().CompressedBytesIn)
+		}))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "wsbro_apps_compression_bytes_out",
+			Help: "The total number of bytes of compressed app messages after compression",
+		}, func() float64 {
+			return float64(a.GetData().CompressedBytesOut)
+		}))
 	prometheus.MustRegister(prometheus.NewCounterFunc(
 		prometheus.CounterOpts{
 			Name: "wsbro_apps_total_disconnects",
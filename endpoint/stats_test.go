@@ -0,0 +1,65 @@
+package endpoint
+
+import (
+	"fmt"
+	"github.com/stepan-s/ws-bro/hive"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type testUsersStats struct {
+	data hive.UsersStatsData
+}
+
+func (s *testUsersStats) GetData() hive.UsersStatsData {
+	return s.data
+}
+
+type testAppsStats struct {
+	data hive.AppsStatsData
+}
+
+func (s *testAppsStats) GetData() hive.AppsStatsData {
+	return s.data
+}
+
+func TestMetricsCompression(t *testing.T) {
+	users := &testUsersStats{}
+	apps := &testAppsStats{}
+	BindMetrics(users, apps, "/metrics")
+
+	tests := []struct {
+		name string
+		in   uint64
+		out  uint64
+	}{
+		{"compressed", 1000, 300},
+		// incompressible messages grow, counters still only go up
+		{"grown", 1100, 450},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users.data.CompressedBytesIn = test.in
+			users.data.CompressedBytesOut = test.out
+			apps.data.CompressedBytesIn = test.in
+			apps.data.CompressedBytesOut = test.out
+
+			w := testServe(testRequest(http.MethodGet, "/metrics", ""))
+			body, _ := ioutil.ReadAll(w.Body)
+			for _, want := range []string{
+				"# TYPE wsbro_users_compression_bytes_in counter",
+				"# TYPE wsbro_apps_compression_bytes_out counter",
+				fmt.Sprintf("wsbro_users_compression_bytes_in %d", test.in),
+				fmt.Sprintf("wsbro_users_compression_bytes_out %d", test.out),
+				fmt.Sprintf("wsbro_apps_compression_bytes_in %d", test.in),
+				fmt.Sprintf("wsbro_apps_compression_bytes_out %d", test.out),
+			} {
+				if !strings.Contains(string(body), want+"\n") {
+					t.Errorf("no %q in metrics", want)
+				}
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package endpoint
 import (
 	"crypto/sha256"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/stepan-s/ws-bro/hive"
 	"github.com/stepan-s/ws-bro/log"
@@ -21,8 +22,14 @@ func SignUserAuth(uid uint32, ts int64, authKey string) string {
 	return fmt.Sprintf("%x", hash.Sum(nil))
 }
 
+func SignGuestAuth(grant uuid.UUID, expires int64, authKey string) string {
+	hash := sha256.New()
+	hash.Write([]byte(fmt.Sprintf("guest:%s:%d:%s", grant.String(), expires, authKey)))
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
 // Bind http handler
-func BindUsers(users *hive.Users, pattern string, allowedOrigins string, authKey string) {
+func BindUsers(users *hive.Users, apps *hive.Apps, pattern string, allowedOrigins string, authKey string, options hive.ConnectionOptions, admission *Admission) {
 
 	origins := make(map[string]bool)
 	{
@@ -33,6 +40,8 @@ func BindUsers(users *hive.Users, pattern string, allowedOrigins string, authKey
 	}
 
 	var upgrader = websocket.Upgrader{
+		Subprotocols:      hive.CodecSubprotocols,
+		EnableCompression: options.Compression,
 		CheckOrigin: func(r *http.Request) bool {
 			origin := r.Header.Get("Origin")
 			u, err := url.Parse(origin)
@@ -61,10 +70,70 @@ func BindUsers(users *hive.Users, pattern string, allowedOrigins string, authKey
 	}
 
 	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if refuseDraining(w) {
+			return
+		}
+		if !admission.enter(w) {
+			return
+		}
+		defer admission.leave()
+
+		// checked before a grant is used
+		if !upgrader.CheckOrigin(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
 		// Auth
 		var uid uint32 = 0
-		{
-			rUid, err := strconv.ParseInt(r.URL.Query().Get("uid"), 10, 32)
+		guest := false
+		if r.URL.Query().Get("grant") != "" {
+			grant, err := uuid.Parse(r.URL.Query().Get("grant"))
+			if err != nil {
+				w.Header().Add("X-Error", "Invalid grant")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			sign := r.URL.Query().Get("sign")
+			if sign == "" {
+				w.Header().Add("X-Error", "Empty sign")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+			if err != nil {
+				w.Header().Add("X-Error", "Invalid expires")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			if time.Now().Unix() >= expires {
+				log.Warning("Decline connection, reason: expired grant: %s", grant.String())
+				w.Header().Add("X-Error", "Expired sign")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			if SignGuestAuth(grant, expires, authKey) != sign {
+				log.Warning("Decline connection, reason: incorrect sign for grant: %s", grant.String())
+				w.Header().Add("X-Error", "Invalid sign")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			uid = apps.UseGrant(grant)
+			if uid == 0 {
+				log.Warning("Decline connection, reason: unusable grant: %s", grant.String())
+				w.Header().Add("X-Error", "Unusable grant")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			guest = true
+		} else {
+			// regular uids never exceed int32, the rest are guest uids
+			rUid, err := strconv.ParseUint(r.URL.Query().Get("uid"), 10, 31)
 			if err != nil {
 				w.Header().Add("X-Error", "Invalid uid")
 				w.WriteHeader(http.StatusBadRequest)
@@ -105,15 +174,40 @@ func BindUsers(users *hive.Users, pattern string, allowedOrigins string, authKey
 		}
 
 		// Accept connection
-		conn, err := upgrader.Upgrade(w, r, nil)
+		if Netpoll != nil {
+			conn, protocol, err := upgradePolled(w, r)
+			if err != nil {
+				log.Error("Upgrade connection error: %v", err)
+				if guest {
+					apps.ReleaseGuest(uid)
+				}
+				return
+			}
+
+			log.Debug("User-Agent: %v", r.Header.Get("User-Agent"))
+
+			_, err = hive.NewPolledUserConnection(Netpoll, users, uid, conn, protocol, options)
+			if err != nil {
+				log.Error("Poll connection error: %v", err)
+				_ = conn.Close()
+				if guest {
+					apps.ReleaseGuest(uid)
+				}
+			}
+			return
+		}
+		conn, err := upgrader.Upgrade(compressionResponseWriter(w, r, options), r, nil)
 		if err != nil {
 			log.Error("Upgrade connection error: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
+			if guest {
+				apps.ReleaseGuest(uid)
+			}
 			return
 		}
 
 		log.Debug("User-Agent: %v", r.Header.Get("User-Agent"))
 
-		hive.NewUserConnection(users, uid, conn)
+		hive.NewUserConnection(users, uid, conn, options)
 	})
 }
@@ -0,0 +1,78 @@
+package endpoint
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stepan-s/ws-bro/hive"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUserHandshake(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name   string
+		uid    string
+		origin string
+		status int
+	}{
+		{"negative uid", "-1", "https://example.com", http.StatusBadRequest},
+		{"guest range uid", "2147483648", "https://example.com", http.StatusBadRequest},
+		{"invalid uid", "user", "https://example.com", http.StatusBadRequest},
+		{"disallowed origin", "5", "https://example.org", http.StatusForbidden},
+		// a plain request is not upgraded
+		{"signed", "5", "https://www.example.com", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var uid uint32
+			fmt.Sscan(test.uid, &uid)
+			target := fmt.Sprintf("/bro?uid=%s&ts=%d&sign=%s", test.uid, now, SignUserAuth(uid, now, testAuthKey))
+			r := testRequest(http.MethodGet, target, "")
+			r.Header.Set("Origin", test.origin)
+			w := testServe(r)
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestGuestHandshake(t *testing.T) {
+	aid := uuid.New()
+	testApp(t, aid)
+
+	tests := []struct {
+		name   string
+		origin string
+		status int
+	}{
+		{"disallowed origin", "https://example.org", http.StatusForbidden},
+		{"upgrade failed", "https://example.com", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grant := hive.ShareGrant{Id: uuid.New(), Aid: aid, Role: hive.ROLE_VIEWER, Expires: time.Now().Add(time.Minute), MaxUses: 1}
+			testApps.AddGrant(grant)
+			expires := grant.Expires.Unix()
+			target := fmt.Sprintf("/bro?grant=%s&expires=%d&sign=%s", grant.Id, expires, SignGuestAuth(grant.Id, expires, testAuthKey))
+			r := testRequest(http.MethodGet, target, "")
+			r.Header.Set("Origin", test.origin)
+			w := testServe(r)
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+
+			// the only use is left for a connected guest
+			deadline := time.Now().Add(time.Second)
+			var uid uint32
+			for uid == 0 && time.Now().Before(deadline) {
+				uid = testApps.UseGrant(grant.Id)
+			}
+			if uid == 0 {
+				t.Error("grant is used by a failed handshake")
+			}
+		})
+	}
+}
@@ -9,24 +9,44 @@ import (
 )
 
 type AppConnection struct {
-	handler AAppHandler
-	aid     uuid.UUID
-	conn    *websocket.Conn
-	send    chan []byte
+	handler  AAppHandler
+	aid      uuid.UUID
+	instance string
+	id       uint64
+	conn     *websocket.Conn
+	send     *sendQueue
+	counter  *CountingConn
+	connectionBase
 }
 
-func NewAppConnection(handler AAppHandler, aid uuid.UUID, conn *websocket.Conn) *AppConnection {
+func NewAppConnection(handler AAppHandler, aid uuid.UUID, instance string, conn *websocket.Conn, options ConnectionOptions) *AppConnection {
 	c := &AppConnection{
-		handler: handler,
-		aid:     aid,
-		conn:    conn,
-		send:    make(chan []byte, 10),
+		handler:  handler,
+		aid:      aid,
+		instance: instance,
+		id:       nextConnectionId(),
+		conn:     conn,
+		send:     newSendQueue(options),
+	}
+	c.connectionBase = connectionBase{
+		sender:  c,
+		codec:   CodecBySubprotocol(conn.Subprotocol()),
+		options: options,
+		name:    "app:" + aid.String(),
+	}
+	c.ip, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	if options.Compression {
+		err := conn.SetCompressionLevel(options.CompressionLevel)
+		if err != nil {
+			log.Error("Fail set compression level: %v, app:%v", err, aid)
+		}
+		c.counter, _ = conn.UnderlyingConn().(*CountingConn)
 	}
 	conn.SetPongHandler(func(appData string) error {
 		_ = conn.SetReadDeadline(time.Now().Add(70 * time.Second))
 		return nil
 	})
-	handler.ConnectionAdd(aid, c)
+	handler.ConnectionAdd(aid, instance, c)
 	return c
 }
 
@@ -34,7 +54,7 @@ func (c *AppConnection) Start() {
 	go func() {
 		defer func() {
 			// Remove app connection
-			c.handler.ConnectionRemove(c.aid, c)
+			c.handler.ConnectionRemove(c.aid, c.instance, c)
 
 			// close
 			err := c.conn.Close()
@@ -45,7 +65,11 @@ func (c *AppConnection) Start() {
 
 		_ = c.conn.SetReadDeadline(time.Now().Add(70 * time.Second))
 		for {
-			mt, message, err := c.conn.ReadMessage()
+			mt, message, err := readLimited(c.conn, c.options.MaxMessageSize)
+			if err == errMessageTooBig {
+				c.reject("Message too big")
+				continue
+			}
 			if err != nil {
 				if err.Error() != "websocket: close 1005 (no status)" &&
 					err.Error() != "websocket: close 1001 (going away)" &&
@@ -54,8 +78,9 @@ func (c *AppConnection) Start() {
 				}
 				break
 			}
-			if mt == websocket.TextMessage {
-				c.handler.ConnectionMessage(c.aid, message)
+			message, binary, ok := c.accept(message, mt == websocket.BinaryMessage)
+			if ok {
+				c.handler.ConnectionMessage(c.aid, c.instance, message, binary)
 			}
 		}
 	}()
@@ -66,7 +91,7 @@ func (c *AppConnection) Start() {
 			ticker.Stop()
 
 			// Remove app connection
-			c.handler.ConnectionRemove(c.aid, c)
+			c.handler.ConnectionRemove(c.aid, c.instance, c)
 
 			// close
 			err := c.conn.Close()
@@ -77,16 +102,19 @@ func (c *AppConnection) Start() {
 
 		for {
 			select {
-			case msg, ok := <-c.send:
-				_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
-				if !ok {
-					_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-					return
+			case <-c.send.ready:
+				frames, closed := c.send.pop()
+				for _, frame := range frames {
+					_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+					err := c.writeFrame(c.conn, c.counter, frame)
+					if err != nil {
+						log.Error("Send error: %v", err)
+						return
+					}
 				}
-
-				err := c.conn.WriteMessage(websocket.TextMessage, msg)
-				if err != nil {
-					log.Error("Send error: %v", err)
+				if closed {
+					_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+					_ = c.conn.WriteMessage(websocket.CloseMessage, c.send.closeMessage())
 					return
 				}
 			case <-ticker.C:
@@ -100,14 +128,21 @@ func (c *AppConnection) Start() {
 	}()
 }
 
-func (c *AppConnection) Send(message []byte) {
-	if len(c.send) < cap(c.send) {
-		c.send <- message
-	}
+func (c *AppConnection) Send(message Frame) {
+	c.send.push(message)
 }
 
 func (c *AppConnection) Close() {
-	close(c.send)
+	c.send.close()
+}
+
+// CloseWithCode Close after queued frames with close code
+func (c *AppConnection) CloseWithCode(code int, text string) {
+	c.send.closeWithCode(code, text)
+}
+
+func (c *AppConnection) Id() uint64 {
+	return c.id
 }
 
 func (c *AppConnection) RemoteAddr() net.Addr {
@@ -1,32 +1,53 @@
 package hive
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/google/uuid"
 	"github.com/stepan-s/ws-bro/log"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"time"
 )
 
-// AppMessageToEvent A message to app
+// AppMessageToEvent A message to app, if RawMessage is nil Data is packed as received data
 type AppMessageToEvent struct {
 	Aid        uuid.UUID
 	Uid        uint32
 	RawMessage []byte
+	Data       json.RawMessage
+	Id         string
+	Source     AConnection
+	Binary     bool
+	// Target instance, empty - all instances
+	Instance string
+	// Sender connection id, if Source is not set
+	Cid uint64
 }
 
-// AppMessageFromEvent A message from app
+// AppMessageFromEvent A message from app, Source is the user connection to skip
 type AppMessageFromEvent struct {
 	Aid        uuid.UUID
 	Uids       []uint32
 	RawMessage []byte
+	Source     AConnection
+	Binary     bool
+	// Sender instance
+	Instance string
+	// Generated by the hive, apps can not send errors, control changes and sent data
+	Notice bool
+	// Skipped user connection id, if Source is not set
+	SkipCid uint64
 }
 
 // A connection message
 type appConnectionEvent struct {
-	cmd  uint8
-	aid  uuid.UUID
-	conn AConnection
+	cmd      uint8
+	aid      uuid.UUID
+	instance string
+	conn     AConnection
 }
 
 type appGetUidsEvent struct {
@@ -35,130 +56,421 @@ type appGetUidsEvent struct {
 }
 
 type AppUidsEvent struct {
-	Cmd  uint8
-	Aid  uuid.UUID
-	Uids []uint32
+	Cmd   uint8
+	Aid   uuid.UUID
+	Uids  []uint32
+	Roles map[uint32]uint8
+}
+
+// Uid role, owner if not specified
+func (event *AppUidsEvent) role(uid uint32) uint8 {
+	role, exists := event.Roles[uid]
+	if !exists || role == 0 {
+		return ROLE_OWNER
+	}
+	return role
 }
 
 type appConnectedEvent struct {
-	uid  uint32
-	aids []uuid.UUID
+	uid   uint32
+	aids  []uuid.UUID
+	reply chan []appConnection
+	// asked by other node, empty reply is not sent
+	remote bool
+}
+
+type appUidsQueryEvent struct {
+	aid   uuid.UUID
+	reply chan []uint32
+}
+
+type appInfoQueryEvent struct {
+	aid   uuid.UUID
+	reply chan *AppInfo
+}
+
+type appListQueryEvent struct {
+	offset int
+	limit  int
+	reply  chan AppList
+}
+
+type appAidsQueryEvent struct {
+	uid   uint32
+	reply chan []uuid.UUID
+}
+
+// AppInfo A connected app snapshot, Ip and ConnectedAt are of the first instance
+type AppInfo struct {
+	Aid         uuid.UUID
+	Ip          string
+	ConnectedAt time.Time
+	Uids        []uint32
+	Roles       map[uint32]string
+	Instances   []AppInstanceInfo
+}
+
+// AppInstanceInfo A connected app instance snapshot
+type AppInstanceInfo struct {
+	Instance    string
+	Ip          string
+	ConnectedAt time.Time
+}
+
+// AppList A page of connected apps snapshot
+type AppList struct {
+	Total int
+	List  []AppInfo
+}
+
+type appOptionsEvent struct {
+	aid    uuid.UUID
+	mirror bool
+}
+
+type appShareEvent struct {
+	cmd    uint8
+	uid    uint32
+	aid    uuid.UUID
+	target uint32
+	role   uint8
+}
+
+// A connection of app process, untagged connection is the "" instance
+type appInstance struct {
+	conn        AConnection
+	connectedAt time.Time
 }
 
 type App struct {
-	uids []uint32
-	conn AConnection
+	uids      []uint32
+	roles     map[uint32]uint8
+	instances map[string]*appInstance
+	lease     appLease
+	mirror    bool
+}
+
+// Send frame to all instances or a named one, false if instance is not connected
+func (app *App) send(instance string, frame Frame) bool {
+	if instance != "" {
+		item, exists := app.instances[instance]
+		if !exists {
+			return false
+		}
+		item.conn.Send(frame)
+		return true
+	}
+	for _, item := range app.instances {
+		item.conn.Send(frame)
+	}
+	return true
+}
+
+// First instance by name
+func (app *App) primary() *appInstance {
+	var primary *appInstance
+	var primaryName string
+	for name, item := range app.instances {
+		if primary == nil || name < primaryName {
+			primary = item
+			primaryName = name
+		}
+	}
+	return primary
+}
+
+func (app *App) ip() string {
+	return app.primary().conn.RemoteAddr().String()
+}
+
+// Attach uid or update its role, true if uid is new
+func (app *App) attach(uid uint32, role uint8) bool {
+	_, exists := app.roles[uid]
+	app.roles[uid] = role
+	if !exists {
+		app.uids = append(app.uids, uid)
+	}
+	return !exists
+}
+
+// Detach uid, true if uid was attached
+func (app *App) detach(uid uint32) bool {
+	_, exists := app.roles[uid]
+	if !exists {
+		return false
+	}
+	delete(app.roles, uid)
+	if app.lease.uid == uid {
+		app.lease = appLease{}
+	}
+	// uids may be in use by the router, copy
+	uids := make([]uint32, 0, len(app.uids))
+	for _, item := range app.uids {
+		if item != uid {
+			uids = append(uids, item)
+		}
+	}
+	app.uids = uids
+	return true
 }
 
 // Apps A apps hive
 type Apps struct {
 	conns         map[uuid.UUID]*App
 	chanIn        chan AppMessageToEvent
+	chanBatch     chan []AppMessageToEvent
+	chanBroadcast chan Frame
 	chanOutUids   chan AppMessageFromEvent
 	chanOut       chan AppMessageFromEvent
 	chanConn      chan appConnectionEvent
 	chanGetUids   chan appGetUidsEvent
 	chanUids      chan AppUidsEvent
 	chanConnected chan appConnectedEvent
+	chanUidsQuery chan appUidsQueryEvent
+	chanInfoQuery chan appInfoQueryEvent
+	chanListQuery chan appListQueryEvent
+	chanAidsQuery chan appAidsQueryEvent
+	chanShare     chan appShareEvent
+	chanGrant     chan appGrantEvent
+	chanUseGrant  chan appUseGrantEvent
+	chanFreeGuest chan uint32
+	grants        map[uuid.UUID]*shareGrant
+	chanControl   chan appControlEvent
+	chanUserGone  chan uint32
+	chanOptions   chan appOptionsEvent
+	chanRemote    chan AppMessageToEvent
+	chanDrain     chan time.Duration
+	draining      bool
+	remote        ARemote
+	exporter      AExporter
+	leases        map[uuid.UUID]bool
 	stats         AAppStat
 	uidsApiUrl    string
+	uidsClient    *http.Client
+	shards        []*Apps
 }
 
 type uidsReponse struct {
-	Uids []uint32
+	Uids  []uint32
+	Roles map[uint32]string
+}
+
+// NewApps Instantiate apps hive, apps are spread over HiveShards event loops until ctx is done
+func NewApps(ctx context.Context, uidsApiUrl string, stats AAppStat) *Apps {
+	apps := new(Apps)
+	apps.chanGetUids = make(chan appGetUidsEvent, 10000)
+	apps.uidsApiUrl = uidsApiUrl
+	apps.uidsClient = uidsClient
+	apps.stats = stats
+	apps.shards = make([]*Apps, shardsCount())
+	for i := range apps.shards {
+		apps.shards[i] = newAppsShard(ctx, apps)
+	}
+	for w := 0; w < 4; w++ {
+		go apps.getUidsWorker(ctx)
+	}
+	return apps
 }
 
-// NewApps Instantiate apps hive
-func NewApps(uidsApiUrl string, stats AAppStat) *Apps {
+// Instantiate apps event loop, uids requests are served by the root workers
+func newAppsShard(ctx context.Context, root *Apps) *Apps {
 	apps := new(Apps)
 	apps.conns = make(map[uuid.UUID]*App)
 	apps.chanIn = make(chan AppMessageToEvent, 10000)
+	apps.chanBatch = make(chan []AppMessageToEvent, 10000)
+	apps.chanBroadcast = make(chan Frame, 10000)
 	apps.chanOutUids = make(chan AppMessageFromEvent, 10000)
 	apps.chanOut = make(chan AppMessageFromEvent, 10000)
 	apps.chanConn = make(chan appConnectionEvent, 10000)
-	apps.chanGetUids = make(chan appGetUidsEvent, 10000)
+	apps.chanGetUids = root.chanGetUids
 	apps.chanUids = make(chan AppUidsEvent, 10000)
 	apps.chanConnected = make(chan appConnectedEvent, 10000)
-	apps.uidsApiUrl = uidsApiUrl
-	apps.stats = stats
+	apps.chanUidsQuery = make(chan appUidsQueryEvent, 10000)
+	apps.chanInfoQuery = make(chan appInfoQueryEvent, 10000)
+	apps.chanListQuery = make(chan appListQueryEvent, 10000)
+	apps.chanAidsQuery = make(chan appAidsQueryEvent, 10000)
+	apps.chanShare = make(chan appShareEvent, 10000)
+	apps.chanGrant = make(chan appGrantEvent, 10000)
+	apps.chanUseGrant = make(chan appUseGrantEvent, 10000)
+	apps.chanFreeGuest = make(chan uint32, 10000)
+	apps.grants = make(map[uuid.UUID]*shareGrant)
+	apps.chanControl = make(chan appControlEvent, 10000)
+	apps.chanUserGone = make(chan uint32, 10000)
+	apps.chanOptions = make(chan appOptionsEvent, 10000)
+	apps.chanRemote = make(chan AppMessageToEvent, 10000)
+	apps.chanDrain = make(chan time.Duration, 1)
+	apps.leases = make(map[uuid.UUID]bool)
+	apps.stats = root.stats
+	// disconnects are queued aside, the routers may wait for this loop
+	gone := make(chan uint32)
+	go relayUids(ctx, apps.chanUserGone, gone)
 	go func() {
+		ticker := time.NewTicker(time.Second)
 		for {
 			select {
 			case event := <-apps.chanConn:
 				switch event.cmd {
 				case ADD:
-					apps.addConnection(event.aid, event.conn)
+					apps.addConnection(event.aid, event.instance, event.conn)
 				case REMOVE:
-					apps.removeConnection(event.aid, event.conn)
+					apps.removeConnection(event.aid, event.instance, event.conn)
 				}
 			case event := <-apps.chanIn:
+				apps.forward(event)
+			case events := <-apps.chanBatch:
+				for _, event := range events {
+					apps.forward(event)
+				}
+			case event := <-apps.chanRemote:
 				apps.sendEvent(event)
+			case frame := <-apps.chanBroadcast:
+				apps.broadcast(frame)
 			case event := <-apps.chanUids:
 				switch event.Cmd {
 				case ADD:
 					apps.addUids(event)
 				case REMOVE:
 					apps.removeUids(event)
+				case SET:
+					apps.setUids(event)
 				}
 			case event := <-apps.chanConnected:
 				apps.replyConnected(event)
+			case event := <-apps.chanUidsQuery:
+				apps.replyUids(event)
+			case event := <-apps.chanInfoQuery:
+				apps.replyInfo(event)
+			case event := <-apps.chanListQuery:
+				apps.replyList(event)
+			case event := <-apps.chanAidsQuery:
+				apps.replyAids(event)
+			case event := <-apps.chanShare:
+				apps.share(event)
+			case event := <-apps.chanGrant:
+				switch event.cmd {
+				case ADD:
+					apps.addGrant(event.grant)
+				case REMOVE:
+					apps.revokeGrant(event.grant.Id)
+				}
+			case event := <-apps.chanUseGrant:
+				apps.useGrant(event)
+			case uid := <-apps.chanFreeGuest:
+				apps.releaseGuest(uid, true)
+			case event := <-apps.chanControl:
+				apps.forwardControl(event)
+			case uid := <-gone:
+				apps.releaseControls(uid)
+				if IsGuestUid(uid) {
+					// a guest uid is issued per connection
+					apps.releaseGuest(uid, false)
+				}
+			case event := <-apps.chanOptions:
+				conn, exists := apps.conns[event.aid]
+				if exists {
+					conn.mirror = event.mirror
+				}
+			case <-ticker.C:
+				apps.expireGrants()
+				apps.expireLeases()
 			case event := <-apps.chanOutUids:
+				// unattached app still may send options
 				conn, exists := apps.conns[event.Aid]
-				if exists && len(conn.uids) > 0 {
+				if exists {
 					event.Uids = conn.uids
 					apps.chanOut <- event
 				}
+			case window := <-apps.chanDrain:
+				apps.drain(window)
+			case <-ctx.Done():
+				ticker.Stop()
+				return
 			}
 		}
 	}()
-	for w := 0; w < 4; w++ {
-		go apps.getUidsWorker()
-	}
 	return apps
 }
 
 // Register app connection
-func (apps *Apps) addConnection(aid uuid.UUID, conn AConnection) {
+func (apps *Apps) addConnection(aid uuid.UUID, instance string, conn AConnection) {
 	existApp, exists := apps.conns[aid]
 	if exists {
-		log.Info("Reconnect app: %v", aid)
-		apps.conns[aid] = &App{
-			uids: existApp.uids,
-			conn: conn,
+		existInstance, reconnect := existApp.instances[instance]
+		existApp.instances[instance] = &appInstance{
+			conn:        conn,
+			connectedAt: time.Now(),
+		}
+		if reconnect {
+			// options are kept while any instance is connected
+			log.Info("Reconnect app: %v, instance: %s", aid, instance)
+			existInstance.conn.Close()
+			apps.stats.Reconnected()
+		} else {
+			log.Info("Hello app instance: %v, instance: %s", aid, instance)
 		}
-		existApp.conn.Close()
-		apps.stats.Reconnected()
 	} else {
-		log.Info("Hello app: %v", aid)
+		log.Info("Hello app: %v, instance: %s", aid, instance)
 		apps.conns[aid] = &App{
-			uids: []uint32{},
-			conn: conn,
+			uids:  []uint32{},
+			roles: make(map[uint32]uint8),
+			instances: map[string]*appInstance{instance: {
+				conn:        conn,
+				connectedAt: time.Now(),
+			}},
 		}
 		apps.stats.Connected()
+		apps.attachGuests(aid, apps.conns[aid])
+		if apps.remote != nil {
+			apps.remote.AppPresence(aid, true)
+		}
+		apps.exportPresence(aid, ACTION_CONNECTED)
 
 		apps.chanGetUids <- appGetUidsEvent{aid, 0}
 	}
 
 	conn.Start()
+	if apps.draining {
+		drainConnection(conn)
+	}
 }
 
-func (apps *Apps) getUidsWorker() {
+func (apps *Apps) getUidsWorker(ctx context.Context) {
 	for {
 		select {
 		case event := <-apps.chanGetUids:
+			if !uidsPace.wait(ctx) {
+				return
+			}
 			err, uids := apps.getUids(event.aid)
 			if err != nil && event.attempts < 10 {
 				event.attempts++
-				apps.chanGetUids <- event
+				// the api may be overloaded, back off
+				time.AfterFunc(uidsRetryDelay(event.attempts), func() {
+					apps.chanGetUids <- event
+				})
 			} else {
-				apps.chanUids <- AppUidsEvent{ADD, event.aid, uids}
+				uidsEvent := AppUidsEvent{Cmd: ADD, Aid: event.aid, Roles: make(map[uint32]uint8)}
+				if uids != nil {
+					uidsEvent.Uids = uids.Uids
+					for uid, name := range uids.Roles {
+						role, valid := RoleParse(name)
+						if !valid {
+							log.Error("Invalid role: %s, app:%v, user:%d", name, event.aid, uid)
+							continue
+						}
+						uidsEvent.Roles[uid] = role
+					}
+				}
+				apps.shard(event.aid).chanUids <- uidsEvent
 			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
 // Request uid list
-func (apps *Apps) getUids(aid uuid.UUID) (error, []uint32) {
+func (apps *Apps) getUids(aid uuid.UUID) (error, *uidsReponse) {
 	req, err := http.NewRequest("GET", apps.uidsApiUrl, nil)
 	if err != nil {
 		log.Error("Fail init request: %v", err)
@@ -169,12 +481,12 @@ func (apps *Apps) getUids(aid uuid.UUID) (error, []uint32) {
 	q.Add("aid", aid.String())
 	req.URL.RawQuery = q.Encode()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := apps.uidsClient.Do(req)
 	if err != nil {
 		log.Error("Fail do request: %v", err)
 		return err, nil
 	}
+	defer resp.Body.Close()
 
 	buf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -189,7 +501,7 @@ func (apps *Apps) getUids(aid uuid.UUID) (error, []uint32) {
 		return err, nil
 	}
 
-	return nil, uids.Uids
+	return nil, &uids
 }
 
 func (apps *Apps) addUids(event AppUidsEvent) {
@@ -200,24 +512,16 @@ func (apps *Apps) addUids(event AppUidsEvent) {
 
 	var added []uint32
 	for _, uid := range event.Uids {
-		add := true
-		// check exist
-		for _, item := range conn.uids {
-			if uid == item {
-				add = false
-				break
-			}
-		}
-		if add {
+		if conn.attach(uid, event.role(uid)) {
 			added = append(added, uid)
-			conn.uids = append(conn.uids, uid)
 		}
 	}
+	apps.exportAttachment(event.Aid, ACTION_ATTACHED, added)
 	rawMessage, err := MessageUserConnectedPack(&MessageUserConnected{
 		Action: ACTION_CONNECTED,
 		List: []appConnection{{
 			Aid: event.Aid,
-			Ip:  conn.conn.RemoteAddr().String(),
+			Ip:  conn.ip(),
 		}},
 	})
 	if err != nil {
@@ -227,6 +531,7 @@ func (apps *Apps) addUids(event AppUidsEvent) {
 		Aid:        event.Aid,
 		Uids:       added,
 		RawMessage: rawMessage,
+		Notice:     true,
 	}
 }
 
@@ -236,36 +541,188 @@ func (apps *Apps) removeUids(event AppUidsEvent) {
 		return
 	}
 
-	var uids []uint32
+	var removed []uint32
+	for _, uid := range event.Uids {
+		if apps.detachUid(event.Aid, conn, uid) {
+			removed = append(removed, uid)
+		}
+	}
+	apps.exportAttachment(event.Aid, ACTION_DETACHED, removed)
+
+	rawMessage, err := MessageUserConnectedPack(&MessageUserConnected{
+		Action: ACTION_DISCONNECTED,
+		List: []appConnection{{
+			Aid: event.Aid,
+			Ip:  conn.ip(),
+		}},
+	})
+	if err != nil {
+		log.Error("Fail pack %v", err)
+	}
+	apps.chanOut <- AppMessageFromEvent{
+		Aid:        event.Aid,
+		Uids:       event.Uids,
+		RawMessage: rawMessage,
+		Notice:     true,
+	}
+}
+
+// Replace app uids, notify added and removed ones
+func (apps *Apps) setUids(event AppUidsEvent) {
+	conn, exists := apps.conns[event.Aid]
+	if !exists {
+		return
+	}
+
+	var removed []uint32
 	for _, item := range conn.uids {
-		left := true
-		// check remove
+		if IsGuestUid(item) {
+			// guests are managed by grants
+			continue
+		}
+		remove := true
+		// check left
 		for _, uid := range event.Uids {
 			if uid == item {
-				left = false
+				remove = false
 				break
 			}
 		}
-		if left {
-			uids = append(uids, item)
+		if remove {
+			removed = append(removed, item)
 		}
 	}
-	conn.uids = uids
+	for _, uid := range removed {
+		apps.detachUid(event.Aid, conn, uid)
+	}
 
-	rawMessage, err := MessageUserConnectedPack(&MessageUserConnected{
-		Action: ACTION_DISCONNECTED,
+	var added []uint32
+	for _, uid := range event.Uids {
+		if conn.attach(uid, event.role(uid)) {
+			added = append(added, uid)
+		}
+	}
+
+	apps.notifyAttached(event.Aid, conn, added)
+	apps.notifyDetached(event.Aid, removed)
+}
+
+// Send attached and connected to uids
+func (apps *Apps) notifyAttached(aid uuid.UUID, conn *App, uids []uint32) {
+	if len(uids) == 0 {
+		return
+	}
+	apps.exportAttachment(aid, ACTION_ATTACHED, uids)
+
+	rawMessage, err := MessageUserAttachedPack(&MessageUserAttached{
+		Action: ACTION_ATTACHED,
+		List:   []uuid.UUID{aid},
+	})
+	if err != nil {
+		log.Error("Fail pack %v", err)
+	} else {
+		apps.chanOut <- AppMessageFromEvent{
+			Aid:        aid,
+			Uids:       uids,
+			RawMessage: rawMessage,
+			Notice:     true,
+		}
+	}
+	rawMessage, err = MessageUserConnectedPack(&MessageUserConnected{
+		Action: ACTION_CONNECTED,
 		List: []appConnection{{
-			Aid: event.Aid,
-			Ip:  conn.conn.RemoteAddr().String(),
+			Aid: aid,
+			Ip:  conn.ip(),
 		}},
 	})
 	if err != nil {
 		log.Error("Fail pack %v", err)
+	} else {
+		apps.chanOut <- AppMessageFromEvent{
+			Aid:        aid,
+			Uids:       uids,
+			RawMessage: rawMessage,
+			Notice:     true,
+		}
+	}
+}
+
+// Send disconnected and detached to uids
+func (apps *Apps) notifyDetached(aid uuid.UUID, uids []uint32) {
+	if len(uids) == 0 {
+		return
+	}
+	apps.exportAttachment(aid, ACTION_DETACHED, uids)
+
+	rawMessage, err := MessageUserDisconnectedPack(&MessageUserDisconnected{
+		Action: ACTION_DISCONNECTED,
+		List:   []uuid.UUID{aid},
+	})
+	if err != nil {
+		log.Error("Fail pack %v", err)
+	} else {
+		apps.chanOut <- AppMessageFromEvent{
+			Aid:        aid,
+			Uids:       uids,
+			RawMessage: rawMessage,
+			Notice:     true,
+		}
+	}
+	rawMessage, err = MessageUserDetachedPack(&MessageUserDetached{
+		Action: ACTION_DETACHED,
+		List:   []uuid.UUID{aid},
+	})
+	if err != nil {
+		log.Error("Fail pack %v", err)
+	} else {
+		apps.chanOut <- AppMessageFromEvent{
+			Aid:        aid,
+			Uids:       uids,
+			RawMessage: rawMessage,
+			Notice:     true,
+		}
+	}
+}
+
+// Send error to uid
+func (apps *Apps) replyError(aid uuid.UUID, uid uint32, message string) {
+	rawMessage, err := MessageUserErrorPack(&MessageUserError{
+		Action: ACTION_ERROR,
+		Aid:    aid,
+		Error:  message,
+	})
+	if err != nil {
+		log.Error("Fail pack %v", err)
+		return
 	}
 	apps.chanOut <- AppMessageFromEvent{
-		Aid:        event.Aid,
-		Uids:       event.Uids,
+		Aid:        aid,
+		Uids:       []uint32{uid},
 		RawMessage: rawMessage,
+		Notice:     true,
+	}
+}
+
+// Attach or detach uid by app owner
+func (apps *Apps) share(event appShareEvent) {
+	conn, exists := apps.conns[event.aid]
+	if !exists {
+		return
+	}
+	if conn.roles[event.uid] < ROLE_OWNER {
+		apps.replyError(event.aid, event.uid, "Sharing is not allowed")
+		return
+	}
+
+	switch event.cmd {
+	case ADD:
+		if conn.attach(event.target, event.role) {
+			apps.notifyAttached(event.aid, conn, []uint32{event.target})
+		}
+	case REMOVE:
+		if apps.detachUid(event.aid, conn, event.target) {
+			apps.notifyDetached(event.aid, []uint32{event.target})
+		}
 	}
 }
 
@@ -278,13 +735,18 @@ func (apps *Apps) replyConnected(event appConnectedEvent) {
 				if uid == event.uid {
 					list = append(list, appConnection{
 						Aid: aid,
-						Ip:  conn.conn.RemoteAddr().String(),
+						Ip:  conn.ip(),
 					})
 					break
 				}
 			}
 		}
 	}
+	event.reply <- list
+}
+
+// Send connected apps to uid
+func (apps *Apps) sendConnected(uid uint32, list []appConnection) {
 	rawMessage, err := MessageUserConnectedPack(&MessageUserConnected{
 		Action: ACTION_CONNECTED,
 		List:   list,
@@ -294,18 +756,28 @@ func (apps *Apps) replyConnected(event appConnectedEvent) {
 	}
 	apps.chanOut <- AppMessageFromEvent{
 		Aid:        uuid.Nil,
-		Uids:       []uint32{event.uid},
+		Uids:       []uint32{uid},
 		RawMessage: rawMessage,
+		Notice:     true,
 	}
 }
 
 // Unregister app connection
-func (apps *Apps) removeConnection(aid uuid.UUID, theConn AConnection) {
+func (apps *Apps) removeConnection(aid uuid.UUID, instance string, theConn AConnection) {
 	conn, exists := apps.conns[aid]
 	if !exists {
 		return
 	}
-	if conn.conn != theConn {
+	item, exists := conn.instances[instance]
+	if !exists || item.conn != theConn {
+		return
+	}
+
+	delete(conn.instances, instance)
+	item.conn.Close()
+	if len(conn.instances) > 0 {
+		// app is still connected
+		log.Info("Bye app instance: %v, instance: %s", aid, instance)
 		return
 	}
 
@@ -320,70 +792,404 @@ func (apps *Apps) removeConnection(aid uuid.UUID, theConn AConnection) {
 		Aid:        aid,
 		Uids:       conn.uids,
 		RawMessage: rawMessage,
+		Notice:     true,
 	}
 
 	// No connection left - remove app
 	delete(apps.conns, aid)
-	conn.conn.Close()
+	delete(apps.leases, aid)
 	apps.stats.Disconnected()
+	if apps.remote != nil {
+		apps.remote.AppPresence(aid, false)
+	}
+	apps.exportPresence(aid, ACTION_DISCONNECTED)
 	log.Info("Bye app: %v", aid)
 }
 
+// Send message to local app or to the node it is connected to
+func (apps *Apps) forward(event AppMessageToEvent) {
+	_, exists := apps.conns[event.Aid]
+	if !exists && apps.remote != nil {
+		apps.remote.SendApp(event)
+		return
+	}
+	apps.sendEvent(event)
+}
+
 // Send message to all app connections
 func (apps *Apps) sendEvent(event AppMessageToEvent) {
 	app, exists := apps.conns[event.Aid]
-	if exists {
-		send := false
-		if event.Uid == SYSUID {
-			send = true
-		} else {
-			// check uid is linked to app
-			if app.uids != nil {
-				for _, item := range app.uids {
-					if event.Uid == item {
-						send = true
-						break
-					}
-				}
+	if !exists {
+		return
+	}
+
+	var role uint8 = ROLE_OWNER
+	if event.Uid != SYSUID {
+		// check uid is linked to app
+		role, exists = app.roles[event.Uid]
+		if !exists {
+			return
+		}
+		if role < ROLE_OPERATOR {
+			apps.replyError(event.Aid, event.Uid, "Sending is not allowed")
+			return
+		}
+		if !apps.checkControl(app, event.Uid) {
+			apps.replyError(event.Aid, event.Uid, "Control is held by another user")
+			return
+		}
+	}
+	if event.Instance != "" {
+		_, exists = app.instances[event.Instance]
+		if !exists {
+			if event.Uid != SYSUID {
+				apps.replyError(event.Aid, event.Uid, "Instance is not connected")
 			}
+			return
 		}
+	}
 
-		if send {
-			// uid can send to app
-			app.conn.Send(event.RawMessage)
-			apps.stats.Transmitted()
+	rawMessage := event.RawMessage
+	if rawMessage == nil {
+		var err error
+		cid := event.Cid
+		if event.Source != nil {
+			// the app can answer to the sender tab
+			cid = event.Source.Id()
+		}
+		// data is spliced, not encoded again
+		rawMessage, err = packAppReceivedData(event.Uid, cid, RoleName(role), event.Id, event.Data, event.Binary)
+		if err != nil {
+			log.Error("Fail pack: %v, user:%d, app:%v", err, event.Uid, event.Aid)
+			return
 		}
 	}
+
+	// uid can send to app
+	app.send(event.Instance, Frame{Binary: event.Binary, Data: rawMessage})
+	apps.stats.Transmitted()
+	if event.RawMessage == nil {
+		apps.exportData(ExportUserSubject(event.Uid, "data"), rawMessage, event.Binary)
+	}
+
+	if app.mirror && event.RawMessage == nil {
+		apps.mirrorEvent(event)
+	}
+}
+
+// Echo user data to other attached users and other sender connections
+func (apps *Apps) mirrorEvent(event AppMessageToEvent) {
+	app := apps.conns[event.Aid]
+	message := &MessageUserSentData{
+		Action: ACTION_SENT_DATA,
+		To:     event.Aid,
+		From:   event.Uid,
+		Id:     event.Id,
+		Data:   event.Data,
+	}
+	if event.Binary {
+		// payload goes after header
+		message.Data = nil
+	}
+	rawMessage, err := MessageUserSentDataPack(message)
+	if err == nil && event.Binary {
+		rawMessage, err = EnvelopePack(rawMessage, event.Data)
+	}
+	if err != nil {
+		log.Error("Fail pack: %v, user:%d, app:%v", err, event.Uid, event.Aid)
+		return
+	}
+	mirror := AppMessageFromEvent{
+		Aid:        event.Aid,
+		Uids:       app.uids,
+		RawMessage: rawMessage,
+		Source:     event.Source,
+		Binary:     event.Binary,
+		Notice:     true,
+	}
+	if event.Source == nil {
+		// the sender is connected to other node
+		mirror.SkipCid = event.Cid
+	}
+	apps.chanOut <- mirror
+}
+
+// Send message to all connected apps
+func (apps *Apps) broadcast(frame Frame) {
+	for _, app := range apps.conns {
+		app.send("", frame)
+		apps.stats.Transmitted()
+	}
+}
+
+func (apps *Apps) replyUids(event appUidsQueryEvent) {
+	app, exists := apps.conns[event.aid]
+	if !exists {
+		event.reply <- nil
+		return
+	}
+	uids := make([]uint32, len(app.uids))
+	copy(uids, app.uids)
+	event.reply <- uids
+}
+
+func (apps *Apps) appInfo(aid uuid.UUID, app *App) AppInfo {
+	uids := make([]uint32, len(app.uids))
+	copy(uids, app.uids)
+	roles := make(map[uint32]string, len(app.roles))
+	for uid, role := range app.roles {
+		roles[uid] = RoleName(role)
+	}
+	instances := make([]AppInstanceInfo, 0, len(app.instances))
+	for name, item := range app.instances {
+		instances = append(instances, AppInstanceInfo{
+			Instance:    name,
+			Ip:          item.conn.RemoteAddr().String(),
+			ConnectedAt: item.connectedAt,
+		})
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Instance < instances[j].Instance
+	})
+	return AppInfo{
+		Aid:         aid,
+		Ip:          instances[0].Ip,
+		ConnectedAt: instances[0].ConnectedAt,
+		Uids:        uids,
+		Roles:       roles,
+		Instances:   instances,
+	}
+}
+
+func (apps *Apps) replyInfo(event appInfoQueryEvent) {
+	app, exists := apps.conns[event.aid]
+	if !exists {
+		event.reply <- nil
+		return
+	}
+	info := apps.appInfo(event.aid, app)
+	event.reply <- &info
+}
+
+func (apps *Apps) replyList(event appListQueryEvent) {
+	aids := make([]uuid.UUID, 0, len(apps.conns))
+	for aid := range apps.conns {
+		aids = append(aids, aid)
+	}
+	// stable order for paging
+	sort.Slice(aids, func(i, j int) bool {
+		return bytes.Compare(aids[i][:], aids[j][:]) < 0
+	})
+
+	list := AppList{
+		Total: len(aids),
+		List:  []AppInfo{},
+	}
+	for i := event.offset; i < len(aids) && len(list.List) < event.limit; i++ {
+		list.List = append(list.List, apps.appInfo(aids[i], apps.conns[aids[i]]))
+	}
+	event.reply <- list
+}
+
+func (apps *Apps) replyAids(event appAidsQueryEvent) {
+	aids := []uuid.UUID{}
+	for aid, app := range apps.conns {
+		for _, uid := range app.uids {
+			if uid == event.uid {
+				aids = append(aids, aid)
+				break
+			}
+		}
+	}
+	event.reply <- aids
 }
 
 // SendEvent Send message to all app connections
 func (apps *Apps) SendEvent(event AppMessageToEvent) {
-	apps.chanIn <- event
+	apps.shard(event.Aid).chanIn <- event
+}
+
+// SendBatch Send messages to apps at once, the batch is split by shards
+func (apps *Apps) SendBatch(events []AppMessageToEvent) {
+	if len(apps.shards) == 1 {
+		apps.shards[0].chanBatch <- events
+		return
+	}
+	batches := make([][]AppMessageToEvent, len(apps.shards))
+	for _, event := range events {
+		i := appShardIndex(event.Aid, len(apps.shards))
+		batches[i] = append(batches[i], event)
+	}
+	for i, batch := range batches {
+		if len(batch) > 0 {
+			apps.shards[i].chanBatch <- batch
+		}
+	}
 }
 
-// ReceiveEvent Read message from app, blocked
-func (apps *Apps) ReceiveEvent() AppMessageFromEvent {
-	return <-apps.chanOut
+// Broadcast Send message to all connected apps
+func (apps *Apps) Broadcast(rawMessage []byte) {
+	// framed once for all shards
+	frame := prepareFrame(Frame{Data: rawMessage})
+	for _, shard := range apps.shards {
+		shard.chanBroadcast <- frame
+	}
 }
 
-// UpdateUids Unregister app connection
+// GetUids Get uids attached to connected app, nil if app is not connected
+func (apps *Apps) GetUids(aid uuid.UUID) []uint32 {
+	reply := make(chan []uint32, 1)
+	apps.shard(aid).chanUidsQuery <- appUidsQueryEvent{aid, reply}
+	return <-reply
+}
+
+// UpdateUids Add, remove or replace uids attached to app
 func (apps *Apps) UpdateUids(event AppUidsEvent) {
-	apps.chanUids <- event
+	apps.shard(event.Aid).chanUids <- event
+}
+
+// GetApp Get connected app snapshot, nil if app is not connected
+func (apps *Apps) GetApp(aid uuid.UUID) *AppInfo {
+	reply := make(chan *AppInfo, 1)
+	apps.shard(aid).chanInfoQuery <- appInfoQueryEvent{aid, reply}
+	return <-reply
 }
 
+// GetApps Get a page of connected apps snapshot ordered by aid
+func (apps *Apps) GetApps(offset int, limit int) AppList {
+	reply := make(chan AppList, len(apps.shards))
+	for _, shard := range apps.shards {
+		// the page may be anywhere, take the head of each shard
+		shard.chanListQuery <- appListQueryEvent{0, offset + limit, reply}
+	}
+	list := AppList{
+		List: []AppInfo{},
+	}
+	var merged []AppInfo
+	for range apps.shards {
+		shardList := <-reply
+		list.Total += shardList.Total
+		merged = append(merged, shardList.List...)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return bytes.Compare(merged[i].Aid[:], merged[j].Aid[:]) < 0
+	})
+	for i := offset; i < len(merged) && len(list.List) < limit; i++ {
+		list.List = append(list.List, merged[i])
+	}
+	return list
+}
+
+// GetAids Get connected apps attached to uid
+func (apps *Apps) GetAids(uid uint32) []uuid.UUID {
+	reply := make(chan []uuid.UUID, len(apps.shards))
+	for _, shard := range apps.shards {
+		shard.chanAidsQuery <- appAidsQueryEvent{uid, reply}
+	}
+	aids := []uuid.UUID{}
+	for range apps.shards {
+		aids = append(aids, <-reply...)
+	}
+	return aids
+}
+
+func (apps *Apps) shareApp(event appShareEvent) {
+	apps.shard(event.aid).chanShare <- event
+}
+
+func (apps *Apps) setOptions(event appOptionsEvent) {
+	apps.shard(event.aid).chanOptions <- event
+}
+
+func (apps *Apps) control(event appControlEvent) {
+	apps.shard(event.aid).chanControl <- event
+}
+
+func (apps *Apps) userDisconnected(uid uint32) {
+	for _, shard := range apps.shards {
+		shard.chanUserGone <- uid
+	}
+}
+
+// Pass uids from in to out keeping the backlog aside, receiving from in never waits for out
+func relayUids(ctx context.Context, in chan uint32, out chan uint32) {
+	var pending []uint32
+	for {
+		var send chan uint32
+		var next uint32
+		if len(pending) > 0 {
+			send = out
+			next = pending[0]
+		}
+		select {
+		case uid := <-in:
+			pending = append(pending, uid)
+		case send <- next:
+			pending = pending[1:]
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Collect connected apps from shards, reply is sent at once
 func (apps *Apps) getConnected(event appConnectedEvent) {
-	apps.chanConnected <- event
+	aids := make([][]uuid.UUID, len(apps.shards))
+	for _, aid := range event.aids {
+		i := appShardIndex(aid, len(apps.shards))
+		aids[i] = append(aids[i], aid)
+	}
+	reply := make(chan []appConnection, len(apps.shards))
+	asked := 0
+	for i, shard := range apps.shards {
+		if len(aids[i]) > 0 {
+			shard.chanConnected <- appConnectedEvent{uid: event.uid, aids: aids[i], reply: reply}
+			asked++
+		}
+	}
+	go func() {
+		var list []appConnection
+		for ; asked > 0; asked-- {
+			list = append(list, <-reply...)
+		}
+		if event.remote && len(list) == 0 {
+			return
+		}
+		apps.shard(uuid.Nil).sendConnected(event.uid, list)
+	}()
+	// apps of other nodes reply from there
+	if !event.remote && apps.remote != nil {
+		apps.remote.GetConnected(event.uid, event.aids)
+	}
+}
+
+// Set delivery to other nodes, before connections are accepted
+func (apps *Apps) setRemote(remote ARemote) {
+	apps.remote = remote
+	for _, shard := range apps.shards {
+		shard.remote = remote
+	}
 }
 
-func (apps *Apps) ConnectionAdd(aid uuid.UUID, conn AConnection) {
-	apps.chanConn <- appConnectionEvent{ADD, aid, conn}
+// Deliver message from other node
+func (apps *Apps) sendRemote(event AppMessageToEvent) {
+	apps.shard(event.Aid).chanRemote <- event
 }
 
-func (apps *Apps) ConnectionRemove(aid uuid.UUID, conn AConnection) {
-	apps.chanConn <- appConnectionEvent{REMOVE, aid, conn}
+func (apps *Apps) ConnectionAdd(aid uuid.UUID, instance string, conn AConnection) {
+	apps.shard(aid).chanConn <- appConnectionEvent{ADD, aid, instance, conn}
 }
 
-func (apps *Apps) ConnectionMessage(aid uuid.UUID, message []byte) {
+func (apps *Apps) ConnectionRemove(aid uuid.UUID, instance string, conn AConnection) {
+	apps.shard(aid).chanConn <- appConnectionEvent{REMOVE, aid, instance, conn}
+}
+
+func (apps *Apps) ConnectionMessage(aid uuid.UUID, instance string, message []byte, binary bool) {
 	apps.stats.Received()
-	apps.chanOutUids <- AppMessageFromEvent{aid, nil, message}
+	apps.shard(aid).chanOutUids <- AppMessageFromEvent{
+		Aid:        aid,
+		RawMessage: message,
+		Binary:     binary,
+		Instance:   instance,
+	}
 }
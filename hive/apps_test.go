@@ -0,0 +1,173 @@
+package hive
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Wait for uids attached to app, events and queries go through different channels
+func testUids(t *testing.T, apps *Apps, aid uuid.UUID, want []uint32) {
+	t.Helper()
+	var uids []uint32
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		info := apps.GetApp(aid)
+		if info == nil {
+			t.Fatalf("app %v is not connected", aid)
+		}
+		uids = info.Uids
+		sort.Slice(uids, func(i, j int) bool {
+			return uids[i] < uids[j]
+		})
+		if reflect.DeepEqual(uids, want) || (len(uids) == 0 && len(want) == 0) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("uids %v, want %v", uids, want)
+}
+
+func TestSetUids(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  []uint32
+		set      []uint32
+		want     []uint32
+		attached []uint32
+		detached []uint32
+	}{
+		{"replace", []uint32{1, 2}, []uint32{2, 3}, []uint32{2, 3}, []uint32{3}, []uint32{1}},
+		{"same", []uint32{1, 2}, []uint32{2, 1}, []uint32{1, 2}, nil, nil},
+		{"clear", []uint32{1, 2}, []uint32{}, []uint32{}, nil, []uint32{1, 2}},
+		{"from empty", nil, []uint32{1, 3}, []uint32{1, 3}, []uint32{1, 3}, nil},
+		{"duplicates", []uint32{1}, []uint32{2, 2}, []uint32{2}, []uint32{2}, []uint32{1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, 2)
+			conns := make(map[uint32]*testConnection)
+			for _, uid := range []uint32{1, 2, 3} {
+				conns[uid] = testUser(t, users, uid)
+			}
+			aid := uuid.New()
+			testApp(t, apps, aid, "")
+			if len(test.initial) > 0 {
+				apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: test.initial})
+				for _, uid := range test.initial {
+					conns[uid].nextAction(t, ACTION_CONNECTED)
+				}
+			}
+
+			apps.UpdateUids(AppUidsEvent{Cmd: SET, Aid: aid, Uids: test.set})
+			testUids(t, apps, aid, test.want)
+			for _, uid := range test.attached {
+				conns[uid].nextAction(t, ACTION_ATTACHED)
+				conns[uid].nextAction(t, ACTION_CONNECTED)
+			}
+			for _, uid := range test.detached {
+				conns[uid].nextAction(t, ACTION_DISCONNECTED)
+				conns[uid].nextAction(t, ACTION_DETACHED)
+			}
+			for _, conn := range conns {
+				conn.none(t)
+			}
+		})
+	}
+}
+
+func TestSetUidsKeepsGuests(t *testing.T) {
+	_, apps := testHives(t, 1)
+	aid := uuid.New()
+	testApp(t, apps, aid, "")
+	grant := ShareGrant{Id: uuid.New(), Aid: aid, Role: ROLE_VIEWER, Expires: time.Now().Add(time.Minute)}
+	apps.AddGrant(grant)
+	guest := apps.UseGrant(grant.Id)
+	if !IsGuestUid(guest) {
+		t.Fatalf("guest uid %d", guest)
+	}
+
+	apps.UpdateUids(AppUidsEvent{Cmd: SET, Aid: aid, Uids: []uint32{1}})
+	testUids(t, apps, aid, []uint32{1, guest})
+}
+
+func TestGetApps(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards int
+		offset int
+		limit  int
+		want   int
+	}{
+		{"first page", 4, 0, 3, 3},
+		{"middle page", 4, 3, 4, 4},
+		{"last page", 4, 8, 5, 2},
+		{"beyond", 4, 10, 5, 0},
+		{"one shard", 1, 2, 5, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, apps := testHives(t, test.shards)
+			aids := make([]uuid.UUID, 10)
+			for i := range aids {
+				aids[i] = uuid.New()
+				testApp(t, apps, aids[i], "")
+			}
+			sort.Slice(aids, func(i, j int) bool {
+				return bytes.Compare(aids[i][:], aids[j][:]) < 0
+			})
+
+			list := apps.GetApps(test.offset, test.limit)
+			if list.Total != len(aids) {
+				t.Errorf("total %d, want %d", list.Total, len(aids))
+			}
+			if len(list.List) != test.want {
+				t.Fatalf("page of %d, want %d", len(list.List), test.want)
+			}
+			for i, info := range list.List {
+				if info.Aid != aids[test.offset+i] {
+					t.Errorf("app %d is %v, want %v", i, info.Aid, aids[test.offset+i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetAids(t *testing.T) {
+	_, apps := testHives(t, 4)
+	first := uuid.New()
+	second := uuid.New()
+	testApp(t, apps, first, "")
+	testApp(t, apps, second, "")
+	apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: first, Uids: []uint32{1, 2}})
+	apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: second, Uids: []uint32{2}})
+	testUids(t, apps, first, []uint32{1, 2})
+	testUids(t, apps, second, []uint32{2})
+
+	tests := []struct {
+		name string
+		uid  uint32
+		want []uuid.UUID
+	}{
+		{"one app", 1, []uuid.UUID{first}},
+		{"two apps", 2, []uuid.UUID{first, second}},
+		{"no apps", 3, []uuid.UUID{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aids := apps.GetAids(test.uid)
+			sort.Slice(aids, func(i, j int) bool {
+				return bytes.Compare(aids[i][:], aids[j][:]) < 0
+			})
+			sort.Slice(test.want, func(i, j int) bool {
+				return bytes.Compare(test.want[i][:], test.want[j][:]) < 0
+			})
+			if !reflect.DeepEqual(aids, test.want) {
+				t.Errorf("aids %v, want %v", aids, test.want)
+			}
+		})
+	}
+}
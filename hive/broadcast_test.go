@@ -0,0 +1,122 @@
+package hive
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFanoutPrepared(t *testing.T) {
+	tests := []struct {
+		name     string
+		uids     []uint32
+		prepared bool
+	}{
+		{"one user", []uint32{10}, false},
+		{"many users", []uint32{10, 11, 12}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, 2)
+			aid := uuid.New()
+			testApp(t, apps, aid, "")
+			var conns []*testConnection
+			for _, uid := range test.uids {
+				conns = append(conns, testUser(t, users, uid))
+			}
+			apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: test.uids})
+			for _, conn := range conns {
+				conn.nextAction(t, ACTION_CONNECTED)
+			}
+
+			apps.ConnectionMessage(aid, "", []byte(`{"Action":"sendData","Data":{"N":1}}`), false)
+			for _, conn := range conns {
+				frame := conn.nextAction(t, ACTION_RECEIVED_DATA)
+				if (frame.Prepared != nil) != test.prepared {
+					t.Errorf("prepared %v, want %v", frame.Prepared != nil, test.prepared)
+				}
+			}
+		})
+	}
+}
+
+func TestBroadcastPrepared(t *testing.T) {
+	users, apps := testHives(t, 2)
+	user := testUser(t, users, 10)
+	app := testApp(t, apps, uuid.New(), "")
+
+	users.Broadcast([]byte(`{"Action":"news"}`))
+	apps.Broadcast([]byte(`{"Action":"notice"}`))
+	for _, frame := range []Frame{user.nextAction(t, "news"), app.nextAction(t, "notice")} {
+		if frame.Prepared == nil {
+			t.Errorf("broadcast %s is not framed once", frame.Data)
+		}
+	}
+}
+
+// User connections over websocket, clients discard what they read
+func testBroadcastConnections(b *testing.B, count int, options ConnectionOptions) []*UserConnection {
+	handler := &testUserHandler{make(chan string, 100)}
+	conns := make(chan *UserConnection, count)
+	upgrader := websocket.Upgrader{EnableCompression: options.Compression}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- NewUserConnection(handler, 10, conn, options)
+	}))
+	b.Cleanup(server.Close)
+	dialer := websocket.Dialer{EnableCompression: options.Compression}
+	result := make([]*UserConnection, count)
+	for i := range result {
+		client, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { client.Close() })
+		go func() {
+			for {
+				_, _, err := client.NextReader()
+				if err != nil {
+					return
+				}
+			}
+		}()
+		result[i] = <-conns
+	}
+	return result
+}
+
+// Same message written to hundreds of connections, framed per connection or once
+func BenchmarkBroadcast(b *testing.B) {
+	data := []byte(`{"Action":"receivedData","From":"` + strings.Repeat("0", 36) + `","Data":{"Text":"` + strings.Repeat("broadcast ", 100) + `"}}`)
+	for _, count := range []int{100, 500} {
+		for _, compression := range []bool{false, true} {
+			options := ConnectionOptions{Compression: compression, CompressionLevel: 1, CompressionThreshold: 256}
+			conns := testBroadcastConnections(b, count, options)
+			for _, prepared := range []bool{false, true} {
+				b.Run(fmt.Sprintf("recipients %d compression %v prepared %v", count, compression, prepared), func(b *testing.B) {
+					b.ReportAllocs()
+					b.SetBytes(int64(len(data) * count))
+					for n := 0; n < b.N; n++ {
+						frame := Frame{Data: data}
+						if prepared {
+							frame = prepareFrame(frame)
+						}
+						for _, c := range conns {
+							err := c.writeFrame(c.conn, c.counter, frame)
+							if err != nil {
+								b.Fatal(err)
+							}
+						}
+					}
+				})
+			}
+		}
+	}
+}
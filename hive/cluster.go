@@ -0,0 +1,462 @@
+package hive
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/stepan-s/ws-bro/backplane"
+	"github.com/stepan-s/ws-bro/log"
+	"sync"
+	"time"
+)
+
+// ClusterHeartbeat Presence snapshot interval in seconds, node is forgotten after 3 intervals
+var ClusterHeartbeat int64 = 5
+
+const clusterPresenceTopic = "wsbro.presence"
+const clusterNodeTopic = "wsbro.node."
+
+// ARemote Delivery of hive events to other cluster nodes
+type ARemote interface {
+	SendUser(event UserMessageEvent)
+	SendApp(event AppMessageToEvent)
+	UserPresence(uid uint32, online bool)
+	AppPresence(aid uuid.UUID, online bool)
+	GetConnected(uid uint32, aids []uuid.UUID)
+	SendControl(cmd uint8, aid uuid.UUID, uid uint32)
+	UserGone(uid uint32)
+}
+
+// Connections of a node
+type clusterPresence struct {
+	Node   string
+	Uids   []uint32
+	Aids   []uuid.UUID
+	Online bool
+	// snapshot replaces known node connections
+	Full bool
+}
+
+type clusterUserEvent struct {
+	Uid        uint32
+	RawMessage []byte
+	Binary     bool
+	Key        string
+	Cid        uint64
+	SkipCid    uint64
+}
+
+// Data is kept as bytes, binary payload is not json
+type clusterAppEvent struct {
+	Aid        uuid.UUID
+	Uid        uint32
+	RawMessage []byte
+	Data       []byte
+	Id         string
+	Binary     bool
+	Instance   string
+	Cid        uint64
+}
+
+// Connected apps request of a user of other node
+type clusterConnectedEvent struct {
+	Uid  uint32
+	Aids []uuid.UUID
+}
+
+// Control lease request of a user of other node
+type clusterControlEvent struct {
+	Cmd uint8
+	Aid uuid.UUID
+	Uid uint32
+}
+
+type clusterMessage struct {
+	User      *clusterUserEvent      `json:",omitempty"`
+	App       *clusterAppEvent       `json:",omitempty"`
+	Connected *clusterConnectedEvent `json:",omitempty"`
+	Control   *clusterControlEvent   `json:",omitempty"`
+}
+
+type clusterOutgoing struct {
+	topic      string
+	rawMessage []byte
+}
+
+type clusterNode struct {
+	uids map[uint32]bool
+	aids map[uuid.UUID]bool
+	seen time.Time
+}
+
+func newClusterNode() *clusterNode {
+	return &clusterNode{
+		uids: make(map[uint32]bool),
+		aids: make(map[uuid.UUID]bool),
+		seen: time.Now(),
+	}
+}
+
+// Cluster Routes events between hives of cluster nodes over backplane
+type Cluster struct {
+	node    string
+	users   *Users
+	apps    *Apps
+	lock    sync.RWMutex
+	local   *clusterNode
+	nodes   map[string]*clusterNode
+	chanOut chan clusterOutgoing
+}
+
+// NewCluster Join the cluster until ctx is done, node must be unique
+func NewCluster(ctx context.Context, node string, bus backplane.ABackplane, users *Users, apps *Apps) (*Cluster, error) {
+	c := &Cluster{
+		node:    node,
+		users:   users,
+		apps:    apps,
+		local:   newClusterNode(),
+		nodes:   make(map[string]*clusterNode),
+		chanOut: make(chan clusterOutgoing, 10000),
+	}
+	setConnectionNode(node)
+	setGuestNode(node)
+	err := bus.Subscribe(clusterPresenceTopic, c.receivePresence)
+	if err != nil {
+		return nil, err
+	}
+	err = bus.Subscribe(clusterNodeTopic+node, c.receiveMessage)
+	if err != nil {
+		return nil, err
+	}
+	users.setRemote(c)
+	apps.setRemote(c)
+
+	// hives do not wait for the backplane
+	go func() {
+		for {
+			select {
+			case item := <-c.chanOut:
+				err := bus.Publish(item.topic, item.rawMessage)
+				if err != nil {
+					log.Error("Fail publish: %v, topic:%s", err, item.topic)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(ClusterHeartbeat) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.heartbeat()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	log.Info("Joined cluster as node: %s", node)
+	return c, nil
+}
+
+// Send local presence snapshot and forget silent nodes
+func (c *Cluster) heartbeat() {
+	c.lock.Lock()
+	presence := &clusterPresence{Node: c.node, Online: true, Full: true}
+	for uid := range c.local.uids {
+		presence.Uids = append(presence.Uids, uid)
+	}
+	for aid := range c.local.aids {
+		presence.Aids = append(presence.Aids, aid)
+	}
+	var lost []uint32
+	for node, item := range c.nodes {
+		if time.Since(item.seen) > time.Duration(3*ClusterHeartbeat)*time.Second {
+			log.Warning("Lost cluster node: %s", node)
+			delete(c.nodes, node)
+			for uid := range item.uids {
+				lost = append(lost, uid)
+			}
+		}
+	}
+	gone := c.offline(lost)
+	c.lock.Unlock()
+
+	c.userGone(gone)
+	c.publishPresence(presence)
+}
+
+// Uids not connected to any node, called under read or write lock
+func (c *Cluster) offline(uids []uint32) []uint32 {
+	var gone []uint32
+	for _, uid := range uids {
+		if c.local.uids[uid] {
+			continue
+		}
+		online := false
+		for _, item := range c.nodes {
+			if item.uids[uid] {
+				online = true
+				break
+			}
+		}
+		if !online {
+			gone = append(gone, uid)
+		}
+	}
+	return gone
+}
+
+// User leases and guest grants of local apps end with the last connection in the cluster
+func (c *Cluster) userGone(uids []uint32) {
+	for _, uid := range uids {
+		c.apps.userDisconnected(uid)
+	}
+}
+
+// UserGone Local user has no connections left, user leases end if no other node has the user
+func (c *Cluster) UserGone(uid uint32) {
+	c.lock.RLock()
+	gone := c.offline([]uint32{uid})
+	c.lock.RUnlock()
+
+	c.userGone(gone)
+}
+
+func (c *Cluster) publishPresence(presence *clusterPresence) {
+	rawMessage, err := json.Marshal(presence)
+	if err != nil {
+		log.Error("Fail pack presence: %v", err)
+		return
+	}
+	c.chanOut <- clusterOutgoing{clusterPresenceTopic, rawMessage}
+}
+
+func (c *Cluster) publish(node string, message *clusterMessage) {
+	rawMessage, err := json.Marshal(message)
+	if err != nil {
+		log.Error("Fail pack cluster message: %v", err)
+		return
+	}
+	c.chanOut <- clusterOutgoing{clusterNodeTopic + node, rawMessage}
+}
+
+func (c *Cluster) receivePresence(rawMessage []byte) {
+	var presence clusterPresence
+	err := json.Unmarshal(rawMessage, &presence)
+	if err != nil {
+		log.Error("Fail parse presence: %v", err)
+		return
+	}
+	if presence.Node == c.node {
+		return
+	}
+
+	c.lock.Lock()
+	var left []uint32
+	node, exists := c.nodes[presence.Node]
+	if !exists || presence.Full {
+		if !exists {
+			log.Info("New cluster node: %s", presence.Node)
+		} else {
+			// users missed by the snapshot are gone
+			for uid := range node.uids {
+				left = append(left, uid)
+			}
+		}
+		node = newClusterNode()
+		c.nodes[presence.Node] = node
+	}
+	node.seen = time.Now()
+	for _, uid := range presence.Uids {
+		if presence.Online {
+			node.uids[uid] = true
+		} else {
+			delete(node.uids, uid)
+			left = append(left, uid)
+		}
+	}
+	for _, aid := range presence.Aids {
+		if presence.Online {
+			node.aids[aid] = true
+		} else {
+			delete(node.aids, aid)
+		}
+	}
+	gone := c.offline(left)
+	c.lock.Unlock()
+
+	c.userGone(gone)
+}
+
+func (c *Cluster) receiveMessage(rawMessage []byte) {
+	var message clusterMessage
+	err := json.Unmarshal(rawMessage, &message)
+	if err != nil {
+		log.Error("Fail parse cluster message: %v", err)
+		return
+	}
+	if message.User != nil {
+		c.users.sendRemote(UserMessageEvent{
+			Uid:        message.User.Uid,
+			RawMessage: message.User.RawMessage,
+			Binary:     message.User.Binary,
+			Key:        message.User.Key,
+			Cid:        message.User.Cid,
+			SkipCid:    message.User.SkipCid,
+		})
+	}
+	if message.App != nil {
+		c.apps.sendRemote(AppMessageToEvent{
+			Aid:        message.App.Aid,
+			Uid:        message.App.Uid,
+			RawMessage: message.App.RawMessage,
+			Data:       message.App.Data,
+			Id:         message.App.Id,
+			Binary:     message.App.Binary,
+			Instance:   message.App.Instance,
+			Cid:        message.App.Cid,
+		})
+	}
+	if message.Connected != nil {
+		c.apps.getConnected(appConnectedEvent{
+			uid:    message.Connected.Uid,
+			aids:   message.Connected.Aids,
+			remote: true,
+		})
+	}
+	if message.Control != nil {
+		c.apps.control(appControlEvent{
+			cmd:    message.Control.Cmd,
+			aid:    message.Control.Aid,
+			uid:    message.Control.Uid,
+			remote: true,
+		})
+	}
+}
+
+// SendUser Send event to other nodes with uid connections
+func (c *Cluster) SendUser(event UserMessageEvent) {
+	var nodes []string
+	c.lock.RLock()
+	for node, item := range c.nodes {
+		if item.uids[event.Uid] {
+			nodes = append(nodes, node)
+		}
+	}
+	c.lock.RUnlock()
+
+	if len(nodes) == 0 {
+		return
+	}
+	message := &clusterMessage{User: &clusterUserEvent{
+		Uid:        event.Uid,
+		RawMessage: event.RawMessage,
+		Binary:     event.Binary,
+		Key:        event.Key,
+		Cid:        event.Cid,
+		SkipCid:    event.SkipCid,
+	}}
+	for _, node := range nodes {
+		c.publish(node, message)
+	}
+}
+
+// Node with app connection, empty if app is not connected to other nodes
+func (c *Cluster) appNode(aid uuid.UUID) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for node, item := range c.nodes {
+		if item.aids[aid] {
+			return node
+		}
+	}
+	return ""
+}
+
+// SendApp Send event to the node with app connection
+func (c *Cluster) SendApp(event AppMessageToEvent) {
+	target := c.appNode(event.Aid)
+	if target == "" {
+		return
+	}
+	cid := event.Cid
+	if event.Source != nil {
+		cid = event.Source.Id()
+	}
+	c.publish(target, &clusterMessage{App: &clusterAppEvent{
+		Aid:        event.Aid,
+		Uid:        event.Uid,
+		RawMessage: event.RawMessage,
+		Data:       event.Data,
+		Id:         event.Id,
+		Binary:     event.Binary,
+		Instance:   event.Instance,
+		Cid:        cid,
+	}})
+}
+
+// UserPresence Announce user connected or disconnected on this node
+func (c *Cluster) UserPresence(uid uint32, online bool) {
+	c.lock.Lock()
+	if online {
+		c.local.uids[uid] = true
+	} else {
+		delete(c.local.uids, uid)
+	}
+	c.lock.Unlock()
+
+	c.publishPresence(&clusterPresence{Node: c.node, Uids: []uint32{uid}, Online: online})
+}
+
+// AppPresence Announce app connected or disconnected on this node
+func (c *Cluster) AppPresence(aid uuid.UUID, online bool) {
+	c.lock.Lock()
+	if online {
+		c.local.aids[aid] = true
+	} else {
+		delete(c.local.aids, aid)
+	}
+	c.lock.Unlock()
+
+	c.publishPresence(&clusterPresence{Node: c.node, Aids: []uuid.UUID{aid}, Online: online})
+}
+
+// GetConnected Ask nodes with apps connected for the connected apps of uid, each node replies to the user
+func (c *Cluster) GetConnected(uid uint32, aids []uuid.UUID) {
+	targets := make(map[string][]uuid.UUID)
+	c.lock.RLock()
+	for _, aid := range aids {
+		for node, item := range c.nodes {
+			if item.aids[aid] {
+				targets[node] = append(targets[node], aid)
+				break
+			}
+		}
+	}
+	c.lock.RUnlock()
+
+	for node, nodeAids := range targets {
+		c.publish(node, &clusterMessage{Connected: &clusterConnectedEvent{
+			Uid:  uid,
+			Aids: nodeAids,
+		}})
+	}
+}
+
+// SendControl Send control lease request to the node with app connection
+func (c *Cluster) SendControl(cmd uint8, aid uuid.UUID, uid uint32) {
+	target := c.appNode(aid)
+	if target == "" {
+		return
+	}
+	c.publish(target, &clusterMessage{Control: &clusterControlEvent{
+		Cmd: cmd,
+		Aid: aid,
+		Uid: uid,
+	}})
+}
@@ -0,0 +1,277 @@
+package hive
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stepan-s/ws-bro/backplane"
+	"hash/fnv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Node of a test cluster
+type testNode struct {
+	users   *Users
+	apps    *Apps
+	cluster *Cluster
+}
+
+// Two nodes over memory backplane, stopped with the test
+func testCluster(t *testing.T) (*testNode, *testNode) {
+	bus := backplane.NewMemory()
+	ctx, stop := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		stop()
+		_ = bus.Close()
+	})
+	var nodes []*testNode
+	for _, name := range []string{"node1", "node2"} {
+		users, apps := testHives(t, 2)
+		cluster, err := NewCluster(ctx, name, bus, users, apps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, &testNode{users, apps, cluster})
+	}
+	return nodes[0], nodes[1]
+}
+
+// Wait for the node knows presence of the other node
+func testKnown(t *testing.T, node *testNode, check func(item *clusterNode) bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		node.cluster.lock.RLock()
+		known := false
+		for _, item := range node.cluster.nodes {
+			if check(item) {
+				known = true
+			}
+		}
+		node.cluster.lock.RUnlock()
+		if known {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("presence is not known")
+}
+
+// User of node1 attached to app of node2
+func testClusterApp(t *testing.T, node1 *testNode, node2 *testNode, role uint8) (*testConnection, *testConnection, uuid.UUID) {
+	t.Helper()
+	aid := uuid.New()
+	app := testApp(t, node2.apps, aid, "")
+	user := testUser(t, node1.users, 10)
+	testKnown(t, node1, func(item *clusterNode) bool { return item.aids[aid] })
+	testKnown(t, node2, func(item *clusterNode) bool { return item.uids[10] })
+	node2.apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10}, Roles: map[uint32]uint8{10: role}})
+	user.nextAction(t, ACTION_CONNECTED)
+	return user, app, aid
+}
+
+func TestClusterUserToApp(t *testing.T) {
+	tests := []struct {
+		name    string
+		binary  bool
+		payload string
+	}{
+		{"json", false, `"Data":{"N":1}`},
+		{"binary", true, "\x00\x01\xff"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node1, node2 := testCluster(t)
+			user, app, aid := testClusterApp(t, node1, node2, ROLE_OPERATOR)
+
+			if test.binary {
+				frame, err := EnvelopePack([]byte(fmt.Sprintf(`{"Action":"sendData","To":"%s"}`, aid)), []byte(test.payload))
+				if err != nil {
+					t.Fatal(err)
+				}
+				node1.users.ConnectionMessage(10, user, frame, true)
+			} else {
+				node1.users.ConnectionMessage(10, user, []byte(fmt.Sprintf(`{"Action":"sendData","To":"%s",%s}`, aid, test.payload)), false)
+			}
+			frame := app.nextAction(t, ACTION_RECEIVED_DATA)
+			if frame.Binary != test.binary {
+				t.Fatalf("binary %v", frame.Binary)
+			}
+			data := frame.Data
+			if test.binary {
+				_, payload, err := EnvelopeUnpack(frame.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data = payload
+			}
+			if !bytes.Contains(data, []byte(test.payload)) {
+				t.Errorf("app got %q", data)
+			}
+			if !strings.Contains(string(frame.Data), fmt.Sprintf(`"Cid":%d`, user.id)) {
+				t.Errorf("no sender cid: %s", frame.Data)
+			}
+		})
+	}
+}
+
+func TestClusterAppToUser(t *testing.T) {
+	tests := []struct {
+		name  string
+		cid   bool
+		first bool
+	}{
+		{"all tabs", false, true},
+		{"one tab", true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node1, node2 := testCluster(t)
+			first, _, aid := testClusterApp(t, node1, node2, ROLE_OPERATOR)
+			second := testUser(t, node1.users, 10)
+
+			message := `{"Action":"sendData","Data":{"N":1}}`
+			if test.cid {
+				message = fmt.Sprintf(`{"Action":"sendData","Cid":%d,"Data":{"N":1}}`, second.id)
+			}
+			node2.apps.ConnectionMessage(aid, "", []byte(message), false)
+			frame := second.nextAction(t, ACTION_RECEIVED_DATA)
+			if !strings.Contains(string(frame.Data), `{"N":1}`) {
+				t.Errorf("user got %s", frame.Data)
+			}
+			if test.first {
+				first.nextAction(t, ACTION_RECEIVED_DATA)
+			} else {
+				first.none(t)
+			}
+		})
+	}
+}
+
+func TestClusterMirror(t *testing.T) {
+	node1, node2 := testCluster(t)
+	sender, _, aid := testClusterApp(t, node1, node2, ROLE_OPERATOR)
+	tab := testUser(t, node1.users, 10)
+	node2.apps.ConnectionMessage(aid, "", []byte(`{"Action":"setOptions","Mirror":true}`), false)
+
+	// options go through the router, send until the other tab gets the echo
+	message := []byte(fmt.Sprintf(`{"Action":"sendData","To":"%s","Data":{"N":1}}`, aid))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(tab.frames) == 0 && time.Now().Before(deadline) {
+		node1.users.ConnectionMessage(10, sender, message, false)
+		time.Sleep(time.Millisecond)
+	}
+	frame := tab.nextAction(t, ACTION_SENT_DATA)
+	if !strings.Contains(string(frame.Data), `"From":10`) {
+		t.Errorf("tab got %s", frame.Data)
+	}
+	// the sender is skipped by connection id on its node
+	sender.none(t)
+}
+
+func TestClusterControl(t *testing.T) {
+	node1, node2 := testCluster(t)
+	user, app, aid := testClusterApp(t, node1, node2, ROLE_OPERATOR)
+
+	node1.users.ConnectionMessage(10, user, []byte(fmt.Sprintf(`{"Action":"acquireControl","To":"%s"}`, aid)), false)
+	frame := user.nextAction(t, ACTION_CONTROL_CHANGED)
+	if !strings.Contains(string(frame.Data), `"Uid":10`) {
+		t.Fatalf("user got %s", frame.Data)
+	}
+	app.nextAction(t, ACTION_CONTROL_CHANGED)
+
+	// the lease ends with the last connection in the cluster
+	node1.users.ConnectionRemove(10, user)
+	frame = app.nextAction(t, ACTION_CONTROL_CHANGED)
+	if !strings.Contains(string(frame.Data), `"Uid":0`) {
+		t.Errorf("app got %s", frame.Data)
+	}
+}
+
+func TestClusterControlUserOnline(t *testing.T) {
+	node1, node2 := testCluster(t)
+	user, app, aid := testClusterApp(t, node1, node2, ROLE_OPERATOR)
+	node1.users.ConnectionMessage(10, user, []byte(fmt.Sprintf(`{"Action":"acquireControl","To":"%s"}`, aid)), false)
+	app.nextAction(t, ACTION_CONTROL_CHANGED)
+
+	// user is still connected to node2
+	testUser(t, node2.users, 10)
+	testKnown(t, node1, func(item *clusterNode) bool { return item.uids[10] })
+	node1.users.ConnectionRemove(10, user)
+	app.none(t)
+}
+
+func TestClusterControlLocalAppUserOnline(t *testing.T) {
+	node1, node2 := testCluster(t)
+	aid := uuid.New()
+	app := testApp(t, node1.apps, aid, "")
+	user := testUser(t, node1.users, 10)
+	node1.apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10}, Roles: map[uint32]uint8{10: ROLE_OPERATOR}})
+	user.nextAction(t, ACTION_CONNECTED)
+	node1.users.ConnectionMessage(10, user, []byte(fmt.Sprintf(`{"Action":"acquireControl","To":"%s"}`, aid)), false)
+	app.nextAction(t, ACTION_CONTROL_CHANGED)
+
+	// the last local connection is gone, user is still connected to node2
+	remote := testUser(t, node2.users, 10)
+	testKnown(t, node1, func(item *clusterNode) bool { return item.uids[10] })
+	node1.users.ConnectionRemove(10, user)
+	app.none(t)
+
+	// the lease ends with the last connection in the cluster
+	node2.users.ConnectionRemove(10, remote)
+	frame := app.nextAction(t, ACTION_CONTROL_CHANGED)
+	if !strings.Contains(string(frame.Data), `"Uid":0`) {
+		t.Errorf("app got %s", frame.Data)
+	}
+}
+
+func TestClusterGetConnected(t *testing.T) {
+	node1, node2 := testCluster(t)
+	user, _, aid := testClusterApp(t, node1, node2, ROLE_VIEWER)
+
+	node1.users.ConnectionMessage(10, user, []byte(fmt.Sprintf(`{"Action":"getConnected","List":["%s"]}`, aid)), false)
+	// local node replies with an empty list
+	for {
+		frame := user.nextAction(t, ACTION_CONNECTED)
+		if strings.Contains(string(frame.Data), aid.String()) {
+			break
+		}
+	}
+}
+
+func TestClusterConnectionId(t *testing.T) {
+	testCluster(t)
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte("node2"))
+	id := nextConnectionId()
+	if id>>37 != uint64(hash.Sum32()&0xFFFF) {
+		t.Errorf("id %x has no node prefix", id)
+	}
+	if id >= 1<<53 {
+		t.Errorf("id %d is not a safe json number", id)
+	}
+}
+
+func TestClusterGuestUid(t *testing.T) {
+	uids := make(map[string]uint32)
+	for _, node := range []string{"node1", "node2"} {
+		setGuestNode(node)
+		uids[node] = nextGuestUid()
+	}
+	setGuestNode("")
+	for node, uid := range uids {
+		if !IsGuestUid(uid) {
+			t.Errorf("uid %x is not guest", uid)
+		}
+		if uid>>guestSeqBits&(1<<guestNodeBits-1) != nodeHash(node)&(1<<guestNodeBits-1) {
+			t.Errorf("uid %x has no node prefix", uid)
+		}
+	}
+	// the same sequence on both nodes gives distinct uids
+	if uids["node1"]&^(1<<guestSeqBits-1) == uids["node2"]&^(1<<guestSeqBits-1) {
+		t.Errorf("uids %x and %x share the node prefix", uids["node1"], uids["node2"])
+	}
+}
@@ -0,0 +1,252 @@
+package hive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"reflect"
+)
+
+const SUBPROTOCOL_JSON = "wsbro.json"
+const SUBPROTOCOL_MSGPACK = "wsbro.msgpack"
+const SUBPROTOCOL_CBOR = "wsbro.cbor"
+
+// Max nesting of arrays and maps in a frame, deeper frames are not decoded
+const codecMaxDepth = 32
+
+var errCodecTooDeep = errors.New("frame is nested too deep")
+
+// CodecSubprotocols Supported connection encodings in order of preference
+var CodecSubprotocols = []string{SUBPROTOCOL_JSON, SUBPROTOCOL_MSGPACK, SUBPROTOCOL_CBOR}
+
+// ACodec A connection encoding, the hive itself works with json
+type ACodec interface {
+	Marshal(interface{}) ([]byte, error)
+	Unmarshal([]byte, *interface{}) error
+}
+
+type msgpackCodec struct{}
+
+func (codec msgpackCodec) Marshal(value interface{}) ([]byte, error) {
+	return msgpack.Marshal(value)
+}
+
+func (codec msgpackCodec) Unmarshal(data []byte, value *interface{}) error {
+	// the decoder recurses without limit
+	if msgpackDepth(data) > codecMaxDepth {
+		return errCodecTooDeep
+	}
+	return msgpack.Unmarshal(data, value)
+}
+
+// Max nesting of msgpack arrays and maps, without validation
+func msgpackDepth(data []byte) int {
+	// items left in each open array or map
+	var open []uint64
+	maxDepth := 0
+	for i := 0; i < len(data); {
+		c := data[i]
+		i++
+		var items uint64
+		var skip uint64
+		container := c&0xe0 == 0x80 || c >= 0xdc && c <= 0xdf
+		switch {
+		case c <= 0x7f || c >= 0xe0:
+		case c <= 0x8f:
+			items = uint64(c&0x0f) * 2
+		case c <= 0x9f:
+			items = uint64(c & 0x0f)
+		case c <= 0xbf:
+			skip = uint64(c & 0x1f)
+		case c == 0xc4 || c == 0xd9:
+			skip = msgpackUint(data, i, 1) + 1
+		case c == 0xc5 || c == 0xda:
+			skip = msgpackUint(data, i, 2) + 2
+		case c == 0xc6 || c == 0xdb:
+			skip = msgpackUint(data, i, 4) + 4
+		case c == 0xc7:
+			skip = msgpackUint(data, i, 1) + 2
+		case c == 0xc8:
+			skip = msgpackUint(data, i, 2) + 3
+		case c == 0xc9:
+			skip = msgpackUint(data, i, 4) + 5
+		case c == 0xca:
+			skip = 4
+		case c == 0xcb:
+			skip = 8
+		case c >= 0xcc && c <= 0xd3:
+			skip = 1 << (c & 0x03)
+		case c >= 0xd4 && c <= 0xd8:
+			skip = 1<<(c-0xd4) + 1
+		case c == 0xdc:
+			items = msgpackUint(data, i, 2)
+			skip = 2
+		case c == 0xdd:
+			items = msgpackUint(data, i, 4)
+			skip = 4
+		case c == 0xde:
+			items = msgpackUint(data, i, 2) * 2
+			skip = 2
+		case c == 0xdf:
+			items = msgpackUint(data, i, 4) * 2
+			skip = 4
+		}
+		if skip > uint64(len(data)-i) {
+			break
+		}
+		i += int(skip)
+
+		if container && len(open)+1 > maxDepth {
+			maxDepth = len(open) + 1
+		}
+		if len(open) > 0 {
+			open[len(open)-1]--
+		}
+		if items > 0 {
+			open = append(open, items)
+		}
+		// close finished arrays and maps
+		for len(open) > 0 && open[len(open)-1] == 0 {
+			open = open[:len(open)-1]
+		}
+	}
+	return maxDepth
+}
+
+// Big endian length of size bytes at i, 0 if truncated
+func msgpackUint(data []byte, i int, size int) uint64 {
+	if len(data)-i < size {
+		return 0
+	}
+	switch size {
+	case 1:
+		return uint64(data[i])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(data[i:]))
+	default:
+		return uint64(binary.BigEndian.Uint32(data[i:]))
+	}
+}
+
+type cborCodec struct {
+	encMode cbor.EncMode
+	decMode cbor.DecMode
+}
+
+func (codec cborCodec) Marshal(value interface{}) ([]byte, error) {
+	return codec.encMode.Marshal(value)
+}
+
+func (codec cborCodec) Unmarshal(data []byte, value *interface{}) error {
+	return codec.decMode.Unmarshal(data, value)
+}
+
+func newCborCodec() ACodec {
+	encMode, err := cbor.EncOptions{}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	// json needs string keys
+	decMode, err := cbor.DecOptions{
+		DefaultMapType:  reflect.TypeOf(map[string]interface{}{}),
+		MaxNestedLevels: codecMaxDepth,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborCodec{encMode, decMode}
+}
+
+var codecs = map[string]ACodec{
+	SUBPROTOCOL_MSGPACK: msgpackCodec{},
+	SUBPROTOCOL_CBOR:    newCborCodec(),
+}
+
+// CodecBySubprotocol Get connection encoding, nil for json
+func CodecBySubprotocol(subprotocol string) ACodec {
+	return codecs[subprotocol]
+}
+
+// Parse json keeping integers as integers
+func codecJsonValue(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	return codecJsonNumbers(value), nil
+}
+
+func codecJsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = codecJsonNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = codecJsonNumbers(item)
+		}
+	}
+	return value
+}
+
+// Convert outgoing frame to connection encoding, binary envelope payload becomes Data
+func codecEncodeFrame(codec ACodec, frame Frame) ([]byte, error) {
+	if !frame.Binary {
+		value, err := codecJsonValue(frame.Data)
+		if err != nil {
+			return nil, err
+		}
+		return codec.Marshal(value)
+	}
+
+	header, payload, err := EnvelopeUnpack(frame.Data)
+	if err != nil {
+		return nil, err
+	}
+	value, err := codecJsonValue(header)
+	if err != nil {
+		return nil, err
+	}
+	message, ok := value.(map[string]interface{})
+	if !ok {
+		return codec.Marshal(value)
+	}
+	message["Data"] = payload
+	return codec.Marshal(message)
+}
+
+// Convert incoming frame from connection encoding to json,
+// binary Data becomes payload of binary envelope
+func codecDecodeFrame(codec ACodec, data []byte) ([]byte, bool, error) {
+	var value interface{}
+	err := codec.Unmarshal(data, &value)
+	if err != nil {
+		return nil, false, err
+	}
+	if message, ok := value.(map[string]interface{}); ok {
+		if payload, ok := message["Data"].([]byte); ok {
+			delete(message, "Data")
+			header, err := json.Marshal(message)
+			if err != nil {
+				return nil, false, err
+			}
+			frame, err := EnvelopePack(header, payload)
+			return frame, true, err
+		}
+	}
+	message, err := json.Marshal(value)
+	return message, false, err
+}
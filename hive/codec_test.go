@@ -0,0 +1,123 @@
+package hive
+
+import (
+	"bytes"
+	"github.com/vmihailenco/msgpack/v5"
+	"testing"
+)
+
+// Arrays nested depth times
+func testNested(depth int) interface{} {
+	var value interface{} = 1
+	for i := 0; i < depth; i++ {
+		value = []interface{}{value}
+	}
+	return value
+}
+
+func TestMsgpackDepth(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		depth int
+	}{
+		{"scalar", 1, 0},
+		{"string", "abc", 0},
+		{"empty array", []interface{}{}, 1},
+		{"flat map", map[string]interface{}{"a": 1, "b": "c"}, 1},
+		{"nested", testNested(5), 5},
+		{"siblings", []interface{}{testNested(2), testNested(3), 1}, 4},
+		{"binary", map[string]interface{}{"Data": []byte{0x91, 0x91, 0x91}}, 1},
+		{"long array", make([]interface{}, 100), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := msgpack.Marshal(test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if depth := msgpackDepth(data); depth != test.depth {
+				t.Errorf("depth %d, want %d", depth, test.depth)
+			}
+		})
+	}
+}
+
+func TestCodecDecodeFrame(t *testing.T) {
+	tests := []struct {
+		name        string
+		subprotocol string
+		value       interface{}
+		json        string
+		payload     []byte
+		err         bool
+	}{
+		{"msgpack", SUBPROTOCOL_MSGPACK, map[string]interface{}{"Action": "sendData", "Data": map[string]interface{}{"N": 1}}, `{"Action":"sendData","Data":{"N":1}}`, nil, false},
+		{"msgpack binary", SUBPROTOCOL_MSGPACK, map[string]interface{}{"Action": "sendData", "Data": []byte{0, 1, 2}}, `{"Action":"sendData"}`, []byte{0, 1, 2}, false},
+		{"msgpack too deep", SUBPROTOCOL_MSGPACK, testNested(codecMaxDepth + 1), "", nil, true},
+		{"cbor", SUBPROTOCOL_CBOR, map[string]interface{}{"Action": "sendData", "Data": 1}, `{"Action":"sendData","Data":1}`, nil, false},
+		{"cbor binary", SUBPROTOCOL_CBOR, map[string]interface{}{"Action": "sendData", "Data": []byte{3}}, `{"Action":"sendData"}`, []byte{3}, false},
+		{"cbor too deep", SUBPROTOCOL_CBOR, testNested(codecMaxDepth + 1), "", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			codec := CodecBySubprotocol(test.subprotocol)
+			data, err := codec.Marshal(test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, binary, err := codecDecodeFrame(codec, data)
+			if test.err {
+				if err == nil {
+					t.Errorf("decoded %s", message)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if binary != (test.payload != nil) {
+				t.Fatalf("binary %v", binary)
+			}
+			if binary {
+				header, payload, err := EnvelopeUnpack(message)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(header) != test.json || !bytes.Equal(payload, test.payload) {
+					t.Errorf("got %s %v, want %s %v", header, payload, test.json, test.payload)
+				}
+				return
+			}
+			if string(message) != test.json {
+				t.Errorf("got %s, want %s", message, test.json)
+			}
+		})
+	}
+}
+
+func TestCodecBinaryRelay(t *testing.T) {
+	codec := CodecBySubprotocol(SUBPROTOCOL_MSGPACK)
+	data, err := codec.Marshal(map[string]interface{}{"Action": "sendData", "Data": []byte{0, 1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, binary, err := codecDecodeFrame(codec, data)
+	if err != nil || !binary {
+		t.Fatalf("binary %v, error %v", binary, err)
+	}
+
+	// the payload stays bytes on the way back
+	encoded, err := codecEncodeFrame(codec, Frame{Data: message, Binary: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value map[string]interface{}
+	err = msgpack.Unmarshal(encoded, &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, ok := value["Data"].([]byte); !ok || !bytes.Equal(payload, []byte{0, 1, 2}) {
+		t.Errorf("got %#v", value["Data"])
+	}
+}
@@ -2,20 +2,51 @@ package hive
 
 import (
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stepan-s/ws-bro/log"
 	"net"
 )
 
+// Frame An outgoing message
+type Frame struct {
+	Binary bool
+	Data   []byte
+	// Queued frame with the same key is replaced by this one
+	Key string
+	// Shared by connections of a fan-out, codec connections use Data
+	Prepared *websocket.PreparedMessage
+}
+
+// Frame message once for sending to many connections
+func prepareFrame(frame Frame) Frame {
+	mt := websocket.TextMessage
+	if frame.Binary {
+		mt = websocket.BinaryMessage
+	}
+	prepared, err := websocket.NewPreparedMessage(mt, frame.Data)
+	if err != nil {
+		// send as is
+		log.Error("Fail prepare message: %v", err)
+		return frame
+	}
+	frame.Prepared = prepared
+	return frame
+}
+
 type AConnection interface {
 	Start()
+	Id() uint64
 	RemoteAddr() net.Addr
-	Send([]byte)
+	Send(Frame)
 	Close()
+	CloseWithCode(code int, text string)
 }
 
+// AUserHandler Connection events, message flag is true for binary frames
 type AUserHandler interface {
 	ConnectionAdd(uint32, AConnection)
 	ConnectionRemove(uint32, AConnection)
-	ConnectionMessage(uint32, []byte)
+	ConnectionMessage(uint32, AConnection, []byte, bool)
 }
 
 type AUserStat interface {
@@ -27,10 +58,21 @@ type AUserStat interface {
 	Transmitted()
 }
 
+// AConnectionStat Connection level counters, called from connection goroutines
+type AConnectionStat interface {
+	Compressed(original int, compressed int)
+	Dropped()
+	SlowDisconnected()
+	Conflated()
+	Throttled()
+	AbuseDisconnected()
+	Rejected()
+}
+
 type AAppHandler interface {
-	ConnectionAdd(uuid.UUID, AConnection)
-	ConnectionRemove(uuid.UUID, AConnection)
-	ConnectionMessage(uuid.UUID, []byte)
+	ConnectionAdd(uuid.UUID, string, AConnection)
+	ConnectionRemove(uuid.UUID, string, AConnection)
+	ConnectionMessage(uuid.UUID, string, []byte, bool)
 }
 
 type AAppStat interface {
@@ -0,0 +1,170 @@
+package hive
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/stepan-s/ws-bro/log"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.Init(ioutil.Discard, log.NONE)
+	os.Exit(m.Run())
+}
+
+// Connection recording sent frames
+type testConnection struct {
+	id        uint64
+	frames    chan Frame
+	lock      sync.Mutex
+	started   bool
+	closed    bool
+	closeCode int
+	// closed before start
+	rejected bool
+}
+
+func newTestConnection() *testConnection {
+	return &testConnection{
+		id:     nextConnectionId(),
+		frames: make(chan Frame, 1000),
+	}
+}
+
+func (c *testConnection) Start() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.started = true
+	c.rejected = c.closed
+}
+
+func (c *testConnection) Id() uint64 {
+	return c.id
+}
+
+func (c *testConnection) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+}
+
+func (c *testConnection) Send(frame Frame) {
+	c.frames <- frame
+}
+
+func (c *testConnection) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+}
+
+func (c *testConnection) CloseWithCode(code int, text string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	c.closeCode = code
+}
+
+// Started, closed and close code
+func (c *testConnection) state() (bool, bool, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.started, c.closed, c.closeCode
+}
+
+// Next sent frame, fails after two seconds
+func (c *testConnection) next(t testing.TB) Frame {
+	t.Helper()
+	select {
+	case frame := <-c.frames:
+		return frame
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no frame sent to connection %d", c.id)
+		return Frame{}
+	}
+}
+
+// Next sent frame with action, other frames are skipped
+func (c *testConnection) nextAction(t testing.TB, action string) Frame {
+	t.Helper()
+	for {
+		frame := c.next(t)
+		if frame.Binary {
+			header, _, err := EnvelopeUnpack(frame.Data)
+			if err == nil && testAction(t, header) == action {
+				return frame
+			}
+			continue
+		}
+		if testAction(t, frame.Data) == action {
+			return frame
+		}
+	}
+}
+
+// No frames are sent for a while
+func (c *testConnection) none(t *testing.T) {
+	t.Helper()
+	select {
+	case frame := <-c.frames:
+		t.Fatalf("unexpected frame sent to connection %d: %s", c.id, frame.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func testAction(t testing.TB, rawMessage []byte) string {
+	t.Helper()
+	var message Message
+	err := json.Unmarshal(rawMessage, &message)
+	if err != nil {
+		t.Fatalf("invalid message: %v, %s", err, rawMessage)
+	}
+	return message.Action
+}
+
+// Hives with router over shards, stopped with the test
+func testHives(t testing.TB, shards int) (*Users, *Apps) {
+	saved := HiveShards
+	HiveShards = shards
+	ctx, stop := context.WithCancel(context.Background())
+	users := NewUsers(ctx, NewUsersStats())
+	apps := NewApps(ctx, "", NewAppsStats())
+	RouterStart(ctx, users, apps)
+	HiveShards = saved
+	t.Cleanup(stop)
+	return users, apps
+}
+
+// Connect user and skip hello
+func testUser(t testing.TB, users *Users, uid uint32) *testConnection {
+	t.Helper()
+	conn := newTestConnection()
+	users.ConnectionAdd(uid, conn)
+	conn.nextAction(t, ACTION_HELLO)
+	return conn
+}
+
+// Connect app instance and wait for the shard to register it
+func testApp(t testing.TB, apps *Apps, aid uuid.UUID, instance string) *testConnection {
+	t.Helper()
+	conn := newTestConnection()
+	apps.ConnectionAdd(aid, instance, conn)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		info := apps.GetApp(aid)
+		if info != nil {
+			for _, item := range info.Instances {
+				if item.Instance == instance {
+					return conn
+				}
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("app %v is not connected", aid)
+	return nil
+}
@@ -0,0 +1,154 @@
+package hive
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/stepan-s/ws-bro/log"
+)
+
+// Sends frames and closes the connection, implemented by every connection kind
+type connectionSender interface {
+	Send(message Frame)
+	CloseWithCode(code int, text string)
+}
+
+// Limits, codec and error replies shared by user, app and polled connections
+type connectionBase struct {
+	// connection that embeds the base
+	sender  connectionSender
+	codec   ACodec
+	options ConnectionOptions
+	ip      string
+	// rate limits key and log label
+	name string
+	// throttled messages in a row
+	violations int
+}
+
+// Check limits of incoming message and decode it, ok is false if message must be skipped
+func (c *connectionBase) accept(message []byte, binary bool) ([]byte, bool, bool) {
+	if !c.allow(len(message)) {
+		return nil, false, false
+	}
+	if c.codec != nil {
+		// the hive works with json
+		var err error
+		message, binary, err = codecDecodeFrame(c.codec, message)
+		if err != nil {
+			log.Error("Fail decode frame: %v, %s", err, c.name)
+			return nil, false, false
+		}
+	}
+	if !binary && !c.checkDepth(message) {
+		return nil, false, false
+	}
+	return message, binary, true
+}
+
+// Check rate limits, error is sent on the first throttled message in a row
+func (c *connectionBase) allow(size int) bool {
+	if allowBoth(c.options.Limiter, c.name, c.options.IpLimiter, c.ip, size) {
+		c.violations = 0
+		return true
+	}
+
+	c.violations++
+	if c.options.Stats != nil {
+		c.options.Stats.Throttled()
+	}
+	if c.violations == 1 {
+		c.sendError("Rate limit exceeded")
+	}
+	if c.violations == c.options.RateViolations {
+		log.Warning("Disconnect, reason: rate limit abuse, %s ip:%s", c.name, c.ip)
+		if c.options.Stats != nil {
+			c.options.Stats.AbuseDisconnected()
+		}
+		c.sender.CloseWithCode(websocket.ClosePolicyViolation, "rate limit abuse")
+	}
+	return false
+}
+
+// Check json nesting limit
+func (c *connectionBase) checkDepth(message []byte) bool {
+	if c.options.MaxJsonDepth > 0 && jsonDepth(message) > c.options.MaxJsonDepth {
+		c.reject("Message too complex")
+		return false
+	}
+	return true
+}
+
+// Handle too big or complex message by policy
+func (c *connectionBase) reject(reason string) {
+	if c.options.Stats != nil {
+		c.options.Stats.Rejected()
+	}
+	if c.options.Oversize == OVERSIZE_CLOSE {
+		c.sender.CloseWithCode(websocket.CloseMessageTooBig, reason)
+	} else {
+		c.sendError(reason)
+	}
+}
+
+func (c *connectionBase) sendError(text string) {
+	rawMessage, err := MessageErrorPack(&MessageError{
+		Action: ACTION_ERROR,
+		Error:  text,
+	})
+	if err != nil {
+		log.Error("Fail pack: %v, %s", err, c.name)
+	} else {
+		c.sender.Send(Frame{Data: rawMessage})
+	}
+}
+
+// Encode frame in connection encoding, ok is false for a broken frame
+func (c *connectionBase) encode(frame Frame) ([]byte, bool, bool) {
+	if c.codec == nil {
+		return frame.Data, frame.Binary, true
+	}
+	data, err := codecEncodeFrame(c.codec, frame)
+	if err != nil {
+		log.Error("Fail encode frame: %v, %s", err, c.name)
+		return nil, false, false
+	}
+	return data, true, true
+}
+
+// Write frame to websocket, compress if it is big enough
+func (c *connectionBase) writeFrame(conn *websocket.Conn, counter *CountingConn, frame Frame) error {
+	data, binary, ok := c.encode(frame)
+	if !ok {
+		// skip broken frame
+		return nil
+	}
+	mt := websocket.TextMessage
+	if binary {
+		mt = websocket.BinaryMessage
+	}
+	// prepared message is framed for json only
+	prepared := frame.Prepared
+	if c.codec != nil {
+		prepared = nil
+	}
+
+	compress := c.options.Compression && len(data) >= c.options.CompressionThreshold
+	conn.EnableWriteCompression(compress)
+	if !compress || counter == nil {
+		return writeMessage(conn, mt, data, prepared)
+	}
+
+	written := counter.Written()
+	err := writeMessage(conn, mt, data, prepared)
+	if err == nil && c.options.Stats != nil {
+		c.options.Stats.Compressed(len(data), int(counter.Written()-written))
+	}
+	return err
+}
+
+// Write prepared message if any, it is framed and compressed once for all connections
+func writeMessage(conn *websocket.Conn, mt int, data []byte, prepared *websocket.PreparedMessage) error {
+	if prepared != nil {
+		return conn.WritePreparedMessage(prepared)
+	}
+	return conn.WriteMessage(mt, data)
+}
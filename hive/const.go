@@ -2,6 +2,7 @@ package hive
 
 const ADD = 1
 const REMOVE = 2
+const SET = 3
 const SYSUID = 1
 
 const ACTION_SEND_DATA = "sendData"
@@ -11,3 +12,13 @@ const ACTION_CONNECTED = "connected"
 const ACTION_DISCONNECTED = "disconnected"
 const ACTION_ATTACHED = "attached"
 const ACTION_DETACHED = "detached"
+const ACTION_ERROR = "error"
+const ACTION_SHARE = "share"
+const ACTION_UNSHARE = "unshare"
+const ACTION_ACQUIRE_CONTROL = "acquireControl"
+const ACTION_RELEASE_CONTROL = "releaseControl"
+const ACTION_CONTROL_CHANGED = "controlChanged"
+const ACTION_SENT_DATA = "sentData"
+const ACTION_SET_OPTIONS = "setOptions"
+const ACTION_HELLO = "hello"
+const ACTION_SERVER_SHUTDOWN = "serverShutdown"
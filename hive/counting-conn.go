@@ -0,0 +1,27 @@
+package hive
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// CountingConn A network connection counting written bytes
+type CountingConn struct {
+	net.Conn
+	written uint64
+}
+
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+func (c *CountingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+// Written Bytes written to the connection
+func (c *CountingConn) Written() uint64 {
+	return atomic.LoadUint64(&c.written)
+}
@@ -0,0 +1,90 @@
+package hive
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/stepan-s/ws-bro/log"
+	"math/rand"
+	"time"
+)
+
+// DrainReconnectDelay Suggested reconnect delay in seconds on shutdown, each connection gets up to twice as much
+var DrainReconnectDelay int64 = 5
+
+// Reconnect delay in milliseconds, jitter spreads reconnects of all clients over the delay
+func drainDelay() int64 {
+	delay := DrainReconnectDelay * 1000
+	if delay <= 0 {
+		return 0
+	}
+	return delay + rand.Int63n(delay)
+}
+
+// Ask to reconnect later, close after queued frames
+func drainConnection(conn AConnection) {
+	rawMessage, err := MessageServerShutdownPack(&MessageServerShutdown{
+		Action: ACTION_SERVER_SHUTDOWN,
+		Delay:  drainDelay(),
+	})
+	if err != nil {
+		log.Error("Fail pack: %v", err)
+	} else {
+		conn.Send(Frame{Data: rawMessage})
+	}
+	conn.CloseWithCode(websocket.CloseGoingAway, "Server shutdown")
+}
+
+// Close connections evenly over the window, at once if there is no window
+func drainConnections(conns []AConnection, window time.Duration) {
+	for i, conn := range conns {
+		if window <= 0 {
+			drainConnection(conn)
+			continue
+		}
+		conn := conn
+		time.AfterFunc(window*time.Duration(i)/time.Duration(len(conns)), func() {
+			drainConnection(conn)
+		})
+	}
+}
+
+// Close all users connections, later connections are closed on add
+func (users *Users) drain(window time.Duration) {
+	users.draining = true
+	conns := make([]AConnection, 0, len(users.conns))
+	for _, items := range users.conns {
+		item := items.Front()
+		for item != nil {
+			conns = append(conns, item.Value.(*userConnectionItem).conn)
+			users.stats.Transmitted()
+			item = item.Next()
+		}
+	}
+	drainConnections(conns, window)
+}
+
+// Close all apps instances, later connections are closed on add
+func (apps *Apps) drain(window time.Duration) {
+	apps.draining = true
+	conns := make([]AConnection, 0, len(apps.conns))
+	for _, app := range apps.conns {
+		for _, item := range app.instances {
+			conns = append(conns, item.conn)
+			apps.stats.Transmitted()
+		}
+	}
+	drainConnections(conns, window)
+}
+
+// Drain Send serverShutdown to all connected users and close connections with 1001 over the window
+func (users *Users) Drain(window time.Duration) {
+	for _, shard := range users.shards {
+		shard.chanDrain <- window
+	}
+}
+
+// Drain Send serverShutdown to all connected apps and close connections with 1001 over the window
+func (apps *Apps) Drain(window time.Duration) {
+	for _, shard := range apps.shards {
+		shard.chanDrain <- window
+	}
+}
@@ -0,0 +1,129 @@
+package hive
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"testing"
+	"time"
+)
+
+func TestDrainDelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay int64
+		min   int64
+		max   int64
+	}{
+		{"disabled", 0, 0, 0},
+		{"negative", -1, 0, 0},
+		{"jitter", 5, 5000, 9999},
+	}
+	saved := DrainReconnectDelay
+	defer func() { DrainReconnectDelay = saved }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			DrainReconnectDelay = test.delay
+			for i := 0; i < 100; i++ {
+				delay := drainDelay()
+				if delay < test.min || delay > test.max {
+					t.Fatalf("delay %d, want %d..%d", delay, test.min, test.max)
+				}
+			}
+		})
+	}
+}
+
+// Connection got serverShutdown with a delay and is closed with 1001
+func testDrained(t *testing.T, conn *testConnection) {
+	t.Helper()
+	frame := conn.nextAction(t, ACTION_SERVER_SHUTDOWN)
+	var message MessageServerShutdown
+	err := json.Unmarshal(frame.Data, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Delay < DrainReconnectDelay*1000 || message.Delay >= DrainReconnectDelay*2000 {
+		t.Errorf("delay %d", message.Delay)
+	}
+	_, closed, code := conn.state()
+	if !closed || code != websocket.CloseGoingAway {
+		t.Errorf("closed %v with code %d", closed, code)
+	}
+}
+
+// Wait until every connection is closed, false on timeout
+func testAllClosed(conns []*testConnection, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		closed := 0
+		for _, conn := range conns {
+			_, isClosed, _ := conn.state()
+			if isClosed {
+				closed++
+			}
+		}
+		if closed == len(conns) {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+	}{
+		{"at once", 0},
+		{"over window", 300 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, 2)
+			var conns []*testConnection
+			for uid := uint32(10); uid < 14; uid++ {
+				conns = append(conns, testUser(t, users, uid))
+			}
+			// second tab of a user
+			conns = append(conns, testUser(t, users, 10))
+			for i := 0; i < 3; i++ {
+				conns = append(conns, testApp(t, apps, uuid.New(), ""))
+			}
+
+			started := time.Now()
+			users.Drain(test.window)
+			apps.Drain(test.window)
+			if test.window > 0 && testAllClosed(conns, test.window/3) {
+				t.Error("closed before the window")
+			}
+			if !testAllClosed(conns, test.window+time.Second) {
+				t.Fatal("not closed")
+			}
+			if time.Since(started) > test.window+500*time.Millisecond {
+				t.Errorf("closed in %v", time.Since(started))
+			}
+			for _, conn := range conns {
+				testDrained(t, conn)
+			}
+		})
+	}
+}
+
+func TestDrainNewConnections(t *testing.T) {
+	users, apps := testHives(t, 2)
+	users.Drain(0)
+	apps.Drain(0)
+
+	user := newTestConnection()
+	users.ConnectionAdd(10, user)
+	app := newTestConnection()
+	apps.ConnectionAdd(uuid.New(), "", app)
+	for _, conn := range []*testConnection{user, app} {
+		if !testAllClosed([]*testConnection{conn}, time.Second) {
+			t.Fatal("connection added while draining is not closed")
+		}
+		testDrained(t, conn)
+	}
+}
@@ -0,0 +1,51 @@
+package hive
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Binary frame layout:
+//
+//	+---------------+-------------+---------+
+//	| header length | header json | payload |
+//	|   uint16 BE   |             |  bytes  |
+//	+---------------+-------------+---------+
+//
+// Header is a regular message without Data, payload is passed as is.
+
+const envelopeMaxHeader = 0xFFFF
+
+// EnvelopeUnpack Split binary frame to header and payload
+func EnvelopeUnpack(frame []byte) ([]byte, []byte, error) {
+	if len(frame) < 2 {
+		return nil, nil, errors.New("envelope too short")
+	}
+	size := int(binary.BigEndian.Uint16(frame))
+	if len(frame) < 2+size {
+		return nil, nil, errors.New("envelope header truncated")
+	}
+	return frame[2 : 2+size], frame[2+size:], nil
+}
+
+// EnvelopePack Join header and payload to binary frame
+func EnvelopePack(header []byte, payload []byte) ([]byte, error) {
+	if len(header) > envelopeMaxHeader {
+		return nil, errors.New("envelope header too long")
+	}
+	frame := make([]byte, 2+len(header)+len(payload))
+	binary.BigEndian.PutUint16(frame, uint16(len(header)))
+	copy(frame[2:], header)
+	copy(frame[2+len(header):], payload)
+	return frame, nil
+}
+
+// Complete binary frame built in place, frame is length prefix and header
+func envelopeSeal(frame []byte, payload []byte) ([]byte, error) {
+	size := len(frame) - 2
+	if size > envelopeMaxHeader {
+		return nil, errors.New("envelope header too long")
+	}
+	binary.BigEndian.PutUint16(frame, uint16(size))
+	return append(frame, payload...), nil
+}
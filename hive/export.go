@@ -0,0 +1,89 @@
+package hive
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stepan-s/ws-bro/log"
+)
+
+// AExporter Receives relayed messages and lifecycle events, must not block
+type AExporter interface {
+	Export(subject string, payload []byte, binary bool)
+}
+
+// Lifecycle event payload
+type exportLifecycle struct {
+	Action string
+	Aid    *uuid.UUID `json:",omitempty"`
+	Uid    uint32     `json:",omitempty"`
+	Uids   []uint32   `json:",omitempty"`
+}
+
+func ExportUserSubject(uid uint32, event string) string {
+	return fmt.Sprintf("wsbro.user.%d.%s", uid, event)
+}
+
+func ExportAppSubject(aid uuid.UUID, event string) string {
+	return fmt.Sprintf("wsbro.app.%s.%s", aid.String(), event)
+}
+
+func exportLifecycleEvent(exporter AExporter, subject string, event *exportLifecycle) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Error("Fail pack export event: %v, subject:%s", err, subject)
+		return
+	}
+	exporter.Export(subject, payload, false)
+}
+
+// SetExporter Set export of user messages and connections, before connections are accepted
+func (users *Users) SetExporter(exporter AExporter) {
+	users.exporter = exporter
+	for _, shard := range users.shards {
+		shard.exporter = exporter
+	}
+}
+
+func (users *Users) exportPresence(uid uint32, action string) {
+	if users.exporter != nil {
+		exportLifecycleEvent(users.exporter, ExportUserSubject(uid, action), &exportLifecycle{
+			Action: action,
+			Uid:    uid,
+		})
+	}
+}
+
+// SetExporter Set export of app messages, connections and attachments, before connections are accepted
+func (apps *Apps) SetExporter(exporter AExporter) {
+	apps.exporter = exporter
+	for _, shard := range apps.shards {
+		shard.exporter = exporter
+	}
+}
+
+// Export data accepted for delivery, subject is of the sender
+func (apps *Apps) exportData(subject string, message []byte, binary bool) {
+	if apps.exporter != nil {
+		apps.exporter.Export(subject, message, binary)
+	}
+}
+
+func (apps *Apps) exportPresence(aid uuid.UUID, action string) {
+	if apps.exporter != nil {
+		exportLifecycleEvent(apps.exporter, ExportAppSubject(aid, action), &exportLifecycle{
+			Action: action,
+			Aid:    &aid,
+		})
+	}
+}
+
+func (apps *Apps) exportAttachment(aid uuid.UUID, action string, uids []uint32) {
+	if apps.exporter != nil && len(uids) > 0 {
+		exportLifecycleEvent(apps.exporter, ExportAppSubject(aid, action), &exportLifecycle{
+			Action: action,
+			Aid:    &aid,
+			Uids:   uids,
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package hive
+
+import (
+	"github.com/google/uuid"
+	"github.com/stepan-s/ws-bro/log"
+	"sync/atomic"
+	"time"
+)
+
+// GUEST_UID_FLAG Marks guest uids, regular uids never exceed int32
+const GUEST_UID_FLAG = 0x80000000
+
+// Guest uid is the flag, node hash bits and node sequence bits, guests of nodes do not collide
+const guestNodeBits = 10
+const guestSeqBits = 21
+
+// ShareGrant A time limited app access for guests
+type ShareGrant struct {
+	Id      uuid.UUID
+	Aid     uuid.UUID
+	Role    uint8
+	Expires time.Time
+	// Zero means unlimited
+	MaxUses uint32
+}
+
+type shareGrant struct {
+	ShareGrant
+	uses   uint32
+	guests []uint32
+}
+
+type appGrantEvent struct {
+	cmd   uint8
+	grant ShareGrant
+}
+
+type appUseGrantEvent struct {
+	id    uuid.UUID
+	reply chan uint32
+}
+
+// IsGuestUid Check uid is issued by a share grant
+func IsGuestUid(uid uint32) bool {
+	return uid&GUEST_UID_FLAG != 0
+}
+
+// Guest uid unique within the cluster
+func nextGuestUid() uint32 {
+	return GUEST_UID_FLAG | atomic.LoadUint32(&guestNode) | (atomic.AddUint32(&guestSeq, 1) & (1<<guestSeqBits - 1))
+}
+
+// Prefix guest uids with node hash bits, before connections are accepted
+func setGuestNode(node string) {
+	atomic.StoreUint32(&guestNode, (nodeHash(node)&(1<<guestNodeBits-1))<<guestSeqBits)
+}
+
+func (apps *Apps) addGrant(grant ShareGrant) {
+	apps.grants[grant.Id] = &shareGrant{ShareGrant: grant}
+	log.Info("Share app: %v, grant: %v, expires: %v", grant.Aid, grant.Id, grant.Expires)
+}
+
+// Issue a guest uid and attach it to the app, zero if grant is not usable
+func (apps *Apps) useGrant(event appUseGrantEvent) {
+	grant, exists := apps.grants[event.id]
+	if !exists || !grant.Expires.After(time.Now()) {
+		event.reply <- 0
+		return
+	}
+	if grant.MaxUses > 0 && grant.uses >= grant.MaxUses {
+		event.reply <- 0
+		return
+	}
+	grant.uses++
+
+	// guests of all shards share the sequence
+	uid := nextGuestUid()
+	grant.guests = append(grant.guests, uid)
+
+	conn, exists := apps.conns[grant.Aid]
+	if exists {
+		conn.attach(uid, grant.Role)
+	}
+	log.Info("Hello guest: %d, grant: %v", uid, grant.Id)
+	event.reply <- uid
+}
+
+// Attach guests of active grants to connected app
+func (apps *Apps) attachGuests(aid uuid.UUID, conn *App) {
+	for _, grant := range apps.grants {
+		if grant.Aid == aid {
+			for _, uid := range grant.guests {
+				conn.attach(uid, grant.Role)
+			}
+		}
+	}
+}
+
+// Forget guest uid of a closed connection, the grant use is given back if the guest never connected
+func (apps *Apps) releaseGuest(uid uint32, refund bool) {
+	for _, grant := range apps.grants {
+		for i, item := range grant.guests {
+			if item != uid {
+				continue
+			}
+			// guests may be in use by the router, copy
+			guests := make([]uint32, 0, len(grant.guests))
+			guests = append(guests, grant.guests[:i]...)
+			grant.guests = append(guests, grant.guests[i+1:]...)
+			if refund && grant.uses > 0 {
+				grant.uses--
+			}
+			conn, exists := apps.conns[grant.Aid]
+			if exists && apps.detachUid(grant.Aid, conn, uid) {
+				apps.notifyDetached(grant.Aid, []uint32{uid})
+			}
+			log.Info("Bye guest: %d, grant: %v", uid, grant.Id)
+			return
+		}
+	}
+}
+
+func (apps *Apps) revokeGrant(id uuid.UUID) {
+	grant, exists := apps.grants[id]
+	if !exists {
+		return
+	}
+
+	delete(apps.grants, id)
+	conn, exists := apps.conns[grant.Aid]
+	if exists {
+		for _, uid := range grant.guests {
+			apps.detachUid(grant.Aid, conn, uid)
+		}
+	}
+	apps.notifyDetached(grant.Aid, grant.guests)
+	log.Info("Unshare app: %v, grant: %v", grant.Aid, grant.Id)
+}
+
+func (apps *Apps) expireGrants() {
+	now := time.Now()
+	for id, grant := range apps.grants {
+		if !grant.Expires.After(now) {
+			apps.revokeGrant(id)
+		}
+	}
+}
+
+// AddGrant Register share grant
+func (apps *Apps) AddGrant(grant ShareGrant) {
+	apps.shard(grant.Aid).chanGrant <- appGrantEvent{ADD, grant}
+}
+
+// RevokeGrant Remove share grant and detach its guests
+func (apps *Apps) RevokeGrant(id uuid.UUID) {
+	// grant is known by the shard of its app only
+	for _, shard := range apps.shards {
+		shard.chanGrant <- appGrantEvent{REMOVE, ShareGrant{Id: id}}
+	}
+}
+
+// ReleaseGuest Give back the grant use of a guest uid which is not connected
+func (apps *Apps) ReleaseGuest(uid uint32) {
+	// grant is known by the shard of its app only
+	for _, shard := range apps.shards {
+		shard.chanFreeGuest <- uid
+	}
+}
+
+// UseGrant Get guest uid for share grant, zero if grant is expired, exhausted or unknown
+func (apps *Apps) UseGrant(id uuid.UUID) uint32 {
+	reply := make(chan uint32, len(apps.shards))
+	for _, shard := range apps.shards {
+		shard.chanUseGrant <- appUseGrantEvent{id, reply}
+	}
+	var uid uint32 = 0
+	for range apps.shards {
+		shardUid := <-reply
+		if shardUid != 0 {
+			uid = shardUid
+		}
+	}
+	return uid
+}
@@ -0,0 +1,126 @@
+package hive
+
+import (
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+// Use grant until a guest uid is issued, released uses are given back asynchronously
+func testUseGrant(t *testing.T, apps *Apps, id uuid.UUID) uint32 {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		uid := apps.UseGrant(id)
+		if uid != 0 {
+			return uid
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return 0
+}
+
+func TestUseGrant(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		maxUses uint32
+		uses    int
+		issued  int
+	}{
+		{"unlimited", time.Minute, 0, 3, 3},
+		{"limited", time.Minute, 2, 3, 2},
+		{"expired", -time.Second, 0, 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, apps := testHives(t, 4)
+			aid := uuid.New()
+			testApp(t, apps, aid, "")
+			grant := ShareGrant{Id: uuid.New(), Aid: aid, Role: ROLE_VIEWER, Expires: time.Now().Add(test.ttl), MaxUses: test.maxUses}
+			apps.AddGrant(grant)
+
+			var guests []uint32
+			for i := 0; i < test.uses; i++ {
+				uid := apps.UseGrant(grant.Id)
+				if uid == 0 {
+					continue
+				}
+				if !IsGuestUid(uid) {
+					t.Errorf("uid %d is not a guest uid", uid)
+				}
+				guests = append(guests, uid)
+			}
+			if len(guests) != test.issued {
+				t.Fatalf("issued %d guests, want %d", len(guests), test.issued)
+			}
+			testUids(t, apps, aid, guests)
+		})
+	}
+}
+
+func TestGuestDisconnected(t *testing.T) {
+	users, apps := testHives(t, 4)
+	aid := uuid.New()
+	app := testApp(t, apps, aid, "")
+	grant := ShareGrant{Id: uuid.New(), Aid: aid, Role: ROLE_VIEWER, Expires: time.Now().Add(time.Minute)}
+	apps.AddGrant(grant)
+
+	// each reconnect issues a new guest uid, the closed ones are detached
+	for i := 0; i < 3; i++ {
+		uid := apps.UseGrant(grant.Id)
+		conn := testUser(t, users, uid)
+		testUids(t, apps, aid, []uint32{uid})
+		users.ConnectionRemove(uid, conn)
+		testUids(t, apps, aid, []uint32{})
+	}
+
+	// guests of the grant are attached to the connected app again
+	apps.ConnectionRemove(aid, "", app)
+	for apps.GetApp(aid) != nil {
+		time.Sleep(time.Millisecond)
+	}
+	testApp(t, apps, aid, "")
+	testUids(t, apps, aid, []uint32{})
+}
+
+func TestReleaseGuest(t *testing.T) {
+	_, apps := testHives(t, 4)
+	aid := uuid.New()
+	testApp(t, apps, aid, "")
+	grant := ShareGrant{Id: uuid.New(), Aid: aid, Role: ROLE_VIEWER, Expires: time.Now().Add(time.Minute), MaxUses: 1}
+	apps.AddGrant(grant)
+
+	uid := apps.UseGrant(grant.Id)
+	if uid == 0 {
+		t.Fatal("grant is not usable")
+	}
+	if apps.UseGrant(grant.Id) != 0 {
+		t.Fatal("grant is used twice")
+	}
+
+	// the guest never connected
+	apps.ReleaseGuest(uid)
+	testUids(t, apps, aid, []uint32{})
+	next := testUseGrant(t, apps, grant.Id)
+	if next == 0 || next == uid {
+		t.Errorf("released use is not given back, uid %d", next)
+	}
+}
+
+func TestRevokeGrant(t *testing.T) {
+	users, apps := testHives(t, 4)
+	aid := uuid.New()
+	testApp(t, apps, aid, "")
+	grant := ShareGrant{Id: uuid.New(), Aid: aid, Role: ROLE_VIEWER, Expires: time.Now().Add(time.Minute)}
+	apps.AddGrant(grant)
+	uid := apps.UseGrant(grant.Id)
+	conn := testUser(t, users, uid)
+
+	apps.RevokeGrant(grant.Id)
+	conn.nextAction(t, ACTION_DETACHED)
+	testUids(t, apps, aid, []uint32{})
+	if apps.UseGrant(grant.Id) != 0 {
+		t.Error("revoked grant is usable")
+	}
+}
@@ -0,0 +1,79 @@
+package hive
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+	"testing"
+)
+
+func TestInstanceDelivery(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance string
+		ui       bool
+		daemon   bool
+		error    string
+	}{
+		{"all instances", "", true, true, ""},
+		{"named instance", "daemon", false, true, ""},
+		{"not connected instance", "updater", false, false, "Instance is not connected"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, 2)
+			aid := uuid.New()
+			ui := testApp(t, apps, aid, "ui")
+			daemon := testApp(t, apps, aid, "daemon")
+			user := testUser(t, users, 10)
+			apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10}, Roles: map[uint32]uint8{10: ROLE_OPERATOR}})
+			user.nextAction(t, ACTION_CONNECTED)
+
+			users.ConnectionMessage(10, user, []byte(fmt.Sprintf(`{"Action":"sendData","To":"%s","Instance":"%s","Data":1}`, aid, test.instance)), false)
+			for _, item := range []struct {
+				conn     *testConnection
+				received bool
+			}{{ui, test.ui}, {daemon, test.daemon}} {
+				if item.received {
+					item.conn.nextAction(t, ACTION_RECEIVED_DATA)
+				}
+			}
+			if test.error != "" {
+				frame := user.nextAction(t, ACTION_ERROR)
+				if !strings.Contains(string(frame.Data), test.error) {
+					t.Errorf("user got %s", frame.Data)
+				}
+			}
+			ui.none(t)
+			daemon.none(t)
+		})
+	}
+}
+
+func TestInstancePresence(t *testing.T) {
+	users, apps := testHives(t, 2)
+	aid := uuid.New()
+	ui := testApp(t, apps, aid, "ui")
+	user := testUser(t, users, 10)
+	apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10}})
+	user.nextAction(t, ACTION_CONNECTED)
+
+	// another instance does not change presence
+	daemon := testApp(t, apps, aid, "daemon")
+	info := apps.GetApp(aid)
+	if len(info.Instances) != 2 || info.Instances[0].Instance != "daemon" || info.Instances[1].Instance != "ui" {
+		t.Fatalf("instances %+v", info.Instances)
+	}
+	apps.ConnectionRemove(aid, "ui", ui)
+	user.none(t)
+	if _, closed, _ := ui.state(); !closed {
+		t.Error("removed instance is not closed")
+	}
+
+	// the app is gone with the last instance
+	apps.ConnectionRemove(aid, "daemon", daemon)
+	user.nextAction(t, ACTION_DISCONNECTED)
+	if apps.GetApp(aid) != nil {
+		t.Error("app is still connected")
+	}
+}
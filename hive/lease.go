@@ -0,0 +1,147 @@
+package hive
+
+import (
+	"github.com/google/uuid"
+	"github.com/stepan-s/ws-bro/log"
+	"time"
+)
+
+// ControlLeaseTTL Control lease inactivity timeout in seconds
+var ControlLeaseTTL int64 = 60
+
+// An exclusive right to send data to app
+type appLease struct {
+	uid     uint32
+	expires time.Time
+}
+
+type appControlEvent struct {
+	cmd uint8
+	aid uuid.UUID
+	uid uint32
+	// sent by other node, not forwarded again
+	remote bool
+}
+
+// Check uid may send data to app, prolong lease of the holder
+func (apps *Apps) checkControl(app *App, uid uint32) bool {
+	if app.lease.uid == 0 {
+		return true
+	}
+	if app.lease.uid != uid {
+		return false
+	}
+	app.lease.expires = time.Now().Add(time.Duration(ControlLeaseTTL) * time.Second)
+	return true
+}
+
+// Apply control event to local app or send it to the node the app is connected to
+func (apps *Apps) forwardControl(event appControlEvent) {
+	_, exists := apps.conns[event.aid]
+	if !exists && !event.remote && apps.remote != nil {
+		apps.remote.SendControl(event.cmd, event.aid, event.uid)
+		return
+	}
+	switch event.cmd {
+	case ADD:
+		apps.acquireControl(event.aid, event.uid)
+	case REMOVE:
+		apps.releaseControl(event.aid, event.uid)
+	}
+}
+
+func (apps *Apps) acquireControl(aid uuid.UUID, uid uint32) {
+	app, exists := apps.conns[aid]
+	if !exists {
+		return
+	}
+	role, exists := app.roles[uid]
+	if !exists {
+		return
+	}
+	if role < ROLE_OPERATOR {
+		apps.replyError(aid, uid, "Control is not allowed")
+		return
+	}
+	if app.lease.uid != 0 && app.lease.uid != uid {
+		apps.replyError(aid, uid, "Control is held by another user")
+		return
+	}
+
+	app.lease = appLease{
+		uid:     uid,
+		expires: time.Now().Add(time.Duration(ControlLeaseTTL) * time.Second),
+	}
+	apps.leases[aid] = true
+	log.Debug("Control acquired, app: %v, user: %d", aid, uid)
+	apps.notifyControl(aid, app)
+}
+
+func (apps *Apps) releaseControl(aid uuid.UUID, uid uint32) {
+	app, exists := apps.conns[aid]
+	if !exists || app.lease.uid != uid || uid == 0 {
+		return
+	}
+
+	app.lease = appLease{}
+	delete(apps.leases, aid)
+	log.Debug("Control released, app: %v, user: %d", aid, uid)
+	apps.notifyControl(aid, app)
+}
+
+// Detach uid from app, attached uids are told at once if it held the control
+func (apps *Apps) detachUid(aid uuid.UUID, app *App, uid uint32) bool {
+	holder := app.lease.uid != 0 && app.lease.uid == uid
+	if !app.detach(uid) {
+		return false
+	}
+	if holder {
+		delete(apps.leases, aid)
+		log.Debug("Control dropped on detach, app: %v, user: %d", aid, uid)
+		apps.notifyControl(aid, app)
+	}
+	return true
+}
+
+// Release all leases held by uid
+func (apps *Apps) releaseControls(uid uint32) {
+	for aid := range apps.leases {
+		apps.releaseControl(aid, uid)
+	}
+}
+
+func (apps *Apps) expireLeases() {
+	now := time.Now()
+	for aid := range apps.leases {
+		app := apps.conns[aid]
+		// holder may be detached already
+		if app.lease.uid == 0 || !app.lease.expires.After(now) {
+			app.lease = appLease{}
+			delete(apps.leases, aid)
+			apps.notifyControl(aid, app)
+		}
+	}
+}
+
+// Send control holder to app and attached uids
+func (apps *Apps) notifyControl(aid uuid.UUID, app *App) {
+	rawMessage, err := MessageControlChangedPack(&MessageControlChanged{
+		Action: ACTION_CONTROL_CHANGED,
+		Aid:    aid,
+		Uid:    app.lease.uid,
+	})
+	if err != nil {
+		log.Error("Fail pack %v", err)
+		return
+	}
+	app.send("", Frame{Data: rawMessage})
+	apps.stats.Transmitted()
+	if len(app.uids) > 0 {
+		apps.chanOut <- AppMessageFromEvent{
+			Aid:        aid,
+			Uids:       app.uids,
+			RawMessage: rawMessage,
+			Notice:     true,
+		}
+	}
+}
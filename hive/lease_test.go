@@ -0,0 +1,132 @@
+package hive
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testControl(users *Users, uid uint32, conn AConnection, action string, aid uuid.UUID) {
+	users.ConnectionMessage(uid, conn, []byte(fmt.Sprintf(`{"Action":"%s","To":"%s"}`, action, aid)), false)
+}
+
+func TestAcquireControl(t *testing.T) {
+	tests := []struct {
+		name  string
+		role  uint8
+		error string
+	}{
+		{"viewer", ROLE_VIEWER, "Control is not allowed"},
+		{"operator", ROLE_OPERATOR, ""},
+		{"owner", ROLE_OWNER, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, 2)
+			aid := uuid.New()
+			app := testApp(t, apps, aid, "")
+			user := testUser(t, users, 10)
+			apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10}, Roles: map[uint32]uint8{10: test.role}})
+			user.nextAction(t, ACTION_CONNECTED)
+
+			testControl(users, 10, user, ACTION_ACQUIRE_CONTROL, aid)
+			if test.error != "" {
+				frame := user.nextAction(t, ACTION_ERROR)
+				if !strings.Contains(string(frame.Data), test.error) {
+					t.Errorf("user got %s", frame.Data)
+				}
+				app.none(t)
+				return
+			}
+			for _, frame := range []Frame{app.nextAction(t, ACTION_CONTROL_CHANGED), user.nextAction(t, ACTION_CONTROL_CHANGED)} {
+				if !strings.Contains(string(frame.Data), `"Uid":10`) {
+					t.Errorf("got %s", frame.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestControlLease(t *testing.T) {
+	tests := []struct {
+		name    string
+		release func(users *Users, apps *Apps, conn *testConnection, aid uuid.UUID)
+	}{
+		{"released", func(users *Users, apps *Apps, conn *testConnection, aid uuid.UUID) {
+			testControl(users, 10, conn, ACTION_RELEASE_CONTROL, aid)
+		}},
+		{"holder disconnected", func(users *Users, apps *Apps, conn *testConnection, aid uuid.UUID) {
+			users.ConnectionRemove(10, conn)
+		}},
+		{"holder detached", func(users *Users, apps *Apps, conn *testConnection, aid uuid.UUID) {
+			apps.UpdateUids(AppUidsEvent{Cmd: REMOVE, Aid: aid, Uids: []uint32{10}})
+		}},
+		{"holder left out of set", func(users *Users, apps *Apps, conn *testConnection, aid uuid.UUID) {
+			apps.UpdateUids(AppUidsEvent{Cmd: SET, Aid: aid, Uids: []uint32{11}})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, 2)
+			aid := uuid.New()
+			app := testApp(t, apps, aid, "")
+			holder := testUser(t, users, 10)
+			other := testUser(t, users, 11)
+			apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10, 11}})
+			holder.nextAction(t, ACTION_CONNECTED)
+			other.nextAction(t, ACTION_CONNECTED)
+
+			testControl(users, 10, holder, ACTION_ACQUIRE_CONTROL, aid)
+			app.nextAction(t, ACTION_CONTROL_CHANGED)
+			other.nextAction(t, ACTION_CONTROL_CHANGED)
+
+			// the lease is exclusive
+			users.ConnectionMessage(11, other, []byte(fmt.Sprintf(`{"Action":"sendData","To":"%s","Data":1}`, aid)), false)
+			frame := other.nextAction(t, ACTION_ERROR)
+			if !strings.Contains(string(frame.Data), "Control is held by another user") {
+				t.Errorf("user got %s", frame.Data)
+			}
+			testControl(users, 11, other, ACTION_ACQUIRE_CONTROL, aid)
+			other.nextAction(t, ACTION_ERROR)
+
+			released := time.Now()
+			test.release(users, apps, holder, aid)
+			frame = app.nextAction(t, ACTION_CONTROL_CHANGED)
+			if !strings.Contains(string(frame.Data), `"Uid":0`) {
+				t.Errorf("app got %s", frame.Data)
+			}
+			other.nextAction(t, ACTION_CONTROL_CHANGED)
+			// not left to the lease expiry
+			if time.Since(released) > 500*time.Millisecond {
+				t.Errorf("control changed in %v", time.Since(released))
+			}
+			users.ConnectionMessage(11, other, []byte(fmt.Sprintf(`{"Action":"sendData","To":"%s","Data":1}`, aid)), false)
+			app.nextAction(t, ACTION_RECEIVED_DATA)
+		})
+	}
+}
+
+func TestControlLeaseExpired(t *testing.T) {
+	saved := ControlLeaseTTL
+	ControlLeaseTTL = 0
+	defer func() {
+		ControlLeaseTTL = saved
+	}()
+
+	users, apps := testHives(t, 1)
+	aid := uuid.New()
+	app := testApp(t, apps, aid, "")
+	holder := testUser(t, users, 10)
+	apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10}})
+	holder.nextAction(t, ACTION_CONNECTED)
+
+	testControl(users, 10, holder, ACTION_ACQUIRE_CONTROL, aid)
+	app.nextAction(t, ACTION_CONTROL_CHANGED)
+	// expired on the next tick
+	frame := app.nextAction(t, ACTION_CONTROL_CHANGED)
+	if !strings.Contains(string(frame.Data), `"Uid":0`) {
+		t.Errorf("app got %s", frame.Data)
+	}
+}
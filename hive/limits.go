@@ -0,0 +1,77 @@
+package hive
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
+)
+
+const OVERSIZE_REJECT = 1
+const OVERSIZE_CLOSE = 2
+
+var oversizeNames = map[uint8]string{
+	OVERSIZE_REJECT: "reject",
+	OVERSIZE_CLOSE:  "close",
+}
+
+var errMessageTooBig = errors.New("message too big")
+
+// OversizeParse Get oversize policy by name
+func OversizeParse(name string) (uint8, bool) {
+	for policy, policyName := range oversizeNames {
+		if policyName == name {
+			return policy, true
+		}
+	}
+	return 0, false
+}
+
+// Read message not bigger than limit, the rest of a big message is skipped by the next read
+func readLimited(conn *websocket.Conn, limit int64) (int, []byte, error) {
+	if limit <= 0 {
+		return conn.ReadMessage()
+	}
+	mt, r, err := conn.NextReader()
+	if err != nil {
+		return mt, nil, err
+	}
+	message, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return mt, nil, err
+	}
+	if int64(len(message)) > limit {
+		return mt, nil, errMessageTooBig
+	}
+	return mt, message, nil
+}
+
+// Max nesting of json objects and arrays, without validation
+func jsonDepth(data []byte) int {
+	depth := 0
+	maxDepth := 0
+	inString := false
+	escaped := false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+			if depth > maxDepth {
+				maxDepth = depth
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return maxDepth
+}
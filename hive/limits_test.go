@@ -0,0 +1,198 @@
+package hive
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJsonDepth(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		depth int
+	}{
+		{"scalar", `1`, 0},
+		{"object", `{"a":1}`, 1},
+		{"nested", `{"a":[{"b":[1]}]}`, 4},
+		{"siblings", `[[1],[[2]],3]`, 3},
+		{"brackets in string", `{"a":"[[[{{{"}`, 1},
+		{"escaped quote", `{"a":"\"[[["}`, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if depth := jsonDepth([]byte(test.json)); depth != test.depth {
+				t.Errorf("depth %d, want %d", depth, test.depth)
+			}
+		})
+	}
+}
+
+func TestOversizeParse(t *testing.T) {
+	for policy, name := range oversizeNames {
+		if parsed, ok := OversizeParse(name); !ok || parsed != policy {
+			t.Errorf("%s parsed %d %v", name, parsed, ok)
+		}
+	}
+	if _, ok := OversizeParse("truncate"); ok {
+		t.Error("unknown policy parsed")
+	}
+}
+
+func TestReadLimited(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int64
+		messages []string
+		results  []string
+	}{
+		{"no limit", 0, []string{"abcdef"}, []string{"abcdef"}},
+		{"fits", 6, []string{"abcdef"}, []string{"abcdef"}},
+		// the rest of a big message is skipped
+		{"too big", 5, []string{"abcdef", "abc"}, []string{"", "abc"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results := make(chan string, len(test.messages))
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				for range test.messages {
+					_, message, err := readLimited(conn, test.limit)
+					if err == errMessageTooBig {
+						results <- ""
+						continue
+					}
+					if err != nil {
+						return
+					}
+					results <- string(message)
+				}
+			}))
+			defer server.Close()
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			for _, message := range test.messages {
+				err = conn.WriteMessage(websocket.TextMessage, []byte(message))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, want := range test.results {
+				if got := <-results; got != want {
+					t.Errorf("got %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+// User handler recording messages
+type testUserHandler struct {
+	messages chan string
+}
+
+func (h *testUserHandler) ConnectionAdd(uid uint32, conn AConnection)    {}
+func (h *testUserHandler) ConnectionRemove(uid uint32, conn AConnection) {}
+func (h *testUserHandler) ConnectionMessage(uid uint32, conn AConnection, message []byte, binary bool) {
+	h.messages <- string(message)
+}
+
+// Started user connection over websocket, client side is returned
+func testUserConnection(t *testing.T, options ConnectionOptions) (*websocket.Conn, *testUserHandler) {
+	return testUserConnectionWith(t, options, nil)
+}
+
+// User connection over websocket, prepare is called before start
+func testUserConnectionWith(t *testing.T, options ConnectionOptions, prepare func(*UserConnection)) (*websocket.Conn, *testUserHandler) {
+	handler := &testUserHandler{make(chan string, 100)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := NewUserConnection(handler, 10, conn, options)
+		if prepare != nil {
+			prepare(c)
+		}
+		c.Start()
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, handler
+}
+
+func TestUserConnectionOversize(t *testing.T) {
+	tests := []struct {
+		name      string
+		oversize  uint8
+		message   string
+		error     string
+		closeCode int
+	}{
+		{"too big rejected", OVERSIZE_REJECT, `{"Data":"` + strings.Repeat("a", 100) + `"}`, "Message too big", 0},
+		{"too complex rejected", OVERSIZE_REJECT, `[[[[[1]]]]]`, "Message too complex", 0},
+		{"too big closed", OVERSIZE_CLOSE, `{"Data":"` + strings.Repeat("a", 100) + `"}`, "", websocket.CloseMessageTooBig},
+		{"too complex closed", OVERSIZE_CLOSE, `[[[[[1]]]]]`, "", websocket.CloseMessageTooBig},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stat := &testStat{}
+			client, handler := testUserConnection(t, ConnectionOptions{
+				MaxMessageSize: 64,
+				MaxJsonDepth:   4,
+				Oversize:       test.oversize,
+				Stats:          stat,
+			})
+			_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			err := client.WriteMessage(websocket.TextMessage, []byte(test.message))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, message, err := client.ReadMessage()
+			if test.closeCode != 0 {
+				if !websocket.IsCloseError(err, test.closeCode) {
+					t.Fatalf("got %s %v, want close %d", message, err, test.closeCode)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(string(message), test.error) {
+					t.Errorf("got %s, want %s", message, test.error)
+				}
+				// connection is still usable
+				err = client.WriteMessage(websocket.TextMessage, []byte(`{"N":1}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case got := <-handler.messages:
+					if got != `{"N":1}` {
+						t.Errorf("handler got %s", got)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("no message handled")
+				}
+			}
+			if n := atomic.LoadInt64(&stat.rejected); n != 1 {
+				t.Errorf("rejected %d", n)
+			}
+		})
+	}
+}
@@ -9,18 +9,22 @@ type Message struct {
 	Action string
 }
 
-// in
-type MessageUserSendData struct {
+// out, echo of user data to other users of app
+type MessageUserSentData struct {
 	Action string
 	To     uuid.UUID
+	From   uint32
+	Id     string `json:",omitempty"`
 	Data   json.RawMessage
 }
 
 // out
 type MessageUserReceivedData struct {
-	Action string
-	From   uuid.UUID
-	Data   json.RawMessage
+	Action   string
+	From     uuid.UUID
+	Instance string `json:",omitempty"`
+	Id       string `json:",omitempty"`
+	Data     json.RawMessage
 }
 
 // in
@@ -57,40 +61,58 @@ type MessageUserDetached struct {
 	List []uuid.UUID
 }
 
-// in
-type MessageAppSendData struct {
+// out
+type MessageAppReceivedData struct {
 	Action string
+	From   uint32
+	Cid    uint64 `json:",omitempty"`
+	Role   string
+	Id     string `json:",omitempty"`
 	Data   json.RawMessage
 }
 
+// out, to users and app
+type MessageControlChanged struct {
+	Action string
+	Aid    uuid.UUID
+	Uid    uint32
+}
+
 // out
-type MessageAppReceivedData struct {
+type MessageUserError struct {
 	Action string
-	From   uint32
-	Data   json.RawMessage
+	Aid    uuid.UUID
+	Error  string
 }
 
-func MessageRawGetAction(rawMessage []byte) (string, error) {
-	var message Message
-	err := json.Unmarshal(rawMessage, &message)
-	if err != nil {
-		return "", err
-	} else {
-		return message.Action, nil
-	}
+// out
+type MessageUserHello struct {
+	Action string
+	Cid    uint64
 }
 
-func MessageUserSendDataUnpack(rawMessage []byte) (*MessageUserSendData, error) {
-	var message MessageUserSendData
-	err := json.Unmarshal(rawMessage, &message)
+// out, to users and apps, reconnect after Delay milliseconds
+type MessageServerShutdown struct {
+	Action string
+	Delay  int64
+}
+
+// in/out
+type MessageError struct {
+	Action string
+	Error  string
+}
+
+func MessageUserConnectedPack(message *MessageUserConnected) ([]byte, error) {
+	rawMessage, err := json.Marshal(message)
 	if err != nil {
 		return nil, err
 	} else {
-		return &message, nil
+		return rawMessage, nil
 	}
 }
 
-func MessageAppReceivedDataPack(message *MessageAppReceivedData) ([]byte, error) {
+func MessageUserDisconnectedPack(message *MessageUserDisconnected) ([]byte, error) {
 	rawMessage, err := json.Marshal(message)
 	if err != nil {
 		return nil, err
@@ -99,17 +121,16 @@ func MessageAppReceivedDataPack(message *MessageAppReceivedData) ([]byte, error)
 	}
 }
 
-func MessageAppSendDataUnpack(rawMessage []byte) (*MessageAppSendData, error) {
-	var message MessageAppSendData
-	err := json.Unmarshal(rawMessage, &message)
+func MessageUserAttachedPack(message *MessageUserAttached) ([]byte, error) {
+	rawMessage, err := json.Marshal(message)
 	if err != nil {
 		return nil, err
 	} else {
-		return &message, nil
+		return rawMessage, nil
 	}
 }
 
-func MessageUserReceivedDataPack(message *MessageUserReceivedData) ([]byte, error) {
+func MessageUserDetachedPack(message *MessageUserDetached) ([]byte, error) {
 	rawMessage, err := json.Marshal(message)
 	if err != nil {
 		return nil, err
@@ -118,7 +139,7 @@ func MessageUserReceivedDataPack(message *MessageUserReceivedData) ([]byte, erro
 	}
 }
 
-func MessageUserConnectedPack(message *MessageUserConnected) ([]byte, error) {
+func MessageUserErrorPack(message *MessageUserError) ([]byte, error) {
 	rawMessage, err := json.Marshal(message)
 	if err != nil {
 		return nil, err
@@ -127,7 +148,7 @@ func MessageUserConnectedPack(message *MessageUserConnected) ([]byte, error) {
 	}
 }
 
-func MessageUserDisconnectedPack(message *MessageUserDisconnected) ([]byte, error) {
+func MessageUserHelloPack(message *MessageUserHello) ([]byte, error) {
 	rawMessage, err := json.Marshal(message)
 	if err != nil {
 		return nil, err
@@ -136,7 +157,7 @@ func MessageUserDisconnectedPack(message *MessageUserDisconnected) ([]byte, erro
 	}
 }
 
-func MessageUserAttachedPack(message *MessageUserAttached) ([]byte, error) {
+func MessageServerShutdownPack(message *MessageServerShutdown) ([]byte, error) {
 	rawMessage, err := json.Marshal(message)
 	if err != nil {
 		return nil, err
@@ -145,7 +166,7 @@ func MessageUserAttachedPack(message *MessageUserAttached) ([]byte, error) {
 	}
 }
 
-func MessageUserDetachedPack(message *MessageUserDetached) ([]byte, error) {
+func MessageErrorPack(message *MessageError) ([]byte, error) {
 	rawMessage, err := json.Marshal(message)
 	if err != nil {
 		return nil, err
@@ -154,17 +175,16 @@ func MessageUserDetachedPack(message *MessageUserDetached) ([]byte, error) {
 	}
 }
 
-func MessageUserGetConnectedUnpack(rawMessage []byte) (*MessageUserGetConnected, error) {
-	var message MessageUserGetConnected
-	err := json.Unmarshal(rawMessage, &message)
+func MessageControlChangedPack(message *MessageControlChanged) ([]byte, error) {
+	rawMessage, err := json.Marshal(message)
 	if err != nil {
 		return nil, err
 	} else {
-		return &message, nil
+		return rawMessage, nil
 	}
 }
 
-func MessageUserGetConnectedPack(message *MessageUserGetConnected) ([]byte, error) {
+func MessageUserSentDataPack(message *MessageUserSentData) ([]byte, error) {
 	rawMessage, err := json.Marshal(message)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,84 @@
+package hive
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+// Wait for connection is closed by the hive
+func testClosed(t *testing.T, conn *testConnection) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, closed, _ := conn.state(); closed {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("connection %d is not closed", conn.id)
+}
+
+func TestMirror(t *testing.T) {
+	tests := []struct {
+		name      string
+		mirror    bool
+		reconnect string
+	}{
+		{"disabled", false, ""},
+		{"enabled", true, ""},
+		{"other instance reconnected", true, "b"},
+		{"same instance reconnected", true, "a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, 2)
+			aid := uuid.New()
+			instances := map[string]*testConnection{
+				"a": testApp(t, apps, aid, "a"),
+				"b": testApp(t, apps, aid, "b"),
+			}
+			sender := testUser(t, users, 10)
+			viewer := testUser(t, users, 11)
+			apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10, 11}})
+			sender.nextAction(t, ACTION_CONNECTED)
+			viewer.nextAction(t, ACTION_CONNECTED)
+			send := func() {
+				users.ConnectionMessage(10, sender, []byte(fmt.Sprintf(`{"Action":"sendData","To":"%s","Instance":"a","Data":{"N":1}}`, aid)), false)
+				instances["a"].nextAction(t, ACTION_RECEIVED_DATA)
+			}
+
+			apps.ConnectionMessage(aid, "a", []byte(fmt.Sprintf(`{"Action":"setOptions","Mirror":%v}`, test.mirror)), false)
+			if test.mirror {
+				// options go through the router, wait for the first echo
+				deadline := time.Now().Add(time.Second)
+				for len(viewer.frames) == 0 && time.Now().Before(deadline) {
+					send()
+				}
+				// echoes of the probes may still be on the way
+				time.Sleep(10 * time.Millisecond)
+				for len(viewer.frames) > 0 {
+					viewer.nextAction(t, ACTION_SENT_DATA)
+				}
+			}
+			if test.reconnect != "" {
+				previous := instances[test.reconnect]
+				instances[test.reconnect] = newTestConnection()
+				apps.ConnectionAdd(aid, test.reconnect, instances[test.reconnect])
+				testClosed(t, previous)
+			}
+
+			send()
+			if test.mirror {
+				frame := viewer.nextAction(t, ACTION_SENT_DATA)
+				if string(frame.Data) != fmt.Sprintf(`{"Action":"sentData","To":"%s","From":10,"Data":{"N":1}}`, aid) {
+					t.Errorf("viewer got %s", frame.Data)
+				}
+			} else {
+				viewer.none(t)
+			}
+			sender.none(t)
+		})
+	}
+}
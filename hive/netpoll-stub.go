@@ -0,0 +1,32 @@
+//go:build !linux
+
+package hive
+
+import (
+	"context"
+	"errors"
+)
+
+// Netpoll Readiness notification for polled connections, linux only
+type Netpoll struct{}
+
+// NewNetpoll Not supported on this platform
+func NewNetpoll(ctx context.Context, workers int) (*Netpoll, error) {
+	return nil, errors.New("netpoll is supported on linux only")
+}
+
+func (poll *Netpoll) run(task func()) bool {
+	go task()
+	return true
+}
+
+func (poll *Netpoll) add(fd int, conn *PolledConnection) error {
+	return errors.New("netpoll is supported on linux only")
+}
+
+func (poll *Netpoll) rearm(fd int) error {
+	return nil
+}
+
+func (poll *Netpoll) remove(fd int) {
+}
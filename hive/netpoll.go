@@ -0,0 +1,172 @@
+//go:build linux
+
+package hive
+
+import (
+	"context"
+	"github.com/stepan-s/ws-bro/log"
+	"golang.org/x/sys/unix"
+	"sync"
+	"time"
+)
+
+// Netpoll Readiness notification for polled connections, connections have no own goroutines
+type Netpoll struct {
+	epfd  int
+	lock  sync.Mutex
+	conns map[int]*PolledConnection
+	tasks chan func()
+}
+
+// One notification per readiness, the connection is armed again after reading
+const netpollEvents = unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT
+
+// NewNetpoll Start epoll loop with workers for reading and writing connections until ctx is done
+func NewNetpoll(ctx context.Context, workers int) (*Netpoll, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	poll := &Netpoll{
+		epfd:  epfd,
+		conns: make(map[int]*PolledConnection),
+		tasks: make(chan func(), 10000),
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
+		go func() {
+			for {
+				select {
+				case task := <-poll.tasks:
+					task()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go poll.wait(ctx)
+	go poll.keepalive(ctx)
+	return poll, nil
+}
+
+// Wait timeout in milliseconds to notice ctx is done
+const netpollWaitTimeout = 1000
+
+// Wait timeout in milliseconds while reads are parked, workers are given time to free the queue
+const netpollRetryTimeout = 10
+
+func (poll *Netpoll) wait(ctx context.Context) {
+	events := make([]unix.EpollEvent, 1024)
+	ready := make([]*PolledConnection, 0, len(events))
+	var parked []*PolledConnection
+	for {
+		timeout := netpollWaitTimeout
+		if len(parked) > 0 {
+			timeout = netpollRetryTimeout
+		}
+		n, err := unix.EpollWait(poll.epfd, events, timeout)
+		if ctx.Err() != nil {
+			_ = unix.Close(poll.epfd)
+			return
+		}
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			log.Emergency("Netpoll wait error: %v", err)
+			return
+		}
+		ready = ready[:0]
+		poll.lock.Lock()
+		for i := 0; i < n; i++ {
+			conn, exists := poll.conns[int(events[i].Fd)]
+			if exists {
+				ready = append(ready, conn)
+			}
+		}
+		poll.lock.Unlock()
+		// workers may wait for the lock to remove connections
+		parked = poll.dispatch(parked, ready)
+	}
+}
+
+// Run reads of parked and ready connections, returns reads parked again.
+// A parked descriptor is not armed, it is not signaled until its read is run.
+func (poll *Netpoll) dispatch(parked []*PolledConnection, ready []*PolledConnection) []*PolledConnection {
+	// parked reads waited longer, they go first
+	kept := parked[:0]
+	for _, conn := range parked {
+		if !poll.run(conn.read) {
+			kept = append(kept, conn)
+		}
+	}
+	for _, conn := range ready {
+		if !poll.run(conn.read) {
+			kept = append(kept, conn)
+		}
+	}
+	return kept
+}
+
+// Ping connections, close silent ones
+func (poll *Netpoll) keepalive(ctx context.Context) {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		poll.lock.Lock()
+		conns := make([]*PolledConnection, 0, len(poll.conns))
+		for _, conn := range poll.conns {
+			conns = append(conns, conn)
+		}
+		poll.lock.Unlock()
+
+		for _, conn := range conns {
+			// dropped on overload, silent connections are closed on the next tick
+			poll.run(conn.ping)
+		}
+	}
+}
+
+// Run task on a worker, false if workers are overloaded and the task is dropped
+func (poll *Netpoll) run(task func()) bool {
+	select {
+	case poll.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+func (poll *Netpoll) add(fd int, conn *PolledConnection) error {
+	poll.lock.Lock()
+	defer poll.lock.Unlock()
+
+	err := unix.EpollCtl(poll.epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: netpollEvents, Fd: int32(fd)})
+	if err != nil {
+		return err
+	}
+	poll.conns[fd] = conn
+	return nil
+}
+
+// Wait for the next readiness
+func (poll *Netpoll) rearm(fd int) error {
+	return unix.EpollCtl(poll.epfd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Events: netpollEvents, Fd: int32(fd)})
+}
+
+// Forget connection, before its descriptor is closed
+func (poll *Netpoll) remove(fd int) {
+	poll.lock.Lock()
+	defer poll.lock.Unlock()
+
+	_ = unix.EpollCtl(poll.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+	delete(poll.conns, fd)
+}
@@ -0,0 +1,30 @@
+package hive
+
+// ConnectionOptions Connection settings of an endpoint
+type ConnectionOptions struct {
+	// Enable permessage-deflate if client supports it
+	Compression bool
+	// Deflate level, see compress/flate
+	CompressionLevel int
+	// Frames smaller than threshold in bytes are sent uncompressed
+	CompressionThreshold int
+	// Queued frames limit
+	SendBuffer int
+	// Queued frames limit for spill policy
+	SpillBuffer int
+	// Slow consumer policy, BACKPRESSURE_*
+	Backpressure uint8
+	// Incoming rate limits per uid or aid, nil - no limit
+	Limiter *RateLimiter
+	// Incoming rate limits per ip, nil - no limit
+	IpLimiter *RateLimiter
+	// Throttled messages in a row to disconnect, 0 - never
+	RateViolations int
+	// Incoming message size limit in bytes, 0 - no limit
+	MaxMessageSize int64
+	// Incoming json nesting limit, 0 - no limit
+	MaxJsonDepth int
+	// Policy for too big or complex messages, OVERSIZE_*
+	Oversize uint8
+	Stats    AConnectionStat
+}
@@ -0,0 +1,527 @@
+package hive
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gobwas/pool/pbufio"
+	"github.com/gobwas/pool/pbytes"
+	"github.com/gobwas/ws"
+	"github.com/google/uuid"
+	"github.com/stepan-s/ws-bro/log"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var errPeerClosed = errors.New("closed by peer")
+
+// PolledConnection A connection served by netpoll workers, it has no own goroutines
+// and holds read and write buffers only while there is something to read or write
+// or a frame is partially received.
+// Compression and prepared messages are not supported.
+type PolledConnection struct {
+	poll      *Netpoll
+	conn      net.Conn
+	fd        int
+	id        uint64
+	send      *sendQueue
+	onMessage func(message []byte, binary bool)
+	onRemove  func()
+	// unix time of the last frame from peer
+	seen    int64
+	lock    sync.Mutex
+	reading bool
+	writing bool
+	done    bool
+	// frames are written by the writer and control replies by the reader
+	writeLock sync.Mutex
+	connectionBase
+	// read by one worker at a time
+	input polledInput
+}
+
+// NewPolledUserConnection Serve user connection by netpoll, protocol is the negotiated subprotocol
+func NewPolledUserConnection(poll *Netpoll, handler AUserHandler, uid uint32, conn net.Conn, protocol string, options ConnectionOptions) (*PolledConnection, error) {
+	c, err := newPolledConnection(poll, conn, protocol, options, fmt.Sprintf("user:%d", uid))
+	if err != nil {
+		return nil, err
+	}
+	c.onMessage = func(message []byte, binary bool) {
+		handler.ConnectionMessage(uid, c, message, binary)
+	}
+	c.onRemove = func() {
+		handler.ConnectionRemove(uid, c)
+	}
+	handler.ConnectionAdd(uid, c)
+	return c, nil
+}
+
+// NewPolledAppConnection Serve app connection by netpoll, protocol is the negotiated subprotocol
+func NewPolledAppConnection(poll *Netpoll, handler AAppHandler, aid uuid.UUID, instance string, conn net.Conn, protocol string, options ConnectionOptions) (*PolledConnection, error) {
+	c, err := newPolledConnection(poll, conn, protocol, options, "app:"+aid.String())
+	if err != nil {
+		return nil, err
+	}
+	c.onMessage = func(message []byte, binary bool) {
+		handler.ConnectionMessage(aid, instance, message, binary)
+	}
+	c.onRemove = func() {
+		handler.ConnectionRemove(aid, instance, c)
+	}
+	handler.ConnectionAdd(aid, instance, c)
+	return c, nil
+}
+
+func newPolledConnection(poll *Netpoll, conn net.Conn, protocol string, options ConnectionOptions, name string) (*PolledConnection, error) {
+	fd, err := connFd(conn)
+	if err != nil {
+		return nil, err
+	}
+	c := &PolledConnection{
+		poll: poll,
+		conn: conn,
+		fd:   fd,
+		id:   nextConnectionId(),
+		send: newSendQueue(options),
+	}
+	c.connectionBase = connectionBase{
+		sender:  c,
+		codec:   CodecBySubprotocol(protocol),
+		options: options,
+		name:    name,
+	}
+	c.ip, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	return c, nil
+}
+
+// Descriptor of tcp connection under tls
+func connFd(conn net.Conn) (int, error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsNetConn(tlsConn)
+	}
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, errors.New("connection has no descriptor")
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	fd := 0
+	err = rawConn.Control(func(descriptor uintptr) {
+		fd = int(descriptor)
+	})
+	return fd, err
+}
+
+func (c *PolledConnection) Start() {
+	if c.send.isClosed() {
+		// rejected connection is not read, close already scheduled the writer
+		return
+	}
+	atomic.StoreInt64(&c.seen, time.Now().Unix())
+	err := c.poll.add(c.fd, c)
+	if err != nil {
+		log.Error("Netpoll add error: %v, %s", err, c.name)
+		if !c.poll.run(c.shutdown) {
+			go c.shutdown()
+		}
+		return
+	}
+	// frames queued before start
+	c.scheduleWrite()
+}
+
+// Read available data, called by a worker on readiness. A partial frame is kept
+// until the next readiness, the worker does not wait for the rest.
+func (c *PolledConnection) read() {
+	c.lock.Lock()
+	if c.reading || c.done {
+		c.lock.Unlock()
+		return
+	}
+	c.reading = true
+	c.lock.Unlock()
+
+	chunk := pbytes.GetLen(4096)
+	// readiness is signaled, data should be there, tls may wait for the rest of a record
+	deadline := time.Now().Add(netpollReadWait)
+	idle := false
+	var err error
+	for {
+		_ = c.conn.SetReadDeadline(deadline)
+		var n int
+		n, err = c.conn.Read(chunk)
+		if n > 0 {
+			atomic.StoreInt64(&c.seen, time.Now().Unix())
+			consumeErr := c.consume(chunk[:n])
+			if consumeErr != nil {
+				err = consumeErr
+				break
+			}
+		}
+		if err != nil {
+			netErr, ok := err.(net.Error)
+			idle = ok && netErr.Timeout()
+			break
+		}
+		// take the rest buffered by tls, the socket is polled again
+		deadline = time.Now()
+	}
+	pbytes.Put(chunk)
+
+	c.lock.Lock()
+	c.reading = false
+	done := c.done
+	c.lock.Unlock()
+
+	if idle && !done {
+		// nothing left to read
+		err = c.poll.rearm(c.fd)
+		if err == nil {
+			return
+		}
+	}
+	if err != io.EOF && err != errPeerClosed && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+		log.Error("Connection read error: %v, %s", err, c.name)
+	}
+	c.shutdown()
+}
+
+// Time a worker may wait for a tls record on readiness
+const netpollReadWait = 5 * time.Millisecond
+
+// Incoming frames state, kept between readiness events
+type polledInput struct {
+	// unparsed data, nil when there is none
+	buffer []byte
+	// fragments of the current message
+	message []byte
+	op      ws.OpCode
+	started bool
+	tooBig  bool
+	// payload of a too big frame left to discard
+	skip int64
+	// the discarded frame is the last of message
+	skipFin bool
+}
+
+// Parse complete frames, keep the rest for the next read
+func (c *PolledConnection) consume(data []byte) error {
+	input := &c.input
+	if len(input.buffer) > 0 {
+		input.buffer = append(input.buffer, data...)
+		data = input.buffer
+	}
+	rest, err := c.parseFrames(data)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(rest) == 0:
+		// idle connection holds no buffer
+		input.buffer = nil
+	case len(input.buffer) > 0:
+		input.buffer = input.buffer[:copy(input.buffer, rest)]
+	default:
+		input.buffer = append(make([]byte, 0, len(rest)), rest...)
+	}
+	return nil
+}
+
+// Handle complete frames of data, control frames are answered, the incomplete tail is returned
+func (c *PolledConnection) parseFrames(data []byte) ([]byte, error) {
+	input := &c.input
+	for {
+		if input.skip > 0 {
+			n := input.skip
+			if int64(len(data)) < n {
+				n = int64(len(data))
+			}
+			data = data[n:]
+			input.skip -= n
+			if input.skip > 0 {
+				return data, nil
+			}
+			if input.skipFin {
+				c.endMessage()
+			}
+			continue
+		}
+
+		header, size, err := parseFrameHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+
+		if header.OpCode.IsControl() {
+			if header.Length > ws.MaxControlFramePayloadSize || !header.Fin {
+				return nil, ws.ErrProtocolControlPayloadOverflow
+			}
+			if int64(len(data)-size) < header.Length {
+				return data, nil
+			}
+			payload := data[size : size+int(header.Length)]
+			data = data[size+int(header.Length):]
+			if header.Masked {
+				ws.Cipher(payload, header.Mask, 0)
+			}
+			switch header.OpCode {
+			case ws.OpPing:
+				err = c.writeControl(ws.NewPongFrame(payload))
+			case ws.OpClose:
+				_ = c.writeControl(ws.NewCloseFrame(payload))
+				return nil, errPeerClosed
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !input.started {
+			input.op = header.OpCode
+			input.started = true
+		}
+		total := int64(len(input.message)) + header.Length
+		if input.tooBig || (c.options.MaxMessageSize > 0 && total > c.options.MaxMessageSize) {
+			// skip the rest of message as it arrives
+			input.tooBig = true
+			input.message = nil
+			input.skip = header.Length
+			input.skipFin = header.Fin
+			data = data[size:]
+			if input.skip == 0 && input.skipFin {
+				c.endMessage()
+			}
+			continue
+		}
+		if int64(len(data)-size) < header.Length {
+			return data, nil
+		}
+		payload := data[size : size+int(header.Length)]
+		data = data[size+int(header.Length):]
+		if header.Masked {
+			ws.Cipher(payload, header.Mask, 0)
+		}
+		input.message = append(input.message, payload...)
+		if header.Fin {
+			c.endMessage()
+		}
+	}
+}
+
+// Handle assembled message and reset input for the next one
+func (c *PolledConnection) endMessage() {
+	input := &c.input
+	message, op, tooBig := input.message, input.op, input.tooBig
+	input.message = nil
+	input.op = 0
+	input.started = false
+	input.tooBig = false
+	input.skipFin = false
+	if tooBig {
+		c.reject("Message too big")
+		return
+	}
+	c.handle(op, message)
+}
+
+// Parse frame header, size is 0 if the header is incomplete
+func parseFrameHeader(data []byte) (ws.Header, int, error) {
+	var header ws.Header
+	if len(data) < 2 {
+		return header, 0, nil
+	}
+	header.Fin = data[0]&0x80 != 0
+	header.Rsv = (data[0] & 0x70) >> 4
+	header.OpCode = ws.OpCode(data[0] & 0x0f)
+	header.Masked = data[1]&0x80 != 0
+	size := 2
+	length := data[1] & 0x7f
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header.Masked {
+		size += 4
+	}
+	if len(data) < size {
+		return header, 0, nil
+	}
+	switch length {
+	case 126:
+		header.Length = int64(binary.BigEndian.Uint16(data[2:4]))
+	case 127:
+		if data[2]&0x80 != 0 {
+			return header, 0, ws.ErrHeaderLengthMSB
+		}
+		header.Length = int64(binary.BigEndian.Uint64(data[2:10]))
+	default:
+		header.Length = int64(length)
+	}
+	if header.Masked {
+		copy(header.Mask[:], data[size-4:size])
+	}
+	return header, size, nil
+}
+
+func (c *PolledConnection) handle(op ws.OpCode, message []byte) {
+	if op != ws.OpText && op != ws.OpBinary {
+		return
+	}
+	message, binary, ok := c.accept(message, op == ws.OpBinary)
+	if ok {
+		c.onMessage(message, binary)
+	}
+}
+
+// Run writer unless it is running already
+func (c *PolledConnection) scheduleWrite() {
+	c.lock.Lock()
+	start := !c.writing && !c.done
+	if start {
+		c.writing = true
+	}
+	c.lock.Unlock()
+	if start && !c.poll.run(c.write) {
+		// queued frames would never be written, the hive must not wait for workers
+		log.Warning("Netpoll overload, close connection: %s", c.name)
+		go c.shutdown()
+	}
+}
+
+// Write queued frames, called by a worker
+func (c *PolledConnection) write() {
+	for {
+		select {
+		case <-c.send.ready:
+		default:
+			c.lock.Lock()
+			if len(c.send.ready) == 0 {
+				// next push schedules writer again
+				c.writing = false
+				c.lock.Unlock()
+				return
+			}
+			c.lock.Unlock()
+			continue
+		}
+
+		frames, closed := c.send.pop()
+		err := c.writeFrames(frames, closed)
+		if err != nil {
+			log.Error("Send error: %v, %s", err, c.name)
+		}
+		if err != nil || closed {
+			c.shutdown()
+			return
+		}
+	}
+}
+
+func (c *PolledConnection) writeFrames(frames []Frame, closed bool) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	writer := pbufio.GetWriter(c.conn, 4096)
+	defer pbufio.PutWriter(writer)
+	for _, frame := range frames {
+		data, binary, ok := c.encode(frame)
+		if !ok {
+			// skip broken frame
+			continue
+		}
+		op := ws.OpText
+		if binary {
+			op = ws.OpBinary
+		}
+		_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+		err := ws.WriteFrame(writer, ws.NewFrame(op, true, data))
+		if err != nil {
+			return err
+		}
+	}
+	if closed {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+		err := ws.WriteFrame(writer, ws.NewCloseFrame(c.send.closeMessage()))
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func (c *PolledConnection) writeControl(frame ws.Frame) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	return ws.WriteFrame(c.conn, frame)
+}
+
+// Ping peer, close connection silent for too long, called by a worker
+func (c *PolledConnection) ping() {
+	if time.Now().Unix()-atomic.LoadInt64(&c.seen) > 70 {
+		c.shutdown()
+		return
+	}
+	err := c.writeControl(ws.NewPingFrame(nil))
+	if err != nil {
+		log.Error("Ping error: %v, %s", err, c.name)
+		c.shutdown()
+	}
+}
+
+// Stop polling, close and remove connection
+func (c *PolledConnection) shutdown() {
+	c.lock.Lock()
+	if c.done {
+		c.lock.Unlock()
+		return
+	}
+	c.done = true
+	c.lock.Unlock()
+
+	c.poll.remove(c.fd)
+	err := c.conn.Close()
+	if err != nil {
+		log.Error("Connection close error: %v", err)
+	}
+	c.onRemove()
+}
+
+func (c *PolledConnection) Send(message Frame) {
+	c.send.push(message)
+	c.scheduleWrite()
+}
+
+func (c *PolledConnection) Close() {
+	c.send.close()
+	c.scheduleWrite()
+}
+
+// CloseWithCode Close after queued frames with close code
+func (c *PolledConnection) CloseWithCode(code int, text string) {
+	c.send.closeWithCode(code, text)
+	c.scheduleWrite()
+}
+
+func (c *PolledConnection) Id() uint64 {
+	return c.id
+}
+
+func (c *PolledConnection) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
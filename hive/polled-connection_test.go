@@ -0,0 +1,301 @@
+//go:build linux
+
+package hive
+
+import (
+	"context"
+	"github.com/gobwas/ws"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testNetpoll(t testing.TB, workers int) *Netpoll {
+	ctx, stop := context.WithCancel(context.Background())
+	t.Cleanup(stop)
+	poll, err := NewNetpoll(ctx, workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return poll
+}
+
+// Tcp connection pair, the server side is returned second
+func testTcpPair(t testing.TB, listener net.Listener) (net.Conn, net.Conn) {
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func testListener(t testing.TB) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener
+}
+
+// Started polled user connection, client side is returned
+func testPolledConnection(t testing.TB, poll *Netpoll, listener net.Listener, options ConnectionOptions) (net.Conn, *testUserHandler) {
+	handler := &testUserHandler{make(chan string, 100)}
+	client, server := testTcpPair(t, listener)
+	c, err := NewPolledUserConnection(poll, handler, 10, server, "", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	return client, handler
+}
+
+// Masked frame as the client sends it
+func testClientFrame(t testing.TB, frame ws.Frame) []byte {
+	data, err := ws.CompileFrame(ws.MaskFrame(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testNextMessage(t *testing.T, handler *testUserHandler) string {
+	t.Helper()
+	select {
+	case message := <-handler.messages:
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return ""
+	}
+}
+
+func TestPolledFrames(t *testing.T) {
+	tests := []struct {
+		name     string
+		frames   []ws.Frame
+		chunk    int
+		options  ConnectionOptions
+		messages []string
+		replies  []ws.OpCode
+	}{
+		{
+			name:     "whole",
+			frames:   []ws.Frame{ws.NewTextFrame([]byte(`{"N":1}`))},
+			messages: []string{`{"N":1}`},
+		},
+		{
+			name:     "byte by byte",
+			frames:   []ws.Frame{ws.NewTextFrame([]byte(`{"N":1}`)), ws.NewTextFrame([]byte(`{"N":2}`))},
+			chunk:    1,
+			messages: []string{`{"N":1}`, `{"N":2}`},
+		},
+		{
+			name:     "long length",
+			frames:   []ws.Frame{ws.NewBinaryFrame([]byte(strings.Repeat("a", 70000)))},
+			chunk:    1000,
+			messages: []string{strings.Repeat("a", 70000)},
+		},
+		{
+			name: "fragments with ping",
+			frames: []ws.Frame{
+				ws.NewFrame(ws.OpText, false, []byte(`{"N":`)),
+				ws.NewPingFrame([]byte("ping")),
+				ws.NewFrame(ws.OpContinuation, true, []byte(`1}`)),
+			},
+			chunk:    3,
+			messages: []string{`{"N":1}`},
+			replies:  []ws.OpCode{ws.OpPong},
+		},
+		{
+			name: "too big is skipped",
+			frames: []ws.Frame{
+				ws.NewFrame(ws.OpText, false, []byte(`{"Text":"`)),
+				ws.NewFrame(ws.OpContinuation, true, []byte(`too big"}`)),
+				ws.NewTextFrame([]byte(`{"N":1}`)),
+			},
+			chunk:    5,
+			options:  ConnectionOptions{MaxMessageSize: 10},
+			messages: []string{`{"N":1}`},
+			replies:  []ws.OpCode{ws.OpText},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			poll := testNetpoll(t, 1)
+			client, handler := testPolledConnection(t, poll, testListener(t), test.options)
+			var data []byte
+			for _, frame := range test.frames {
+				data = append(data, testClientFrame(t, frame)...)
+			}
+			chunk := test.chunk
+			if chunk == 0 {
+				chunk = len(data)
+			}
+			for len(data) > 0 {
+				n := chunk
+				if n > len(data) {
+					n = len(data)
+				}
+				_, err := client.Write(data[:n])
+				if err != nil {
+					t.Fatal(err)
+				}
+				data = data[n:]
+				time.Sleep(time.Millisecond)
+			}
+
+			for _, want := range test.messages {
+				message := testNextMessage(t, handler)
+				if message != want {
+					t.Errorf("got message %.20s, want %.20s", message, want)
+				}
+			}
+			_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for _, op := range test.replies {
+				frame, err := ws.ReadFrame(client)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if frame.Header.OpCode != op {
+					t.Errorf("got reply %v, want %v", frame.Header.OpCode, op)
+				}
+			}
+		})
+	}
+}
+
+func TestPolledPartialFrameDoesNotHoldWorker(t *testing.T) {
+	poll := testNetpoll(t, 1)
+	listener := testListener(t)
+	slow, _ := testPolledConnection(t, poll, listener, ConnectionOptions{})
+	fast, handler := testPolledConnection(t, poll, listener, ConnectionOptions{})
+
+	// a header and a part of payload, the rest never comes
+	frame := testClientFrame(t, ws.NewTextFrame([]byte(`{"N":1}`)))
+	_, err := slow.Write(frame[:8])
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	started := time.Now()
+	_, err = fast.Write(testClientFrame(t, ws.NewTextFrame([]byte(`{"N":2}`))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := testNextMessage(t, handler)
+	if message != `{"N":2}` {
+		t.Errorf("got message %s", message)
+	}
+	if time.Since(started) > 500*time.Millisecond {
+		t.Errorf("message is delayed for %v", time.Since(started))
+	}
+}
+
+func TestNetpollOverload(t *testing.T) {
+	// no workers, the queue holds one task
+	poll := &Netpoll{tasks: make(chan func(), 1)}
+	if !poll.run(func() {}) {
+		t.Error("task is dropped")
+	}
+	done := make(chan bool)
+	go func() {
+		done <- poll.run(func() {})
+	}()
+	select {
+	case queued := <-done:
+		if queued {
+			t.Error("task is queued over the limit")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("run is blocked")
+	}
+}
+
+func TestNetpollParkOverloaded(t *testing.T) {
+	// no workers, the queue holds one task
+	poll := &Netpoll{tasks: make(chan func(), 1)}
+	poll.run(func() {})
+	conn := &PolledConnection{}
+	parked := poll.dispatch(nil, []*PolledConnection{conn})
+	if len(parked) != 1 || parked[0] != conn {
+		t.Fatalf("read is not parked, parked %d", len(parked))
+	}
+	// still overloaded, the read stays parked and is not run twice
+	parked = poll.dispatch(parked, nil)
+	if len(parked) != 1 {
+		t.Fatalf("parked %d", len(parked))
+	}
+
+	<-poll.tasks
+	parked = poll.dispatch(parked, nil)
+	if len(parked) != 0 {
+		t.Errorf("read is parked with room in the queue")
+	}
+	if len(poll.tasks) != 1 {
+		t.Errorf("parked read is not queued")
+	}
+}
+
+// Heap held by an idle polled connection, the client side and the socket are not counted
+func BenchmarkPolledIdleConnection(b *testing.B) {
+	count := 1000
+	listener := testListener(b)
+	handler := &testUserHandler{make(chan string, 100)}
+	var total int64
+	// the timer runs, waiting for workers keeps the iterations few
+	for n := 0; n < b.N; n++ {
+		ctx, stop := context.WithCancel(context.Background())
+		poll, err := NewNetpoll(ctx, 4)
+		if err != nil {
+			b.Fatal(err)
+		}
+		clients := make([]net.Conn, count)
+		servers := make([]net.Conn, count)
+		for i := range servers {
+			clients[i], servers[i] = testTcpPair(b, listener)
+		}
+		var before, after runtime.MemStats
+		testSettleHeap()
+		runtime.ReadMemStats(&before)
+
+		conns := make([]*PolledConnection, count)
+		for i, server := range servers {
+			conns[i], err = NewPolledUserConnection(poll, handler, 10, server, "", ConnectionOptions{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			conns[i].Start()
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		testSettleHeap()
+		runtime.ReadMemStats(&after)
+		total += int64(after.HeapAlloc) - int64(before.HeapAlloc)
+		for i, c := range conns {
+			c.shutdown()
+			_ = clients[i].Close()
+		}
+		stop()
+	}
+	b.ReportMetric(float64(total)/float64(b.N*count), "bytes/conn")
+}
+
+// Collect garbage including objects with finalizers
+func testSettleHeap() {
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
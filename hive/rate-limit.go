@@ -0,0 +1,158 @@
+package hive
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Idle buckets are full, so they can be forgotten
+const rateBucketIdle = 10 * time.Second
+
+// Token bucket refilled with rate per second, burst is a second of rate
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(rate float64, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+}
+
+// Balance is positive, big message is allowed on positive balance and paid later
+func (b *tokenBucket) ready(rate float64) bool {
+	return rate <= 0 || b.tokens > 0
+}
+
+func (b *tokenBucket) take(rate float64, amount float64) {
+	if rate > 0 {
+		b.tokens -= amount
+	}
+}
+
+type rateBuckets struct {
+	messages tokenBucket
+	bytes    tokenBucket
+}
+
+// RateLimiter Messages and bytes per second limits by key
+type RateLimiter struct {
+	messages float64
+	bytes    float64
+	lock     sync.Mutex
+	buckets  map[string]*rateBuckets
+}
+
+// NewRateLimiter Create limiter, zero rate - no limit, idle buckets are forgotten until ctx is done
+func NewRateLimiter(ctx context.Context, messages float64, bytes float64) *RateLimiter {
+	l := &RateLimiter{
+		messages: messages,
+		bytes:    bytes,
+		buckets:  make(map[string]*rateBuckets),
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.forgetIdle()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// Allow Take tokens for a message of size, false if limit exceeded
+func (l *RateLimiter) Allow(key string, size int) bool {
+	if l.unlimited() {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b := l.refill(key)
+	// throttled message costs nothing
+	if !b.messages.ready(l.messages) || !b.bytes.ready(l.bytes) {
+		return false
+	}
+	b.messages.take(l.messages, 1)
+	b.bytes.take(l.bytes, float64(size))
+	return true
+}
+
+func (l *RateLimiter) unlimited() bool {
+	return l == nil || (l.messages <= 0 && l.bytes <= 0)
+}
+
+// Buckets of key refilled by now, the lock is held
+func (l *RateLimiter) refill(key string) *rateBuckets {
+	now := time.Now()
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &rateBuckets{
+			messages: tokenBucket{l.messages, now},
+			bytes:    tokenBucket{l.bytes, now},
+		}
+		l.buckets[key] = b
+	}
+	b.messages.refill(l.messages, now)
+	b.bytes.refill(l.bytes, now)
+	return b
+}
+
+// Check key may send a message, nothing is taken
+func (l *RateLimiter) ready(key string) bool {
+	if l.unlimited() {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b := l.refill(key)
+	return b.messages.ready(l.messages) && b.bytes.ready(l.bytes)
+}
+
+// Take tokens for a message of size, after ready
+func (l *RateLimiter) take(key string, size int) {
+	if l.unlimited() {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b := l.refill(key)
+	b.messages.take(l.messages, 1)
+	b.bytes.take(l.bytes, float64(size))
+}
+
+// Check uid or aid limits and ip limits, tokens are taken only when both allow
+func allowBoth(limiter *RateLimiter, key string, ipLimiter *RateLimiter, ip string, size int) bool {
+	if !limiter.ready(key) || !ipLimiter.ready(ip) {
+		return false
+	}
+	limiter.take(key, size)
+	ipLimiter.take(ip, size)
+	return true
+}
+
+func (l *RateLimiter) forgetIdle() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	for key, b := range l.buckets {
+		if now.Sub(b.messages.last) > rateBucketIdle && now.Sub(b.bytes.last) > rateBucketIdle {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package hive
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	type call struct {
+		key   string
+		size  int
+		allow bool
+	}
+	tests := []struct {
+		name     string
+		messages float64
+		bytes    float64
+		calls    []call
+	}{
+		{"no limit", 0, 0, []call{{"a", 1000, true}, {"a", 1000, true}}},
+		// the last token is fractional after refill
+		{"messages", 2, 0, []call{{"a", 1, true}, {"a", 1, true}, {"a", 1, true}, {"a", 1, false}, {"b", 1, true}}},
+		{"bytes", 0, 10, []call{{"a", 8, true}, {"a", 8, true}, {"a", 1, false}}},
+		{"big message paid later", 0, 10, []call{{"a", 100, true}, {"a", 1, false}}},
+		// message token is kept when bytes are exhausted
+		{"bytes throttled", 2, 10, []call{{"a", 20, true}, {"a", 1, false}, {"a", 1, false}, {"b", 1, true}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, stop := context.WithCancel(context.Background())
+			defer stop()
+			l := NewRateLimiter(ctx, test.messages, test.bytes)
+			for i, item := range test.calls {
+				if allow := l.Allow(item.key, item.size); allow != item.allow {
+					t.Errorf("call %d allow %v, want %v", i, allow, item.allow)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterThrottledIsFree(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	l := NewRateLimiter(ctx, 1000, 10)
+	l.Allow("a", 20)
+	for i := 0; i < 100; i++ {
+		l.Allow("a", 1)
+	}
+	b := l.buckets["a"]
+	// only the first message is paid
+	if b.messages.tokens < 998 {
+		t.Errorf("message tokens %f", b.messages.tokens)
+	}
+
+	l = NewRateLimiter(ctx, 1, 1000)
+	l.Allow("a", 1)
+	l.Allow("a", 1)
+	for i := 0; i < 100; i++ {
+		l.Allow("a", 10)
+	}
+	b = l.buckets["a"]
+	if b.bytes.tokens < 997 {
+		t.Errorf("bytes tokens %f", b.bytes.tokens)
+	}
+}
+
+func TestAllowBoth(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages float64
+		ip       float64
+		// message tokens left in the bucket that allows
+		uidTokens float64
+		ipTokens  float64
+	}{
+		// the user is not charged for messages rejected by ip
+		{"ip throttled", 10, 1, 9, 0},
+		// the ip is not charged for messages rejected by uid
+		{"uid throttled", 1, 10, 0, 9},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, stop := context.WithCancel(context.Background())
+			defer stop()
+			limiter := NewRateLimiter(ctx, test.messages, 0)
+			ipLimiter := NewRateLimiter(ctx, test.ip, 0)
+			if !allowBoth(limiter, "user:10", ipLimiter, "127.0.0.1", 1) {
+				t.Fatal("first message is throttled")
+			}
+			for i := 0; i < 20; i++ {
+				allowBoth(limiter, "user:10", ipLimiter, "127.0.0.1", 1)
+			}
+			uidTokens := limiter.buckets["user:10"].messages.tokens
+			ipTokens := ipLimiter.buckets["127.0.0.1"].messages.tokens
+			// refill adds a little meanwhile, the throttled side is in debt of at most one message
+			if uidTokens < test.uidTokens-1 || uidTokens > test.uidTokens+0.5 || ipTokens < test.ipTokens-1 || ipTokens > test.ipTokens+0.5 {
+				t.Errorf("uid tokens %f, ip tokens %f", uidTokens, ipTokens)
+			}
+		})
+	}
+}
+
+func TestAllowBothUnlimited(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		if !allowBoth(nil, "user:10", nil, "127.0.0.1", 1000) {
+			t.Fatal("throttled without limiters")
+		}
+	}
+}
+
+func TestRateLimiterStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, stop := context.WithCancel(context.Background())
+	for i := 0; i < 100; i++ {
+		NewRateLimiter(ctx, 1, 1)
+	}
+	stop()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines %d, before %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
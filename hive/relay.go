@@ -0,0 +1,224 @@
+package hive
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/google/uuid"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// Relayed messages are decoded once into pooled structs, data is copied once and
+// is spliced into the outgoing message as is.
+
+// Raw json value, spliced as is
+type rawValue []byte
+
+func (value *rawValue) UnmarshalJSON(data []byte) error {
+	// data may be the decoder buffer, it is not valid after the call
+	*value = append((*value)[:0], data...)
+	return nil
+}
+
+// MessageUserIncoming in, any message from user
+type MessageUserIncoming struct {
+	Action   string
+	To       uuid.UUID
+	Instance string
+	Id       string
+	Uid      uint32
+	Role     string
+	List     []uuid.UUID
+	Data     rawValue
+}
+
+// MessageAppIncoming in, any message from app or from the apps hive
+type MessageAppIncoming struct {
+	Action string
+	Cid    uint64
+	Id     string
+	Key    string
+	Mirror bool
+	Data   rawValue
+}
+
+var userIncomingPool = sync.Pool{
+	New: func() interface{} {
+		return new(MessageUserIncoming)
+	},
+}
+
+var appIncomingPool = sync.Pool{
+	New: func() interface{} {
+		return new(MessageAppIncoming)
+	},
+}
+
+// MessageUserIncomingUnpack Decode user message, release it after use
+func MessageUserIncomingUnpack(rawMessage []byte) (*MessageUserIncoming, error) {
+	message := userIncomingPool.Get().(*MessageUserIncoming)
+	err := json.Unmarshal(rawMessage, message)
+	if err != nil {
+		MessageUserIncomingRelease(message)
+		return nil, err
+	} else {
+		return message, nil
+	}
+}
+
+// MessageUserIncomingRelease Return decoded message to the pool, backing arrays of Data and List
+// are reused, set them nil before release if they are still in use
+func MessageUserIncomingRelease(message *MessageUserIncoming) {
+	*message = MessageUserIncoming{Data: message.Data[:0], List: message.List[:0]}
+	userIncomingPool.Put(message)
+}
+
+// MessageAppIncomingUnpack Decode app message, release it after use
+func MessageAppIncomingUnpack(rawMessage []byte) (*MessageAppIncoming, error) {
+	message := appIncomingPool.Get().(*MessageAppIncoming)
+	err := json.Unmarshal(rawMessage, message)
+	if err != nil {
+		MessageAppIncomingRelease(message)
+		return nil, err
+	} else {
+		return message, nil
+	}
+}
+
+// MessageAppIncomingRelease Return decoded message to the pool, backing array of Data is reused,
+// set it nil before release if it is still in use
+func MessageAppIncomingRelease(message *MessageAppIncoming) {
+	*message = MessageAppIncoming{Data: message.Data[:0]}
+	appIncomingPool.Put(message)
+}
+
+// Pack MessageUserReceivedData, binary data goes after the header
+func packUserReceivedData(from uuid.UUID, instance string, id string, data []byte, binary bool) ([]byte, error) {
+	size := 128 + len(instance) + len(id) + len(data)
+	if binary {
+		frame := appendUserReceivedData(make([]byte, 2, 2+size), from, instance, id, nil)
+		return envelopeSeal(frame, data)
+	}
+	return appendUserReceivedData(make([]byte, 0, size), from, instance, id, data), nil
+}
+
+// Pack MessageAppReceivedData, binary data goes after the header
+func packAppReceivedData(from uint32, cid uint64, role string, id string, data []byte, binary bool) ([]byte, error) {
+	size := 128 + len(role) + len(id) + len(data)
+	if binary {
+		frame := appendAppReceivedData(make([]byte, 2, 2+size), from, cid, role, id, nil)
+		return envelopeSeal(frame, data)
+	}
+	return appendAppReceivedData(make([]byte, 0, size), from, cid, role, id, data), nil
+}
+
+// Same fields and order as MessageUserReceivedData
+func appendUserReceivedData(buf []byte, from uuid.UUID, instance string, id string, data []byte) []byte {
+	buf = append(buf, `{"Action":"`+ACTION_RECEIVED_DATA+`","From":"`...)
+	buf = appendUuid(buf, from)
+	buf = append(buf, '"')
+	if instance != "" {
+		buf = append(buf, `,"Instance":`...)
+		buf = appendJsonString(buf, instance)
+	}
+	if id != "" {
+		buf = append(buf, `,"Id":`...)
+		buf = appendJsonString(buf, id)
+	}
+	return appendData(buf, data)
+}
+
+// Same fields and order as MessageAppReceivedData
+func appendAppReceivedData(buf []byte, from uint32, cid uint64, role string, id string, data []byte) []byte {
+	buf = append(buf, `{"Action":"`+ACTION_RECEIVED_DATA+`","From":`...)
+	buf = strconv.AppendUint(buf, uint64(from), 10)
+	if cid != 0 {
+		buf = append(buf, `,"Cid":`...)
+		buf = strconv.AppendUint(buf, cid, 10)
+	}
+	buf = append(buf, `,"Role":`...)
+	buf = appendJsonString(buf, role)
+	if id != "" {
+		buf = append(buf, `,"Id":`...)
+		buf = appendJsonString(buf, id)
+	}
+	return appendData(buf, data)
+}
+
+// Data is the last field, absent data is null
+func appendData(buf []byte, data []byte) []byte {
+	buf = append(buf, `,"Data":`...)
+	if len(data) == 0 {
+		buf = append(buf, "null"...)
+	} else {
+		buf = append(buf, data...)
+	}
+	return append(buf, '}')
+}
+
+func appendUuid(buf []byte, id uuid.UUID) []byte {
+	var text [36]byte
+	hex.Encode(text[0:8], id[0:4])
+	text[8] = '-'
+	hex.Encode(text[9:13], id[4:6])
+	text[13] = '-'
+	hex.Encode(text[14:18], id[6:8])
+	text[18] = '-'
+	hex.Encode(text[19:23], id[8:10])
+	text[23] = '-'
+	hex.Encode(text[24:], id[10:])
+	return append(buf, text[:]...)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// Quote string for json, invalid utf-8 is replaced with U+FFFD
+func appendJsonString(buf []byte, value string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(value); {
+		c := value[i]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(value[i:])
+			if r == utf8.RuneError && size == 1 {
+				buf = append(buf, value[start:i]...)
+				buf = append(buf, `\ufffd`...)
+				i += size
+				start = i
+				continue
+			}
+			if r == '\u2028' || r == '\u2029' {
+				// line separators break javascript string literals
+				buf = append(buf, value[start:i]...)
+				buf = append(buf, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+				i += size
+				start = i
+				continue
+			}
+			i += size
+			continue
+		}
+		if c >= 0x20 && c != '"' && c != '\\' {
+			i++
+			continue
+		}
+		buf = append(buf, value[start:i]...)
+		switch c {
+		case '"', '\\':
+			buf = append(buf, '\\', c)
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		default:
+			buf = append(buf, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+		}
+		i++
+		start = i
+	}
+	buf = append(buf, value[start:]...)
+	return append(buf, '"')
+}
@@ -0,0 +1,143 @@
+package hive
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"strings"
+	"testing"
+)
+
+func TestAppendJsonString(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"plain", "abc", `"abc"`},
+		{"quotes", `a"b\c`, `"a\"b\\c"`},
+		{"controls", "a\nb\tc\x01", `"a\nb\tc\u0001"`},
+		{"unicode", "привет", `"привет"`},
+		{"invalid byte", "a\xffb", `"a\ufffdb"`},
+		{"truncated rune", "a\xd0", `"a\ufffd"`},
+		{"line separators", "a\u2028b\u2029", `"a\u2028b\u2029"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := appendJsonString(nil, test.value)
+			if string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+			if !json.Valid(got) {
+				t.Errorf("invalid json %s", got)
+			}
+		})
+	}
+}
+
+func TestRawValueCopy(t *testing.T) {
+	rawMessage := []byte(`{"Action":"sendData","Data":{"N":1}}`)
+	message, err := MessageUserIncomingUnpack(rawMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MessageUserIncomingRelease(message)
+	for i := range rawMessage {
+		rawMessage[i] = ' '
+	}
+	if string(message.Data) != `{"N":1}` {
+		t.Errorf("data %s is not a copy", message.Data)
+	}
+}
+
+func TestIncomingRelease(t *testing.T) {
+	user, err := MessageUserIncomingUnpack([]byte(`{"Action":"getConnected","Id":"1","List":["` + uuid.New().String() + `"],"Data":{"N":1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	MessageUserIncomingRelease(user)
+	if user.Action != "" || user.Id != "" || len(user.List) != 0 || cap(user.List) == 0 || len(user.Data) != 0 || cap(user.Data) == 0 {
+		t.Errorf("user message is not reset or buffers are dropped: %+v", user)
+	}
+
+	app, err := MessageAppIncomingUnpack([]byte(`{"Action":"sendData","Cid":1,"Key":"k","Data":{"N":1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	MessageAppIncomingRelease(app)
+	if app.Action != "" || app.Cid != 0 || app.Key != "" || len(app.Data) != 0 || cap(app.Data) == 0 {
+		t.Errorf("app message is not reset or buffer is dropped: %+v", app)
+	}
+}
+
+func BenchmarkUserIncomingUnpack(b *testing.B) {
+	rawMessage := []byte(`{"Action":"sendData","To":"` + uuid.New().String() + `","Id":"1","Data":{"N":1,"S":"text"}}`)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		message, err := MessageUserIncomingUnpack(rawMessage)
+		if err != nil {
+			b.Fatal(err)
+		}
+		MessageUserIncomingRelease(message)
+	}
+}
+
+func BenchmarkAppIncomingUnpack(b *testing.B) {
+	rawMessage := []byte(`{"Action":"sendData","Cid":1,"Id":"1","Data":{"N":1,"S":"text"}}`)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		message, err := MessageAppIncomingUnpack(rawMessage)
+		if err != nil {
+			b.Fatal(err)
+		}
+		MessageAppIncomingRelease(message)
+	}
+}
+
+// Data buffer of the pooled message is reused, big data costs no allocations
+func BenchmarkAppIncomingUnpackLarge(b *testing.B) {
+	rawMessage := []byte(`{"Action":"sendData","Cid":1,"Id":"1","Data":"` + strings.Repeat("x", 4096) + `"}`)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(rawMessage)))
+	for n := 0; n < b.N; n++ {
+		message, err := MessageAppIncomingUnpack(rawMessage)
+		if err != nil {
+			b.Fatal(err)
+		}
+		MessageAppIncomingRelease(message)
+	}
+}
+
+func BenchmarkPackUserReceivedData(b *testing.B) {
+	from := uuid.New()
+	data := []byte(`{"N":1,"S":"text"}`)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		_, err := packUserReceivedData(from, "main", "1", data, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPackAppReceivedData(b *testing.B) {
+	data := []byte(`{"N":1,"S":"text"}`)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		_, err := packAppReceivedData(10, 1, "operator", "1", data, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Same message with encoding/json, for comparison
+func BenchmarkMarshalAppReceivedData(b *testing.B) {
+	data := json.RawMessage(`{"N":1,"S":"text"}`)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		_, err := json.Marshal(&MessageAppReceivedData{Action: ACTION_RECEIVED_DATA, From: 10, Cid: 1, Role: "operator", Id: "1", Data: data})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package hive
+
+const ROLE_VIEWER = 1
+const ROLE_OPERATOR = 2
+const ROLE_OWNER = 3
+
+var roleNames = map[uint8]string{
+	ROLE_VIEWER:   "viewer",
+	ROLE_OPERATOR: "operator",
+	ROLE_OWNER:    "owner",
+}
+
+// RoleParse Get role by name
+func RoleParse(name string) (uint8, bool) {
+	for role, roleName := range roleNames {
+		if roleName == name {
+			return role, true
+		}
+	}
+	return 0, false
+}
+
+// RoleName Get role name
+func RoleName(role uint8) string {
+	return roleNames[role]
+}
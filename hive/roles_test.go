@@ -0,0 +1,103 @@
+package hive
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+	"testing"
+)
+
+func TestRoleParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		role  uint8
+		valid bool
+	}{
+		{"viewer", ROLE_VIEWER, true},
+		{"operator", ROLE_OPERATOR, true},
+		{"owner", ROLE_OWNER, true},
+		{"admin", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			role, valid := RoleParse(test.name)
+			if role != test.role || valid != test.valid {
+				t.Errorf("got %d %v, want %d %v", role, valid, test.role, test.valid)
+			}
+			if valid && RoleName(role) != test.name {
+				t.Errorf("name %s", RoleName(role))
+			}
+		})
+	}
+}
+
+func TestRoleSendData(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    uint8
+		allowed bool
+	}{
+		{"viewer", ROLE_VIEWER, false},
+		{"operator", ROLE_OPERATOR, true},
+		{"owner", ROLE_OWNER, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, 2)
+			aid := uuid.New()
+			app := testApp(t, apps, aid, "")
+			user := testUser(t, users, 10)
+			apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10}, Roles: map[uint32]uint8{10: test.role}})
+			user.nextAction(t, ACTION_CONNECTED)
+
+			users.ConnectionMessage(10, user, []byte(fmt.Sprintf(`{"Action":"sendData","To":"%s","Data":{"N":1}}`, aid)), false)
+			if test.allowed {
+				frame := app.nextAction(t, ACTION_RECEIVED_DATA)
+				if !strings.Contains(string(frame.Data), `"Role":"`+test.name+`"`) {
+					t.Errorf("app got %s", frame.Data)
+				}
+				user.none(t)
+			} else {
+				frame := user.nextAction(t, ACTION_ERROR)
+				if !strings.Contains(string(frame.Data), "Sending is not allowed") {
+					t.Errorf("user got %s", frame.Data)
+				}
+				app.none(t)
+			}
+		})
+	}
+}
+
+func TestRoleShare(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    uint8
+		allowed bool
+	}{
+		{"viewer", ROLE_VIEWER, false},
+		{"operator", ROLE_OPERATOR, false},
+		{"owner", ROLE_OWNER, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, 2)
+			aid := uuid.New()
+			testApp(t, apps, aid, "")
+			user := testUser(t, users, 10)
+			guest := testUser(t, users, 11)
+			apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10}, Roles: map[uint32]uint8{10: test.role}})
+			user.nextAction(t, ACTION_CONNECTED)
+
+			users.ConnectionMessage(10, user, []byte(fmt.Sprintf(`{"Action":"share","To":"%s","Uid":11,"Role":"viewer"}`, aid)), false)
+			if test.allowed {
+				guest.nextAction(t, ACTION_ATTACHED)
+				testUids(t, apps, aid, []uint32{10, 11})
+			} else {
+				user.nextAction(t, ACTION_ERROR)
+				guest.none(t)
+				testUids(t, apps, aid, []uint32{10})
+			}
+		})
+	}
+}
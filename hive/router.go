@@ -1,7 +1,10 @@
 package hive
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/stepan-s/ws-bro/log"
 )
 
@@ -13,83 +16,253 @@ type AppPayload struct {
 	Transmitter uint32
 }
 
-func RouterStart(users *Users, apps *Apps) {
+// RouterStart Route messages between hives until ctx is done
+func RouterStart(ctx context.Context, users *Users, apps *Apps) {
+	// a router per shard keeps messages of a user or an app in order
+	for _, shard := range users.shards {
+		go routeUserEvents(ctx, shard.chanOut, apps)
+	}
+	for _, shard := range apps.shards {
+		go routeAppEvents(ctx, shard.chanOut, users, apps)
+	}
+
 	go func() {
 		for {
-			event := users.ReceiveEvent()
-			action, err := MessageRawGetAction(event.RawMessage)
-			if err != nil {
-				log.Error("Fail get message action: %v, user:%d message:%s", err, event.Uid, event.RawMessage)
-			} else {
-				switch action {
-				case ACTION_SEND_DATA:
-					incomingMessage, err := MessageUserSendDataUnpack(event.RawMessage)
-					if err != nil {
-						log.Error("Fail unpack: %v, user:%d, message: %s", err, event.Uid, event.RawMessage)
-					} else {
-						outgoingMessage, err := MessageAppReceivedDataPack(&MessageAppReceivedData{
-							Action: ACTION_RECEIVED_DATA,
-							From:   event.Uid,
-							Data:   incomingMessage.Data,
-						})
-						if err != nil {
-							log.Error("Fail pack: %v, user:%d, message: %s", err, event.Uid, event.RawMessage)
-						} else {
-							apps.SendEvent(AppMessageToEvent{incomingMessage.To, event.Uid, outgoingMessage})
-						}
-					}
-				case ACTION_GET_CONNECTED:
-					incomingMessage, err := MessageUserGetConnectedUnpack(event.RawMessage)
-					if err != nil {
-						log.Error("Fail unpack: %v, user:%d, message: %s", err, event.Uid, event.RawMessage)
-					} else {
-						apps.getConnected(appConnectedEvent{
-							uid:  event.Uid,
-							aids: incomingMessage.List,
-						})
-					}
-				default:
-					log.Error("Invalid message action: %s, user:%d, message: %s", action, event.Uid, event.RawMessage)
+			select {
+			case uid := <-users.chanGone:
+				// user leases end with the last connection in the cluster
+				if apps.remote != nil {
+					apps.remote.UserGone(uid)
+				} else {
+					apps.userDisconnected(uid)
 				}
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
+}
 
-	go func() {
-		for {
-			event := apps.ReceiveEvent()
-			action, err := MessageRawGetAction(event.RawMessage)
-			if err != nil {
-				log.Error("Fail get message action: %v, app:%d message:%s", err, event.Aid, event.RawMessage)
-			} else {
-				switch action {
-				case ACTION_SEND_DATA:
-					incomingMessage, err := MessageAppSendDataUnpack(event.RawMessage)
-					if err != nil {
-						log.Error("Fail unpack: %v, app:%d, message: %s", err, event.Aid, event.RawMessage)
-					} else {
-						outgoingMessage, err := MessageUserReceivedDataPack(&MessageUserReceivedData{
-							Action: ACTION_RECEIVED_DATA,
-							From:   event.Aid,
-							Data:   incomingMessage.Data,
-						})
-						if err != nil {
-							log.Error("Fail pack: %v, app:%d, message: %s", err, event.Aid, event.RawMessage)
-						} else {
-							// send to all users connected to the app
-							for _, item := range event.Uids {
-								users.SendEvent(UserMessageEvent{item, outgoingMessage})
-							}
-						}
-					}
-				case ACTION_CONNECTED, ACTION_DISCONNECTED, ACTION_ATTACHED, ACTION_DETACHED:
-					for _, item := range event.Uids {
-						users.SendEvent(UserMessageEvent{item, event.RawMessage})
-					}
-				default:
-					log.Error("Invalid message action: %s, app:%d, message: %s", action, event.Aid, event.RawMessage)
-				}
+// Route messages from users
+func routeUserEvents(ctx context.Context, chanOut chan UserMessageEvent, apps *Apps) {
+	for {
+		var event UserMessageEvent
+		select {
+		case event = <-chanOut:
+		case <-ctx.Done():
+			return
+		}
+		if event.Binary {
+			routeUserBinary(apps, event)
+			continue
+		}
+		incomingMessage, err := MessageUserIncomingUnpack(event.RawMessage)
+		if err != nil {
+			log.Error("Fail unpack: %v, user:%d, message: %s", err, event.Uid, event.RawMessage)
+			continue
+		}
+		routeUserMessage(apps, event, incomingMessage)
+		MessageUserIncomingRelease(incomingMessage)
+	}
+}
+
+func routeUserMessage(apps *Apps, event UserMessageEvent, incomingMessage *MessageUserIncoming) {
+	switch incomingMessage.Action {
+	case ACTION_SEND_DATA:
+		// packed by the apps hive, it knows the user role
+		apps.SendEvent(AppMessageToEvent{
+			Aid:      incomingMessage.To,
+			Uid:      event.Uid,
+			Data:     json.RawMessage(incomingMessage.Data),
+			Id:       incomingMessage.Id,
+			Source:   event.Source,
+			Instance: incomingMessage.Instance,
+		})
+		// data is owned by the apps hive now, it is not reused by the pool
+		incomingMessage.Data = nil
+	case ACTION_GET_CONNECTED:
+		apps.getConnected(appConnectedEvent{
+			uid:  event.Uid,
+			aids: incomingMessage.List,
+		})
+		incomingMessage.List = nil
+	case ACTION_SHARE, ACTION_UNSHARE:
+		var cmd uint8 = REMOVE
+		var role uint8 = 0
+		if incomingMessage.Action == ACTION_SHARE {
+			cmd = ADD
+			var valid bool
+			role, valid = RoleParse(incomingMessage.Role)
+			if !valid {
+				log.Error("Invalid role: %s, user:%d, message: %s", incomingMessage.Role, event.Uid, event.RawMessage)
+				return
 			}
 		}
-	}()
+		apps.shareApp(appShareEvent{
+			cmd:    cmd,
+			uid:    event.Uid,
+			aid:    incomingMessage.To,
+			target: incomingMessage.Uid,
+			role:   role,
+		})
+	case ACTION_ACQUIRE_CONTROL, ACTION_RELEASE_CONTROL:
+		var cmd uint8 = REMOVE
+		if incomingMessage.Action == ACTION_ACQUIRE_CONTROL {
+			cmd = ADD
+		}
+		apps.control(appControlEvent{
+			cmd: cmd,
+			aid: incomingMessage.To,
+			uid: event.Uid,
+		})
+	default:
+		log.Error("Invalid message action: %s, user:%d, message: %s", incomingMessage.Action, event.Uid, event.RawMessage)
+	}
+}
+
+// Route messages from apps
+func routeAppEvents(ctx context.Context, chanOut chan AppMessageFromEvent, users *Users, apps *Apps) {
+	for {
+		var event AppMessageFromEvent
+		select {
+		case event = <-chanOut:
+		case <-ctx.Done():
+			return
+		}
+		if event.Binary {
+			routeAppBinary(users, apps, event)
+			continue
+		}
+		incomingMessage, err := MessageAppIncomingUnpack(event.RawMessage)
+		if err != nil {
+			log.Error("Fail unpack: %v, app:%v, message: %s", err, event.Aid, event.RawMessage)
+			continue
+		}
+		routeAppMessage(users, apps, event, incomingMessage)
+		MessageAppIncomingRelease(incomingMessage)
+	}
+}
+
+func routeAppMessage(users *Users, apps *Apps, event AppMessageFromEvent, incomingMessage *MessageAppIncoming) {
+	switch incomingMessage.Action {
+	case ACTION_SEND_DATA:
+		// data is spliced, not encoded again
+		outgoingMessage, err := packUserReceivedData(event.Aid, event.Instance, incomingMessage.Id, incomingMessage.Data, false)
+		if err != nil {
+			log.Error("Fail pack: %v, app:%v, message: %s", err, event.Aid, event.RawMessage)
+			return
+		}
+		apps.exportData(ExportAppSubject(event.Aid, "data"), outgoingMessage, false)
+		key := conflationKey(event.Aid, incomingMessage.Key)
+		prepared := prepareFanout(outgoingMessage, false, event.Uids)
+		// send to all users connected to the app
+		for _, item := range event.Uids {
+			users.SendEvent(UserMessageEvent{item, outgoingMessage, nil, false, key, incomingMessage.Cid, prepared, 0})
+		}
+	case ACTION_CONNECTED, ACTION_DISCONNECTED, ACTION_ATTACHED, ACTION_DETACHED:
+		routeNotice(users, event)
+	case ACTION_ERROR, ACTION_CONTROL_CHANGED, ACTION_SENT_DATA:
+		if !event.Notice {
+			log.Error("Forbidden message action: %s, app:%v, message: %s", incomingMessage.Action, event.Aid, event.RawMessage)
+			return
+		}
+		routeNotice(users, event)
+	case ACTION_SET_OPTIONS:
+		apps.setOptions(appOptionsEvent{
+			aid:    event.Aid,
+			mirror: incomingMessage.Mirror,
+		})
+	default:
+		log.Error("Invalid message action: %s, app:%v, message: %s", incomingMessage.Action, event.Aid, event.RawMessage)
+	}
+}
+
+// Route binary frame from user, only data is supported
+func routeUserBinary(apps *Apps, event UserMessageEvent) {
+	header, payload, err := EnvelopeUnpack(event.RawMessage)
+	if err != nil {
+		log.Error("Fail unpack envelope: %v, user:%d", err, event.Uid)
+		return
+	}
+	incomingMessage, err := MessageUserIncomingUnpack(header)
+	if err != nil {
+		log.Error("Fail unpack: %v, user:%d, header: %s", err, event.Uid, header)
+		return
+	}
+	defer MessageUserIncomingRelease(incomingMessage)
+	if incomingMessage.Action != ACTION_SEND_DATA {
+		log.Error("Invalid binary message action: %s, user:%d, header: %s", incomingMessage.Action, event.Uid, header)
+		return
+	}
+	apps.SendEvent(AppMessageToEvent{
+		Aid:      incomingMessage.To,
+		Uid:      event.Uid,
+		Data:     payload,
+		Id:       incomingMessage.Id,
+		Source:   event.Source,
+		Binary:   true,
+		Instance: incomingMessage.Instance,
+	})
+}
+
+// Route binary frame from app, data from app or data echo from the hive
+func routeAppBinary(users *Users, apps *Apps, event AppMessageFromEvent) {
+	header, payload, err := EnvelopeUnpack(event.RawMessage)
+	if err != nil {
+		log.Error("Fail unpack envelope: %v, app:%v", err, event.Aid)
+		return
+	}
+	incomingMessage, err := MessageAppIncomingUnpack(header)
+	if err != nil {
+		log.Error("Fail unpack: %v, app:%v, header: %s", err, event.Aid, header)
+		return
+	}
+	defer MessageAppIncomingRelease(incomingMessage)
+	switch incomingMessage.Action {
+	case ACTION_SEND_DATA:
+		outgoingMessage, err := packUserReceivedData(event.Aid, event.Instance, incomingMessage.Id, payload, true)
+		if err != nil {
+			log.Error("Fail pack: %v, app:%v, header: %s", err, event.Aid, header)
+			return
+		}
+		apps.exportData(ExportAppSubject(event.Aid, "data"), outgoingMessage, true)
+		key := conflationKey(event.Aid, incomingMessage.Key)
+		prepared := prepareFanout(outgoingMessage, true, event.Uids)
+		// send to all users connected to the app
+		for _, item := range event.Uids {
+			users.SendEvent(UserMessageEvent{item, outgoingMessage, nil, true, key, incomingMessage.Cid, prepared, 0})
+		}
+	case ACTION_SENT_DATA:
+		if !event.Notice {
+			log.Error("Forbidden binary message action: %s, app:%v, header: %s", incomingMessage.Action, event.Aid, header)
+			return
+		}
+		routeNotice(users, event)
+	default:
+		log.Error("Invalid binary message action: %s, app:%v, header: %s", incomingMessage.Action, event.Aid, header)
+	}
+}
+
+// Send message as is to the users of event
+func routeNotice(users *Users, event AppMessageFromEvent) {
+	prepared := prepareFanout(event.RawMessage, event.Binary, event.Uids)
+	for _, item := range event.Uids {
+		users.SendEvent(UserMessageEvent{item, event.RawMessage, event.Source, event.Binary, "", 0, prepared, event.SkipCid})
+	}
+}
+
+// Frame message once if it goes to many users
+func prepareFanout(rawMessage []byte, binary bool, uids []uint32) *websocket.PreparedMessage {
+	if len(uids) < 2 {
+		return nil
+	}
+	return prepareFrame(Frame{Binary: binary, Data: rawMessage}).Prepared
+}
+
+// Conflation key is scoped by the app, so apps can not replace each other messages
+func conflationKey(aid uuid.UUID, key string) string {
+	if key == "" {
+		return ""
+	}
+	return aid.String() + ":" + key
 }
@@ -0,0 +1,96 @@
+package hive
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"testing"
+)
+
+func TestRouteAppNotices(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		binary  bool
+		action  string
+	}{
+		{"data", `{"Action":"sendData","Data":{"N":1}}`, false, ACTION_RECEIVED_DATA},
+		{"binary data", `{"Action":"sendData"}`, true, ACTION_RECEIVED_DATA},
+		{"forged error", `{"Action":"error","Error":"forged"}`, false, ""},
+		{"forged control changed", `{"Action":"controlChanged","Uid":1}`, false, ""},
+		{"forged sent data", `{"Action":"sentData","Data":{"N":1}}`, false, ""},
+		{"forged binary sent data", `{"Action":"sentData"}`, true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, 2)
+			aid := uuid.New()
+			testApp(t, apps, aid, "")
+			user := testUser(t, users, 10)
+			apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10}})
+			user.nextAction(t, ACTION_CONNECTED)
+
+			message := []byte(test.message)
+			if test.binary {
+				frame, err := EnvelopePack(message, []byte{0, 1, 2})
+				if err != nil {
+					t.Fatal(err)
+				}
+				message = frame
+			}
+			apps.ConnectionMessage(aid, "", message, test.binary)
+			if test.action == "" {
+				user.none(t)
+				return
+			}
+			frame := user.nextAction(t, test.action)
+			if frame.Binary != test.binary {
+				t.Errorf("binary %v, want %v", frame.Binary, test.binary)
+			}
+		})
+	}
+}
+
+func TestRouteControlNotice(t *testing.T) {
+	users, apps := testHives(t, 2)
+	aid := uuid.New()
+	testApp(t, apps, aid, "")
+	user := testUser(t, users, 10)
+	apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10}, Roles: map[uint32]uint8{10: ROLE_OPERATOR}})
+	user.nextAction(t, ACTION_CONNECTED)
+
+	// notices generated by the hive still reach users
+	users.ConnectionMessage(10, user, []byte(fmt.Sprintf(`{"Action":"acquireControl","To":"%s"}`, aid)), false)
+	user.nextAction(t, ACTION_CONTROL_CHANGED)
+}
+
+func TestRouteConflationKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		key     string
+	}{
+		{"no key", `{"Action":"sendData","Data":1}`, ""},
+		{"key", `{"Action":"sendData","Key":"state","Data":1}`, ":state"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, 2)
+			aid := uuid.New()
+			testApp(t, apps, aid, "")
+			user := testUser(t, users, 10)
+			apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{10}})
+			user.nextAction(t, ACTION_CONNECTED)
+
+			apps.ConnectionMessage(aid, "", []byte(test.message), false)
+			frame := user.nextAction(t, ACTION_RECEIVED_DATA)
+			// keys of different apps never collide
+			want := test.key
+			if want != "" {
+				want = aid.String() + want
+			}
+			if frame.Key != want {
+				t.Errorf("key %q, want %q", frame.Key, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package hive
+
+import (
+	"github.com/gorilla/websocket"
+	"sync"
+)
+
+const BACKPRESSURE_DROP_NEWEST = 1
+const BACKPRESSURE_DROP_OLDEST = 2
+const BACKPRESSURE_DISCONNECT = 3
+const BACKPRESSURE_SPILL = 4
+
+var backpressureNames = map[uint8]string{
+	BACKPRESSURE_DROP_NEWEST: "drop-newest",
+	BACKPRESSURE_DROP_OLDEST: "drop-oldest",
+	BACKPRESSURE_DISCONNECT:  "disconnect",
+	BACKPRESSURE_SPILL:       "spill",
+}
+
+// BackpressureParse Get slow consumer policy by name
+func BackpressureParse(name string) (uint8, bool) {
+	for policy, policyName := range backpressureNames {
+		if policyName == name {
+			return policy, true
+		}
+	}
+	return 0, false
+}
+
+// Outgoing frames of a connection, drained by the connection writer
+type sendQueue struct {
+	lock      sync.Mutex
+	frames    []Frame
+	size      int
+	spillSize int
+	policy    uint8
+	stats     AConnectionStat
+	// signaled when frames are queued or queue is closed
+	ready     chan struct{}
+	closed    bool
+	closeCode int
+	closeText string
+}
+
+func newSendQueue(options ConnectionOptions) *sendQueue {
+	q := &sendQueue{
+		size:      options.SendBuffer,
+		spillSize: options.SpillBuffer,
+		policy:    options.Backpressure,
+		stats:     options.Stats,
+		ready:     make(chan struct{}, 1),
+	}
+	if q.size <= 0 {
+		q.size = 10
+	}
+	if q.spillSize < q.size {
+		q.spillSize = q.size
+	}
+	return q
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Queue frame, apply policy on overflow
+func (q *sendQueue) push(frame Frame) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	if frame.Key != "" && q.conflate(frame) {
+		return
+	}
+
+	limit := q.size
+	if q.policy == BACKPRESSURE_SPILL {
+		limit = q.spillSize
+	}
+	if len(q.frames) >= limit {
+		switch q.policy {
+		case BACKPRESSURE_DROP_OLDEST:
+			q.frames = q.frames[1:]
+			q.dropped()
+		case BACKPRESSURE_DISCONNECT:
+			q.dropped()
+			q.frames = nil
+			q.closeWith(websocket.CloseTryAgainLater, "slow consumer")
+			if q.stats != nil {
+				q.stats.SlowDisconnected()
+			}
+			return
+		default:
+			q.dropped()
+			return
+		}
+	}
+
+	q.frames = append(q.frames, frame)
+	q.signal()
+}
+
+// Replace queued frame with the same key, true if replaced
+func (q *sendQueue) conflate(frame Frame) bool {
+	for i := len(q.frames) - 1; i >= 0; i-- {
+		if q.frames[i].Key == frame.Key {
+			q.frames[i] = frame
+			if q.stats != nil {
+				q.stats.Conflated()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (q *sendQueue) dropped() {
+	if q.stats != nil {
+		q.stats.Dropped()
+	}
+}
+
+// Stop accepting frames, queued ones are still written
+func (q *sendQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		q.signal()
+	}
+}
+
+// Stop accepting frames and close with code after queued ones
+func (q *sendQueue) closeWithCode(code int, text string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.closed {
+		q.closeWith(code, text)
+	}
+}
+
+func (q *sendQueue) closeWith(code int, text string) {
+	q.closed = true
+	q.closeCode = code
+	q.closeText = text
+	q.signal()
+}
+
+// Closed queue takes no frames
+func (q *sendQueue) isClosed() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.closed
+}
+
+// Take queued frames, true if writer should close connection after them
+func (q *sendQueue) pop() ([]Frame, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	frames := q.frames
+	q.frames = nil
+	return frames, q.closed
+}
+
+// Close frame payload
+func (q *sendQueue) closeMessage() []byte {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closeCode == 0 {
+		return []byte{}
+	}
+	return websocket.FormatCloseMessage(q.closeCode, q.closeText)
+}
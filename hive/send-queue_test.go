@@ -0,0 +1,138 @@
+package hive
+
+import (
+	"github.com/gorilla/websocket"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// Connection counters
+type testStat struct {
+	dropped          int64
+	slowDisconnected int64
+	conflated        int64
+	throttled        int64
+	abuse            int64
+	rejected         int64
+}
+
+func (s *testStat) Compressed(original int, compressed int) {}
+func (s *testStat) Dropped()                                { atomic.AddInt64(&s.dropped, 1) }
+func (s *testStat) SlowDisconnected()                       { atomic.AddInt64(&s.slowDisconnected, 1) }
+func (s *testStat) Conflated()                              { atomic.AddInt64(&s.conflated, 1) }
+func (s *testStat) Throttled()                              { atomic.AddInt64(&s.throttled, 1) }
+func (s *testStat) AbuseDisconnected()                      { atomic.AddInt64(&s.abuse, 1) }
+func (s *testStat) Rejected()                               { atomic.AddInt64(&s.rejected, 1) }
+
+// Data of queued frames
+func testQueued(q *sendQueue) []string {
+	frames, _ := q.pop()
+	data := []string{}
+	for _, frame := range frames {
+		data = append(data, string(frame.Data))
+	}
+	return data
+}
+
+func TestSendQueueBackpressure(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    uint8
+		spill     int
+		pushed    int
+		queued    []string
+		dropped   int64
+		closeCode int
+	}{
+		{"fits", BACKPRESSURE_DROP_NEWEST, 0, 3, []string{"0", "1", "2"}, 0, 0},
+		{"drop newest", BACKPRESSURE_DROP_NEWEST, 0, 5, []string{"0", "1", "2"}, 2, 0},
+		{"drop oldest", BACKPRESSURE_DROP_OLDEST, 0, 5, []string{"2", "3", "4"}, 2, 0},
+		{"disconnect", BACKPRESSURE_DISCONNECT, 0, 5, []string{}, 1, websocket.CloseTryAgainLater},
+		{"spill", BACKPRESSURE_SPILL, 4, 5, []string{"0", "1", "2", "3"}, 1, 0},
+		{"spill smaller than buffer", BACKPRESSURE_SPILL, 1, 5, []string{"0", "1", "2"}, 2, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stat := &testStat{}
+			q := newSendQueue(ConnectionOptions{SendBuffer: 3, SpillBuffer: test.spill, Backpressure: test.policy, Stats: stat})
+			for i := 0; i < test.pushed; i++ {
+				q.push(Frame{Data: []byte(strconv.Itoa(i))})
+			}
+			if queued := testQueued(q); !reflect.DeepEqual(queued, test.queued) {
+				t.Errorf("queued %v, want %v", queued, test.queued)
+			}
+			if stat.dropped != test.dropped {
+				t.Errorf("dropped %d, want %d", stat.dropped, test.dropped)
+			}
+			if q.closeCode != test.closeCode {
+				t.Errorf("close code %d, want %d", q.closeCode, test.closeCode)
+			}
+			if test.closeCode != 0 && stat.slowDisconnected != 1 {
+				t.Errorf("slow disconnects %d", stat.slowDisconnected)
+			}
+		})
+	}
+}
+
+func TestBackpressureParse(t *testing.T) {
+	for policy, name := range backpressureNames {
+		if parsed, ok := BackpressureParse(name); !ok || parsed != policy {
+			t.Errorf("%s parsed %d %v", name, parsed, ok)
+		}
+	}
+	if _, ok := BackpressureParse("block"); ok {
+		t.Error("unknown policy parsed")
+	}
+}
+
+func TestSendQueueClosed(t *testing.T) {
+	q := newSendQueue(ConnectionOptions{})
+	q.push(Frame{Data: []byte("a")})
+	q.closeWithCode(websocket.CloseMessageTooBig, "too big")
+	q.push(Frame{Data: []byte("b")})
+
+	// queued frames are still written before close
+	frames, closed := q.pop()
+	if len(frames) != 1 || !closed {
+		t.Fatalf("frames %d, closed %v", len(frames), closed)
+	}
+	if string(q.closeMessage()) != string(websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "too big")) {
+		t.Errorf("close message %q", q.closeMessage())
+	}
+}
+func TestSendQueueConflation(t *testing.T) {
+	type push struct {
+		key  string
+		data string
+	}
+	tests := []struct {
+		name      string
+		pushes    []push
+		queued    []string
+		conflated int64
+	}{
+		{"no keys", []push{{"", "a"}, {"", "b"}}, []string{"a", "b"}, 0},
+		{"same key", []push{{"k", "1"}, {"k", "2"}, {"k", "3"}}, []string{"3"}, 2},
+		{"keeps position", []push{{"k", "1"}, {"", "a"}, {"k", "2"}}, []string{"2", "a"}, 1},
+		{"other keys", []push{{"k", "1"}, {"j", "2"}, {"k", "3"}}, []string{"3", "2"}, 1},
+		// full queue still takes a newer state of a queued key
+		{"full queue", []push{{"", "a"}, {"", "b"}, {"k", "1"}, {"k", "2"}, {"", "c"}}, []string{"a", "b", "2"}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stat := &testStat{}
+			q := newSendQueue(ConnectionOptions{SendBuffer: 3, Stats: stat})
+			for _, item := range test.pushes {
+				q.push(Frame{Data: []byte(item.data), Key: item.key})
+			}
+			if queued := testQueued(q); !reflect.DeepEqual(queued, test.queued) {
+				t.Errorf("queued %v, want %v", queued, test.queued)
+			}
+			if stat.conflated != test.conflated {
+				t.Errorf("conflated %d, want %d", stat.conflated, test.conflated)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package hive
+
+import (
+	"encoding/binary"
+	"github.com/google/uuid"
+	"runtime"
+)
+
+// HiveShards Event loops per hive, users are spread by uid and apps by aid
+var HiveShards = runtime.NumCPU()
+
+// Guest uids are unique across apps shards
+var guestSeq uint32
+
+// Node prefix of guest uids
+var guestNode uint32
+
+func shardsCount() int {
+	if HiveShards < 1 {
+		return 1
+	}
+	return HiveShards
+}
+
+func userShardIndex(uid uint32, count int) int {
+	return int(uid % uint32(count))
+}
+
+// Random uuid bits are evenly distributed, use the tail
+func appShardIndex(aid uuid.UUID, count int) int {
+	return int(binary.BigEndian.Uint32(aid[12:]) % uint32(count))
+}
+
+func (users *Users) shard(uid uint32) *Users {
+	return users.shards[userShardIndex(uid, len(users.shards))]
+}
+
+func (apps *Apps) shard(aid uuid.UUID) *Apps {
+	return apps.shards[appShardIndex(aid, len(apps.shards))]
+}
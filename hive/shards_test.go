@@ -0,0 +1,138 @@
+package hive
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRelayUids(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	in := make(chan uint32)
+	out := make(chan uint32)
+	go relayUids(ctx, in, out)
+
+	// nobody reads out, the relay keeps receiving
+	for uid := uint32(10); uid < 1010; uid++ {
+		select {
+		case in <- uid:
+		case <-time.After(time.Second):
+			t.Fatalf("relay is blocked at uid %d", uid)
+		}
+	}
+	for uid := uint32(10); uid < 1010; uid++ {
+		got := <-out
+		if got != uid {
+			t.Fatalf("got uid %d, want %d", got, uid)
+		}
+	}
+}
+
+func TestUserGoneFlood(t *testing.T) {
+	users, apps := testHives(t, 1)
+	aid := uuid.New()
+	testApp(t, apps, aid, "")
+
+	// more disconnects than the channels hold, none of the loops waits for another
+	done := make(chan struct{})
+	go func() {
+		for uid := uint32(10); uid < 30010; uid++ {
+			conn := newTestConnection()
+			users.ConnectionAdd(uid, conn)
+			users.ConnectionRemove(uid, conn)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("hives are blocked")
+	}
+	if apps.GetApp(aid) == nil {
+		t.Error("app is lost")
+	}
+}
+
+// Users sending data to apps, every user to its own app
+func BenchmarkShardsUserToApp(b *testing.B) {
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards %d", shards), func(b *testing.B) {
+			users, apps := testHives(b, shards)
+			count := 64
+			senders := make([]*testConnection, count)
+			messages := make([][]byte, count)
+			var received sync.WaitGroup
+			for i := 0; i < count; i++ {
+				uid := uint32(10 + i)
+				aid := uuid.New()
+				app := testApp(b, apps, aid, "")
+				senders[i] = testUser(b, users, uid)
+				apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aid, Uids: []uint32{uid}, Roles: map[uint32]uint8{uid: ROLE_OPERATOR}})
+				senders[i].nextAction(b, ACTION_CONNECTED)
+				messages[i] = []byte(fmt.Sprintf(`{"Action":"sendData","To":"%s","Data":{"N":1}}`, aid))
+				expected := b.N / count
+				if i < b.N%count {
+					expected++
+				}
+				received.Add(1)
+				go func() {
+					for n := 0; n < expected; n++ {
+						<-app.frames
+					}
+					received.Done()
+				}()
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				i := n % count
+				users.ConnectionMessage(uint32(10+i), senders[i], messages[i], false)
+			}
+			received.Wait()
+		})
+	}
+}
+
+// Apps sending data to users, every app to its own user
+func BenchmarkShardsAppToUser(b *testing.B) {
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards %d", shards), func(b *testing.B) {
+			users, apps := testHives(b, shards)
+			count := 64
+			aids := make([]uuid.UUID, count)
+			messages := make([][]byte, count)
+			var received sync.WaitGroup
+			for i := 0; i < count; i++ {
+				uid := uint32(10 + i)
+				aids[i] = uuid.New()
+				testApp(b, apps, aids[i], "")
+				user := testUser(b, users, uid)
+				apps.UpdateUids(AppUidsEvent{Cmd: ADD, Aid: aids[i], Uids: []uint32{uid}})
+				user.nextAction(b, ACTION_CONNECTED)
+				messages[i] = []byte(fmt.Sprintf(`{"Action":"sendData","To":%d,"Data":{"N":1}}`, uid))
+				expected := b.N / count
+				if i < b.N%count {
+					expected++
+				}
+				received.Add(1)
+				go func() {
+					for n := 0; n < expected; n++ {
+						<-user.frames
+					}
+					received.Done()
+				}()
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				i := n % count
+				apps.ConnectionMessage(aids[i], "", messages[i], false)
+			}
+			received.Wait()
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package hive
 
-import "sync"
+import (
+	"sync/atomic"
+)
 
 type UsersStatsData struct {
 	TotalConnectionsAccepted uint64
@@ -9,84 +11,113 @@ type UsersStatsData struct {
 	CurrentUsersConnected    uint32
 	MessagesReceived         uint64
 	MessagesTransmitted      uint64
+	CompressedBytesIn        uint64
+	CompressedBytesOut       uint64
+	MessagesDropped          uint64
+	SlowDisconnects          uint64
+	MessagesConflated        uint64
+	MessagesThrottled        uint64
+	AbuseDisconnects         uint64
+	MessagesRejected         uint64
 }
 
+// UsersStats Counters updated from hive shards and connection goroutines
 type UsersStats struct {
-	inData  UsersStatsData
-	out     chan UsersStatsData
-	outData UsersStatsData
-	lock    *sync.RWMutex
+	totalConnectionsAccepted uint64
+	currentConnections       int64
+	totalUsersConnected      uint64
+	currentUsersConnected    int64
+	messagesReceived         uint64
+	messagesTransmitted      uint64
+	compressedBytesIn        uint64
+	compressedBytesOut       uint64
+	messagesDropped          uint64
+	slowDisconnects          uint64
+	messagesConflated        uint64
+	messagesThrottled        uint64
+	abuseDisconnects         uint64
+	messagesRejected         uint64
 }
 
 func NewUsersStats() *UsersStats {
-	s := &UsersStats{
-		out:  make(chan UsersStatsData, 10),
-		lock: &sync.RWMutex{},
-	}
-	go func() {
-		for {
-			select {
-			case data := <-s.out:
-				s.setData(data)
-			}
-		}
-	}()
-	return s
-}
-
-func (s *UsersStats) sync() {
-	if len(s.out) < cap(s.out) {
-		s.out <- s.inData
-	}
-}
-
-func (s *UsersStats) setData(data UsersStatsData) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	s.outData = data
+	return &UsersStats{}
 }
 
 func (s *UsersStats) Connected() {
-	s.inData.TotalUsersConnected += 1
-	s.inData.CurrentUsersConnected += 1
-	s.inData.TotalConnectionsAccepted += 1
-	s.inData.CurrentConnections += 1
-	s.sync()
+	atomic.AddUint64(&s.totalUsersConnected, 1)
+	atomic.AddInt64(&s.currentUsersConnected, 1)
+	atomic.AddUint64(&s.totalConnectionsAccepted, 1)
+	atomic.AddInt64(&s.currentConnections, 1)
 }
 
 func (s *UsersStats) ConnectionAdded() {
-	s.inData.TotalConnectionsAccepted += 1
-	s.inData.CurrentConnections += 1
-	s.sync()
+	atomic.AddUint64(&s.totalConnectionsAccepted, 1)
+	atomic.AddInt64(&s.currentConnections, 1)
 }
 
 func (s *UsersStats) ConnectionRemoved() {
-	s.inData.CurrentConnections -= 1
-	s.sync()
+	atomic.AddInt64(&s.currentConnections, -1)
 }
 
 func (s *UsersStats) Disconnected() {
-	s.inData.CurrentConnections -= 1
-	s.inData.CurrentUsersConnected -= 1
-	s.sync()
+	atomic.AddInt64(&s.currentConnections, -1)
+	atomic.AddInt64(&s.currentUsersConnected, -1)
 }
 
 func (s *UsersStats) Received() {
-	s.inData.MessagesReceived += 1
-	s.sync()
+	atomic.AddUint64(&s.messagesReceived, 1)
 }
 
 func (s *UsersStats) Transmitted() {
-	s.inData.MessagesTransmitted += 1
-	s.sync()
+	atomic.AddUint64(&s.messagesTransmitted, 1)
 }
 
-func (s *UsersStats) GetData() UsersStatsData {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+func (s *UsersStats) Compressed(original int, compressed int) {
+	atomic.AddUint64(&s.compressedBytesIn, uint64(original))
+	atomic.AddUint64(&s.compressedBytesOut, uint64(compressed))
+}
+
+func (s *UsersStats) Dropped() {
+	atomic.AddUint64(&s.messagesDropped, 1)
+}
+
+func (s *UsersStats) SlowDisconnected() {
+	atomic.AddUint64(&s.slowDisconnects, 1)
+}
 
-	return s.inData
+func (s *UsersStats) Conflated() {
+	atomic.AddUint64(&s.messagesConflated, 1)
+}
+
+func (s *UsersStats) Throttled() {
+	atomic.AddUint64(&s.messagesThrottled, 1)
+}
+
+func (s *UsersStats) AbuseDisconnected() {
+	atomic.AddUint64(&s.abuseDisconnects, 1)
+}
+
+func (s *UsersStats) Rejected() {
+	atomic.AddUint64(&s.messagesRejected, 1)
+}
+
+func (s *UsersStats) GetData() UsersStatsData {
+	return UsersStatsData{
+		TotalConnectionsAccepted: atomic.LoadUint64(&s.totalConnectionsAccepted),
+		CurrentConnections:       uint32(atomic.LoadInt64(&s.currentConnections)),
+		TotalUsersConnected:      atomic.LoadUint64(&s.totalUsersConnected),
+		CurrentUsersConnected:    uint32(atomic.LoadInt64(&s.currentUsersConnected)),
+		MessagesReceived:         atomic.LoadUint64(&s.messagesReceived),
+		MessagesTransmitted:      atomic.LoadUint64(&s.messagesTransmitted),
+		CompressedBytesIn:        atomic.LoadUint64(&s.compressedBytesIn),
+		CompressedBytesOut:       atomic.LoadUint64(&s.compressedBytesOut),
+		MessagesDropped:          atomic.LoadUint64(&s.messagesDropped),
+		SlowDisconnects:          atomic.LoadUint64(&s.slowDisconnects),
+		MessagesConflated:        atomic.LoadUint64(&s.messagesConflated),
+		MessagesThrottled:        atomic.LoadUint64(&s.messagesThrottled),
+		AbuseDisconnects:         atomic.LoadUint64(&s.abuseDisconnects),
+		MessagesRejected:         atomic.LoadUint64(&s.messagesRejected),
+	}
 }
 
 type AppsStatsData struct {
@@ -96,75 +127,105 @@ type AppsStatsData struct {
 	CurrentConnections       uint32
 	MessagesReceived         uint64
 	MessagesTransmitted      uint64
+	CompressedBytesIn        uint64
+	CompressedBytesOut       uint64
+	MessagesDropped          uint64
+	SlowDisconnects          uint64
+	MessagesConflated        uint64
+	MessagesThrottled        uint64
+	AbuseDisconnects         uint64
+	MessagesRejected         uint64
 }
 
+// AppsStats Counters updated from hive shards and connection goroutines
 type AppsStats struct {
-	inData  AppsStatsData
-	out     chan AppsStatsData
-	outData AppsStatsData
-	lock    *sync.RWMutex
+	totalConnectionsAccepted uint64
+	totalReconnects          uint64
+	totalDisconnects         uint64
+	currentConnections       int64
+	messagesReceived         uint64
+	messagesTransmitted      uint64
+	compressedBytesIn        uint64
+	compressedBytesOut       uint64
+	messagesDropped          uint64
+	slowDisconnects          uint64
+	messagesConflated        uint64
+	messagesThrottled        uint64
+	abuseDisconnects         uint64
+	messagesRejected         uint64
 }
 
 func NewAppsStats() *AppsStats {
-	s := &AppsStats{
-		out:  make(chan AppsStatsData, 10),
-		lock: &sync.RWMutex{},
-	}
-	go func() {
-		for {
-			select {
-			case data := <-s.out:
-				s.setData(data)
-			}
-		}
-	}()
-	return s
-}
-
-func (s *AppsStats) sync() {
-	if len(s.out) < cap(s.out) {
-		s.out <- s.inData
-	}
-}
-
-func (s *AppsStats) setData(data AppsStatsData) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	s.outData = data
+	return &AppsStats{}
 }
 
 func (s *AppsStats) Connected() {
-	s.inData.TotalConnectionsAccepted += 1
-	s.inData.CurrentConnections += 1
-	s.sync()
+	atomic.AddUint64(&s.totalConnectionsAccepted, 1)
+	atomic.AddInt64(&s.currentConnections, 1)
 }
 
 func (s *AppsStats) Disconnected() {
-	s.inData.TotalDisconnects += 1
-	s.inData.CurrentConnections -= 1
-	s.sync()
+	atomic.AddUint64(&s.totalDisconnects, 1)
+	atomic.AddInt64(&s.currentConnections, -1)
 }
 
 func (s *AppsStats) Reconnected() {
-	s.inData.TotalConnectionsAccepted += 1
-	s.inData.TotalReconnects += 1
-	s.sync()
+	atomic.AddUint64(&s.totalConnectionsAccepted, 1)
+	atomic.AddUint64(&s.totalReconnects, 1)
 }
 
 func (s *AppsStats) Received() {
-	s.inData.MessagesReceived += 1
-	s.sync()
+	atomic.AddUint64(&s.messagesReceived, 1)
 }
 
 func (s *AppsStats) Transmitted() {
-	s.inData.MessagesTransmitted += 1
-	s.sync()
+	atomic.AddUint64(&s.messagesTransmitted, 1)
 }
 
-func (s *AppsStats) GetData() AppsStatsData {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+func (s *AppsStats) Compressed(original int, compressed int) {
+	atomic.AddUint64(&s.compressedBytesIn, uint64(original))
+	atomic.AddUint64(&s.compressedBytesOut, uint64(compressed))
+}
+
+func (s *AppsStats) Dropped() {
+	atomic.AddUint64(&s.messagesDropped, 1)
+}
+
+func (s *AppsStats) SlowDisconnected() {
+	atomic.AddUint64(&s.slowDisconnects, 1)
+}
 
-	return s.inData
+func (s *AppsStats) Conflated() {
+	atomic.AddUint64(&s.messagesConflated, 1)
+}
+
+func (s *AppsStats) Throttled() {
+	atomic.AddUint64(&s.messagesThrottled, 1)
+}
+
+func (s *AppsStats) AbuseDisconnected() {
+	atomic.AddUint64(&s.abuseDisconnects, 1)
+}
+
+func (s *AppsStats) Rejected() {
+	atomic.AddUint64(&s.messagesRejected, 1)
+}
+
+func (s *AppsStats) GetData() AppsStatsData {
+	return AppsStatsData{
+		TotalConnectionsAccepted: atomic.LoadUint64(&s.totalConnectionsAccepted),
+		TotalReconnects:          atomic.LoadUint64(&s.totalReconnects),
+		TotalDisconnects:         atomic.LoadUint64(&s.totalDisconnects),
+		CurrentConnections:       uint32(atomic.LoadInt64(&s.currentConnections)),
+		MessagesReceived:         atomic.LoadUint64(&s.messagesReceived),
+		MessagesTransmitted:      atomic.LoadUint64(&s.messagesTransmitted),
+		CompressedBytesIn:        atomic.LoadUint64(&s.compressedBytesIn),
+		CompressedBytesOut:       atomic.LoadUint64(&s.compressedBytesOut),
+		MessagesDropped:          atomic.LoadUint64(&s.messagesDropped),
+		SlowDisconnects:          atomic.LoadUint64(&s.slowDisconnects),
+		MessagesConflated:        atomic.LoadUint64(&s.messagesConflated),
+		MessagesThrottled:        atomic.LoadUint64(&s.messagesThrottled),
+		AbuseDisconnects:         atomic.LoadUint64(&s.abuseDisconnects),
+		MessagesRejected:         atomic.LoadUint64(&s.messagesRejected),
+	}
 }
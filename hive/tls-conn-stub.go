@@ -0,0 +1,13 @@
+//go:build !go1.18
+
+package hive
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Connection under tls is not exposed before go 1.18, it has no descriptor for netpoll
+func tlsNetConn(conn *tls.Conn) net.Conn {
+	return conn
+}
@@ -0,0 +1,13 @@
+//go:build go1.18
+
+package hive
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Connection under tls
+func tlsNetConn(conn *tls.Conn) net.Conn {
+	return conn.NetConn()
+}
@@ -0,0 +1,63 @@
+package hive
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// UidsApiRate Uids requests per second of all workers, 0 - unlimited
+var UidsApiRate float64 = 0
+
+// A hung uids api does not hold workers, default client of apps hives
+var uidsClient = &http.Client{Timeout: 10 * time.Second}
+
+// Requests are spread evenly, reconnecting apps do not hit the uids api at once
+type uidsPacer struct {
+	lock sync.Mutex
+	next time.Time
+}
+
+var uidsPace uidsPacer
+
+// Wait for a request slot, false if ctx is done
+func (p *uidsPacer) wait(ctx context.Context) bool {
+	if UidsApiRate <= 0 {
+		return true
+	}
+	p.lock.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	slot := p.next
+	p.next = p.next.Add(time.Duration(float64(time.Second) / UidsApiRate))
+	p.lock.Unlock()
+
+	if !slot.After(now) {
+		return true
+	}
+	timer := time.NewTimer(slot.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Failed request is repeated later, the delay doubles up to 30 seconds
+func uidsRetryDelay(attempts byte) time.Duration {
+	delay := 100 * time.Millisecond << attempts
+	if delay > 30*time.Second || delay <= 0 {
+		return 30 * time.Second
+	}
+	return delay
+}
+
+// UidsQueueLen Uids requests waiting for workers
+func (apps *Apps) UidsQueueLen() int {
+	return len(apps.chanGetUids)
+}
@@ -0,0 +1,76 @@
+package hive
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetUids(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		delay time.Duration
+		uids  []uint32
+		fail  bool
+	}{
+		{"uids", `{"Uids":[10,11],"Roles":{"11":"viewer"}}`, 0, []uint32{10, 11}, false},
+		{"invalid json", `{"Uids":`, 0, nil, true},
+		// the api hangs longer than the client waits
+		{"timeout", `{"Uids":[10]}`, time.Second, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(test.delay):
+				case <-r.Context().Done():
+					return
+				}
+				_, _ = w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+			ctx, stop := context.WithCancel(context.Background())
+			defer stop()
+			apps := NewApps(ctx, server.URL, NewAppsStats())
+			// workers of this hive get no requests, the client is used by the test only
+			apps.uidsClient = &http.Client{Timeout: 200 * time.Millisecond}
+
+			started := time.Now()
+			err, uids := apps.getUids(uuid.New())
+			if time.Since(started) > 500*time.Millisecond {
+				t.Errorf("request took %v", time.Since(started))
+			}
+			if (err != nil) != test.fail {
+				t.Fatalf("error %v", err)
+			}
+			if test.fail {
+				return
+			}
+			if len(uids.Uids) != len(test.uids) || uids.Uids[0] != test.uids[0] || uids.Roles[11] != "viewer" {
+				t.Errorf("uids %v, roles %v", uids.Uids, uids.Roles)
+			}
+		})
+	}
+}
+
+func TestUidsRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts byte
+		delay    time.Duration
+	}{
+		{1, 200 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{9, 30 * time.Second},
+		{100, 30 * time.Second},
+	}
+	for _, test := range tests {
+		delay := uidsRetryDelay(test.attempts)
+		if delay != test.delay {
+			t.Errorf("attempts %d: delay %v, want %v", test.attempts, delay, test.delay)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package hive
 
 import (
+	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/stepan-s/ws-bro/log"
 	"net"
@@ -10,16 +11,34 @@ import (
 type UserConnection struct {
 	handler AUserHandler
 	uid     uint32
+	id      uint64
 	conn    *websocket.Conn
-	send    chan []byte
+	send    *sendQueue
+	counter *CountingConn
+	connectionBase
 }
 
-func NewUserConnection(handler AUserHandler, uid uint32, conn *websocket.Conn) *UserConnection {
+func NewUserConnection(handler AUserHandler, uid uint32, conn *websocket.Conn, options ConnectionOptions) *UserConnection {
 	c := &UserConnection{
 		handler: handler,
 		uid:     uid,
+		id:      nextConnectionId(),
 		conn:    conn,
-		send:    make(chan []byte, 10),
+		send:    newSendQueue(options),
+	}
+	c.connectionBase = connectionBase{
+		sender:  c,
+		codec:   CodecBySubprotocol(conn.Subprotocol()),
+		options: options,
+		name:    fmt.Sprintf("user:%d", uid),
+	}
+	c.ip, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	if options.Compression {
+		err := conn.SetCompressionLevel(options.CompressionLevel)
+		if err != nil {
+			log.Error("Fail set compression level: %v, user:%d", err, uid)
+		}
+		c.counter, _ = conn.UnderlyingConn().(*CountingConn)
 	}
 	conn.SetPongHandler(func(appData string) error {
 		_ = conn.SetReadDeadline(time.Now().Add(70 * time.Second))
@@ -30,34 +49,42 @@ func NewUserConnection(handler AUserHandler, uid uint32, conn *websocket.Conn) *
 }
 
 func (c *UserConnection) Start() {
-	go func() {
-		defer func() {
-			// Remove app connection
-			c.handler.ConnectionRemove(c.uid, c)
+	// rejected connection is not read, only the close frame is written
+	if !c.send.isClosed() {
+		go func() {
+			defer func() {
+				// Remove app connection
+				c.handler.ConnectionRemove(c.uid, c)
 
-			// close
-			err := c.conn.Close()
-			if err != nil {
-				log.Error("Connection close error: %v", err)
-			}
-		}()
+				// close
+				err := c.conn.Close()
+				if err != nil {
+					log.Error("Connection close error: %v", err)
+				}
+			}()
 
-		_ = c.conn.SetReadDeadline(time.Now().Add(70 * time.Second))
-		for {
-			mt, message, err := c.conn.ReadMessage()
-			if err != nil {
-				if err.Error() != "websocket: close 1005 (no status)" &&
-					err.Error() != "websocket: close 1001 (going away)" &&
-					err.Error() != "websocket: close 1000 (normal)" {
-					log.Error("Connection read error: %v", err)
+			_ = c.conn.SetReadDeadline(time.Now().Add(70 * time.Second))
+			for {
+				mt, message, err := readLimited(c.conn, c.options.MaxMessageSize)
+				if err == errMessageTooBig {
+					c.reject("Message too big")
+					continue
+				}
+				if err != nil {
+					if err.Error() != "websocket: close 1005 (no status)" &&
+						err.Error() != "websocket: close 1001 (going away)" &&
+						err.Error() != "websocket: close 1000 (normal)" {
+						log.Error("Connection read error: %v", err)
+					}
+					break
+				}
+				message, binary, ok := c.accept(message, mt == websocket.BinaryMessage)
+				if ok {
+					c.handler.ConnectionMessage(c.uid, c, message, binary)
 				}
-				break
-			}
-			if mt == websocket.TextMessage {
-				c.handler.ConnectionMessage(c.uid, message)
 			}
-		}
-	}()
+		}()
+	}
 
 	go func() {
 		ticker := time.NewTicker(60 * time.Second)
@@ -76,16 +103,19 @@ func (c *UserConnection) Start() {
 
 		for {
 			select {
-			case msg, ok := <-c.send:
-				_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
-				if !ok {
-					_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-					return
+			case <-c.send.ready:
+				frames, closed := c.send.pop()
+				for _, frame := range frames {
+					_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+					err := c.writeFrame(c.conn, c.counter, frame)
+					if err != nil {
+						log.Error("Send error: %v", err)
+						return
+					}
 				}
-
-				err := c.conn.WriteMessage(websocket.TextMessage, msg)
-				if err != nil {
-					log.Error("Send error: %v", err)
+				if closed {
+					_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+					_ = c.conn.WriteMessage(websocket.CloseMessage, c.send.closeMessage())
 					return
 				}
 			case <-ticker.C:
@@ -99,14 +129,21 @@ func (c *UserConnection) Start() {
 	}()
 }
 
-func (c *UserConnection) Send(message []byte) {
-	if len(c.send) < cap(c.send) {
-		c.send <- message
-	}
+func (c *UserConnection) Send(message Frame) {
+	c.send.push(message)
 }
 
 func (c *UserConnection) Close() {
-	close(c.send)
+	c.send.close()
+}
+
+// CloseWithCode Close after queued frames with close code
+func (c *UserConnection) CloseWithCode(code int, text string) {
+	c.send.closeWithCode(code, text)
+}
+
+func (c *UserConnection) Id() uint64 {
+	return c.id
 }
 
 func (c *UserConnection) RemoteAddr() net.Addr {
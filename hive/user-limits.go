@@ -0,0 +1,51 @@
+package hive
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+const OVERFLOW_REJECT_NEWEST = 1
+const OVERFLOW_EVICT_OLDEST = 2
+
+var overflowNames = map[uint8]string{
+	OVERFLOW_REJECT_NEWEST: "reject-newest",
+	OVERFLOW_EVICT_OLDEST:  "evict-oldest",
+}
+
+// UserMaxConnections Connections limit per uid, 0 - no limit
+var UserMaxConnections = 0
+
+// UserConnectionsOverflow Policy on connections limit, OVERFLOW_*
+var UserConnectionsOverflow uint8 = OVERFLOW_REJECT_NEWEST
+
+var connectionSeq uint64
+
+// Node prefix of connection ids, ids stay within 53 bits of json numbers
+var connectionNode uint64
+
+// OverflowParse Get connections overflow policy by name
+func OverflowParse(name string) (uint8, bool) {
+	for policy, policyName := range overflowNames {
+		if policyName == name {
+			return policy, true
+		}
+	}
+	return 0, false
+}
+
+// Connection id unique within the cluster
+func nextConnectionId() uint64 {
+	return atomic.LoadUint64(&connectionNode) | atomic.AddUint64(&connectionSeq, 1)
+}
+
+// Prefix connection ids with 16 bits of node hash, before connections are accepted
+func setConnectionNode(node string) {
+	atomic.StoreUint64(&connectionNode, uint64(nodeHash(node)&0xFFFF)<<37)
+}
+
+func nodeHash(node string) uint32 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(node))
+	return hash.Sum32()
+}
@@ -0,0 +1,80 @@
+package hive
+
+import (
+	"github.com/gorilla/websocket"
+	"testing"
+	"time"
+)
+
+func TestUserMaxConnections(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow uint8
+		// close code of the first and the second connection
+		first  int
+		second int
+	}{
+		{"reject newest", OVERFLOW_REJECT_NEWEST, 0, websocket.ClosePolicyViolation},
+		{"evict oldest", OVERFLOW_EVICT_OLDEST, websocket.ClosePolicyViolation, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			savedMax, savedOverflow := UserMaxConnections, UserConnectionsOverflow
+			UserMaxConnections, UserConnectionsOverflow = 1, test.overflow
+			defer func() {
+				UserMaxConnections, UserConnectionsOverflow = savedMax, savedOverflow
+			}()
+
+			users, _ := testHives(t, 1)
+			first := testUser(t, users, 10)
+			second := newTestConnection()
+			users.ConnectionAdd(10, second)
+			if test.second == 0 {
+				second.nextAction(t, ACTION_HELLO)
+			} else {
+				second.none(t)
+			}
+
+			for _, item := range []struct {
+				conn *testConnection
+				code int
+			}{{first, test.first}, {second, test.second}} {
+				_, closed, code := item.conn.state()
+				if closed != (item.code != 0) || code != item.code {
+					t.Errorf("connection %d closed %v with %d, want %d", item.conn.id, closed, code, item.code)
+				}
+			}
+			if test.second != 0 && !second.rejected {
+				t.Error("rejected connection is started before close")
+			}
+		})
+	}
+}
+
+func TestOverflowParse(t *testing.T) {
+	for policy, name := range overflowNames {
+		if parsed, ok := OverflowParse(name); !ok || parsed != policy {
+			t.Errorf("%s parsed %d %v", name, parsed, ok)
+		}
+	}
+	if _, ok := OverflowParse("queue"); ok {
+		t.Error("unknown policy parsed")
+	}
+}
+
+func TestRejectedConnectionIsNotRead(t *testing.T) {
+	client, handler := testUserConnectionWith(t, ConnectionOptions{}, func(c *UserConnection) {
+		c.CloseWithCode(websocket.ClosePolicyViolation, "Too many connections")
+	})
+	_ = client.WriteMessage(websocket.TextMessage, []byte(`{"Action":"sendData"}`))
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := client.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("got %v, want close", err)
+	}
+	select {
+	case message := <-handler.messages:
+		t.Errorf("rejected connection message handled: %s", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -2,13 +2,26 @@ package hive
 
 import (
 	"container/list"
+	"context"
+	"github.com/gorilla/websocket"
 	"github.com/stepan-s/ws-bro/log"
+	"time"
 )
 
-// UserMessageEvent A message to user
+// UserMessageEvent A message to or from user, Source is the connection message came from and is skipped on send
 type UserMessageEvent struct {
 	Uid        uint32
 	RawMessage []byte
+	Source     AConnection
+	Binary     bool
+	// Conflation key, see Frame
+	Key string
+	// Target connection id, 0 - all connections
+	Cid uint64
+	// Message framed once for all recipients, optional
+	Prepared *websocket.PreparedMessage
+	// Skipped connection id, the sender connected to other node is known by id only
+	SkipCid uint64
 }
 
 // A connection message
@@ -18,23 +31,74 @@ type userConnectionEvent struct {
 	conn AConnection
 }
 
+type userInfoQueryEvent struct {
+	uid   uint32
+	reply chan *UserInfo
+}
+
+// UserInfo A connected user snapshot
+type UserInfo struct {
+	Uid         uint32
+	Connections []UserConnectionInfo
+}
+
+// UserConnectionInfo A user connection snapshot
+type UserConnectionInfo struct {
+	Cid         uint64
+	Ip          string
+	ConnectedAt time.Time
+}
+
+type userConnectionItem struct {
+	conn        AConnection
+	connectedAt time.Time
+}
+
 // Users A users hive
 type Users struct {
-	conns    map[uint32]*list.List
-	chanIn   chan UserMessageEvent
-	chanOut  chan UserMessageEvent
-	chanConn chan userConnectionEvent
-	stats    AUserStat
+	conns         map[uint32]*list.List
+	chanIn        chan UserMessageEvent
+	chanBatch     chan []UserMessageEvent
+	chanBroadcast chan Frame
+	chanOut       chan UserMessageEvent
+	chanConn      chan userConnectionEvent
+	chanInfoQuery chan userInfoQueryEvent
+	chanGone      chan uint32
+	chanRemote    chan UserMessageEvent
+	chanDrain     chan time.Duration
+	draining      bool
+	remote        ARemote
+	exporter      AExporter
+	stats         AUserStat
+	shards        []*Users
 }
 
-// NewUsers Instantiate users hive
-func NewUsers(stats AUserStat) *Users {
+// NewUsers Instantiate users hive, users are spread over HiveShards event loops until ctx is done
+func NewUsers(ctx context.Context, stats AUserStat) *Users {
+	users := new(Users)
+	users.chanGone = make(chan uint32, 1000)
+	users.stats = stats
+	users.shards = make([]*Users, shardsCount())
+	for i := range users.shards {
+		users.shards[i] = newUsersShard(ctx, users)
+	}
+	return users
+}
+
+// Instantiate users event loop, disconnects are reported to the root
+func newUsersShard(ctx context.Context, root *Users) *Users {
 	users := new(Users)
 	users.conns = make(map[uint32]*list.List)
 	users.chanIn = make(chan UserMessageEvent, 1000)
+	users.chanBatch = make(chan []UserMessageEvent, 1000)
+	users.chanBroadcast = make(chan Frame, 1000)
 	users.chanOut = make(chan UserMessageEvent, 1000)
 	users.chanConn = make(chan userConnectionEvent, 1000)
-	users.stats = stats
+	users.chanInfoQuery = make(chan userInfoQueryEvent, 1000)
+	users.chanGone = root.chanGone
+	users.chanRemote = make(chan UserMessageEvent, 1000)
+	users.chanDrain = make(chan time.Duration, 1)
+	users.stats = root.stats
 	go func() {
 		for {
 			select {
@@ -47,6 +111,22 @@ func NewUsers(stats AUserStat) *Users {
 				}
 			case event := <-users.chanIn:
 				users.sendEvent(event)
+				users.forward(event)
+			case events := <-users.chanBatch:
+				for _, event := range events {
+					users.sendEvent(event)
+					users.forward(event)
+				}
+			case event := <-users.chanRemote:
+				users.sendEvent(event)
+			case frame := <-users.chanBroadcast:
+				users.broadcast(frame)
+			case event := <-users.chanInfoQuery:
+				users.replyInfo(event)
+			case window := <-users.chanDrain:
+				users.drain(window)
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
@@ -61,15 +141,50 @@ func (users *Users) addConnection(uid uint32, conn AConnection) {
 		conns = list.New()
 	} else {
 		log.Debug("Add connection for user: %d", uid)
+		if UserMaxConnections > 0 && conns.Len() >= UserMaxConnections {
+			if UserConnectionsOverflow != OVERFLOW_EVICT_OLDEST {
+				log.Warning("Decline connection, reason: too many connections for user: %d", uid)
+				// closed before start, messages of the rejected connection are not read
+				conn.CloseWithCode(websocket.ClosePolicyViolation, "Too many connections")
+				conn.Start()
+				return
+			}
+			oldest := conns.Remove(conns.Front()).(*userConnectionItem)
+			oldest.conn.CloseWithCode(websocket.ClosePolicyViolation, "Replaced by newer connection")
+			users.stats.ConnectionRemoved()
+			log.Debug("Evict connection for user: %d", uid)
+		}
 	}
-	conns.PushBack(conn)
+	conns.PushBack(&userConnectionItem{conn, time.Now()})
+	users.hello(uid, conn)
 	if !exists {
 		users.conns[uid] = conns
 		users.stats.Connected()
+		if users.remote != nil {
+			users.remote.UserPresence(uid, true)
+		}
+		users.exportPresence(uid, ACTION_CONNECTED)
 	} else {
 		users.stats.ConnectionAdded()
 	}
 	conn.Start()
+	if users.draining {
+		drainConnection(conn)
+	}
+}
+
+// Announce connection id
+func (users *Users) hello(uid uint32, conn AConnection) {
+	rawMessage, err := MessageUserHelloPack(&MessageUserHello{
+		Action: ACTION_HELLO,
+		Cid:    conn.Id(),
+	})
+	if err != nil {
+		log.Error("Fail pack: %v, user:%d", err, uid)
+		return
+	}
+	conn.Send(Frame{Data: rawMessage})
+	users.stats.Transmitted()
 }
 
 // Unregister user connection
@@ -82,9 +197,9 @@ func (users *Users) removeConnection(uid uint32, conn AConnection) {
 	removed := false
 	item := conns.Front()
 	for item != nil {
-		if item.Value == conn {
+		if item.Value.(*userConnectionItem).conn == conn {
 			conns.Remove(item)
-			item.Value.(AConnection).Close()
+			conn.Close()
 			removed = true
 			break
 		}
@@ -103,43 +218,140 @@ func (users *Users) removeConnection(uid uint32, conn AConnection) {
 
 	if disconnected {
 		users.stats.Disconnected()
+		if users.remote != nil {
+			users.remote.UserPresence(uid, false)
+		}
+		users.exportPresence(uid, ACTION_DISCONNECTED)
+		users.chanGone <- uid
 	} else if removed {
 		users.stats.ConnectionRemoved()
 	}
 }
 
-// Send message to all user connections
+// Send message to all user connections or to the target one
 func (users *Users) sendEvent(event UserMessageEvent) {
 	conns, exists := users.conns[event.Uid]
 	if exists {
+		frame := Frame{event.Binary, event.RawMessage, event.Key, event.Prepared}
+		if frame.Prepared == nil && event.Cid == 0 && conns.Len() > 1 {
+			// same message to every tab
+			frame = prepareFrame(frame)
+		}
 		item := conns.Front()
 		for item != nil {
-			item.Value.(AConnection).Send(event.RawMessage)
+			conn := item.Value.(*userConnectionItem).conn
+			skip := conn == event.Source || (event.SkipCid != 0 && event.SkipCid == conn.Id())
+			if !skip && (event.Cid == 0 || event.Cid == conn.Id()) {
+				conn.Send(frame)
+				users.stats.Transmitted()
+			}
+			item = item.Next()
+		}
+	}
+}
+
+// Send message to user connections on other nodes
+func (users *Users) forward(event UserMessageEvent) {
+	if users.remote != nil {
+		users.remote.SendUser(event)
+	}
+}
+
+// Send message to all connections of all users
+func (users *Users) broadcast(frame Frame) {
+	for _, conns := range users.conns {
+		item := conns.Front()
+		for item != nil {
+			item.Value.(*userConnectionItem).conn.Send(frame)
 			users.stats.Transmitted()
 			item = item.Next()
 		}
 	}
 }
 
+func (users *Users) replyInfo(event userInfoQueryEvent) {
+	conns, exists := users.conns[event.uid]
+	if !exists {
+		event.reply <- nil
+		return
+	}
+	info := &UserInfo{
+		Uid:         event.uid,
+		Connections: make([]UserConnectionInfo, 0, conns.Len()),
+	}
+	item := conns.Front()
+	for item != nil {
+		conn := item.Value.(*userConnectionItem)
+		info.Connections = append(info.Connections, UserConnectionInfo{
+			Cid:         conn.conn.Id(),
+			Ip:          conn.conn.RemoteAddr().String(),
+			ConnectedAt: conn.connectedAt,
+		})
+		item = item.Next()
+	}
+	event.reply <- info
+}
+
 // SendEvent Send message to all user connections
 func (users *Users) SendEvent(event UserMessageEvent) {
-	users.chanIn <- event
+	users.shard(event.Uid).chanIn <- event
+}
+
+// SendBatch Send messages to users at once, the batch is split by shards
+func (users *Users) SendBatch(events []UserMessageEvent) {
+	if len(users.shards) == 1 {
+		users.shards[0].chanBatch <- events
+		return
+	}
+	batches := make([][]UserMessageEvent, len(users.shards))
+	for _, event := range events {
+		i := userShardIndex(event.Uid, len(users.shards))
+		batches[i] = append(batches[i], event)
+	}
+	for i, batch := range batches {
+		if len(batch) > 0 {
+			users.shards[i].chanBatch <- batch
+		}
+	}
+}
+
+// Broadcast Send message to all connected users
+func (users *Users) Broadcast(rawMessage []byte) {
+	// framed once for all shards
+	frame := prepareFrame(Frame{Data: rawMessage})
+	for _, shard := range users.shards {
+		shard.chanBroadcast <- frame
+	}
+}
+
+// GetUser Get connected user snapshot, nil if user is not connected
+func (users *Users) GetUser(uid uint32) *UserInfo {
+	reply := make(chan *UserInfo, 1)
+	users.shard(uid).chanInfoQuery <- userInfoQueryEvent{uid, reply}
+	return <-reply
+}
+
+// Set delivery to other nodes, before connections are accepted
+func (users *Users) setRemote(remote ARemote) {
+	for _, shard := range users.shards {
+		shard.remote = remote
+	}
 }
 
-// ReceiveEvent Read message from user, blocked
-func (users *Users) ReceiveEvent() UserMessageEvent {
-	return <-users.chanOut
+// Deliver message from other node
+func (users *Users) sendRemote(event UserMessageEvent) {
+	users.shard(event.Uid).chanRemote <- event
 }
 
 func (users *Users) ConnectionAdd(uid uint32, conn AConnection) {
-	users.chanConn <- userConnectionEvent{ADD, uid, conn}
+	users.shard(uid).chanConn <- userConnectionEvent{ADD, uid, conn}
 }
 
 func (users *Users) ConnectionRemove(uid uint32, conn AConnection) {
-	users.chanConn <- userConnectionEvent{REMOVE, uid, conn}
+	users.shard(uid).chanConn <- userConnectionEvent{REMOVE, uid, conn}
 }
 
-func (users *Users) ConnectionMessage(uid uint32, message []byte) {
+func (users *Users) ConnectionMessage(uid uint32, conn AConnection, message []byte, binary bool) {
 	users.stats.Received()
-	users.chanOut <- UserMessageEvent{uid, message}
+	users.shard(uid).chanOut <- UserMessageEvent{uid, message, conn, binary, "", 0, nil, 0}
 }
@@ -0,0 +1,157 @@
+package hive
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"reflect"
+	"testing"
+)
+
+func TestSendBatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards int
+		uids   []uint32
+	}{
+		{"one shard", 1, []uint32{1, 2, 3}},
+		{"many shards", 4, []uint32{1, 2, 3, 4, 5, 6, 7}},
+		{"same user", 4, []uint32{5, 5, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, _ := testHives(t, test.shards)
+			conns := make(map[uint32]*testConnection)
+			for _, uid := range test.uids {
+				if conns[uid] == nil {
+					conns[uid] = testUser(t, users, uid)
+				}
+			}
+
+			events := make([]UserMessageEvent, len(test.uids))
+			for i, uid := range test.uids {
+				events[i] = UserMessageEvent{Uid: uid, RawMessage: []byte(fmt.Sprintf(`{"N":%d}`, i))}
+			}
+			users.SendBatch(events)
+
+			// messages of a user keep order
+			for i, uid := range test.uids {
+				frame := conns[uid].next(t)
+				if string(frame.Data) != fmt.Sprintf(`{"N":%d}`, i) {
+					t.Errorf("user %d got %s, want message %d", uid, frame.Data, i)
+				}
+			}
+			for _, conn := range conns {
+				conn.none(t)
+			}
+		})
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards int
+		users  int
+	}{
+		{"one shard", 1, 3},
+		{"many shards", 4, 10},
+		{"no users", 4, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, apps := testHives(t, test.shards)
+			var conns []*testConnection
+			for uid := 10; uid < 10+test.users; uid++ {
+				conns = append(conns, testUser(t, users, uint32(uid)))
+			}
+			app := testApp(t, apps, uuid.New(), "")
+
+			users.Broadcast([]byte(`{"Action":"news"}`))
+			for _, conn := range conns {
+				frame := conn.next(t)
+				if string(frame.Data) != `{"Action":"news"}` {
+					t.Errorf("user got %s", frame.Data)
+				}
+			}
+
+			apps.Broadcast([]byte(`{"Action":"notice"}`))
+			app.nextAction(t, "notice")
+			for _, conn := range conns {
+				conn.none(t)
+			}
+		})
+	}
+}
+
+func TestAppSendBatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards int
+		apps   int
+	}{
+		{"one shard", 1, 2},
+		{"many shards", 4, 8},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, apps := testHives(t, test.shards)
+			aids := make([]uuid.UUID, test.apps)
+			conns := make([]*testConnection, test.apps)
+			events := make([]AppMessageToEvent, test.apps)
+			for i := range aids {
+				aids[i] = uuid.New()
+				conns[i] = testApp(t, apps, aids[i], "")
+				events[i] = AppMessageToEvent{Aid: aids[i], Uid: SYSUID, RawMessage: []byte(fmt.Sprintf(`{"Action":"batch","N":%d}`, i))}
+			}
+			apps.SendBatch(events)
+
+			for i, conn := range conns {
+				frame := conn.nextAction(t, "batch")
+				if string(frame.Data) != fmt.Sprintf(`{"Action":"batch","N":%d}`, i) {
+					t.Errorf("app %d got %s", i, frame.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	users, _ := testHives(t, 4)
+	first := testUser(t, users, 1)
+	second := testUser(t, users, 1)
+	third := testUser(t, users, 2)
+
+	tests := []struct {
+		name string
+		uid  uint32
+		cids []uint64
+	}{
+		{"two connections", 1, []uint64{first.Id(), second.Id()}},
+		{"one connection", 2, []uint64{third.Id()}},
+		{"not connected", 3, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := users.GetUser(test.uid)
+			if test.cids == nil {
+				if info != nil {
+					t.Errorf("info of not connected user: %v", info)
+				}
+				return
+			}
+			if info == nil || info.Uid != test.uid {
+				t.Fatalf("info %v", info)
+			}
+			var cids []uint64
+			for _, item := range info.Connections {
+				cids = append(cids, item.Cid)
+				if item.Ip != "127.0.0.1:1000" {
+					t.Errorf("ip %s", item.Ip)
+				}
+			}
+			if !reflect.DeepEqual(cids, test.cids) {
+				t.Errorf("connections %v, want %v", cids, test.cids)
+			}
+		})
+	}
+}
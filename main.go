@@ -3,14 +3,20 @@ package main
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stepan-s/ws-bro/backplane"
 	"github.com/stepan-s/ws-bro/endpoint"
 	"github.com/stepan-s/ws-bro/hive"
 	"github.com/stepan-s/ws-bro/log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -24,6 +30,56 @@ func main() {
 	var privKeyFilename = flag.String("key-file", "", "private key path")
 	var apiKey = flag.String("api-key", "", "api key")
 	var uidsApiUrl = flag.String("uids-api-url", "", "get uids by aid")
+	var controlLeaseTTL = flag.Int64("control-lease-ttl", hive.ControlLeaseTTL, "app control lease inactivity timeout in seconds")
+	var userCompression = flag.Bool("user-compression", false, "enable permessage-deflate for user connections")
+	var userCompressionLevel = flag.Int("user-compression-level", 1, "user connections deflate level, 1..9")
+	var userCompressionThreshold = flag.Int("user-compression-threshold", 256, "compress user messages from size in bytes")
+	var appCompression = flag.Bool("app-compression", false, "enable permessage-deflate for app connections")
+	var appCompressionLevel = flag.Int("app-compression-level", 1, "app connections deflate level, 1..9")
+	var appCompressionThreshold = flag.Int("app-compression-threshold", 256, "compress app messages from size in bytes")
+	var userSendBuffer = flag.Int("user-send-buffer", 10, "user connection outgoing queue size")
+	var userSpillBuffer = flag.Int("user-spill-buffer", 1000, "user connection outgoing queue size for spill policy")
+	var userBackpressure = flag.String("user-backpressure", "drop-newest", "slow user policy: drop-newest, drop-oldest, disconnect, spill")
+	var appSendBuffer = flag.Int("app-send-buffer", 10, "app connection outgoing queue size")
+	var appSpillBuffer = flag.Int("app-spill-buffer", 1000, "app connection outgoing queue size for spill policy")
+	var appBackpressure = flag.String("app-backpressure", "drop-newest", "slow app policy: drop-newest, drop-oldest, disconnect, spill")
+	var userRateMessages = flag.Float64("user-rate-messages", 0, "messages per second from a user, 0 - unlimited")
+	var userRateBytes = flag.Float64("user-rate-bytes", 0, "bytes per second from a user, 0 - unlimited")
+	var appRateMessages = flag.Float64("app-rate-messages", 0, "messages per second from an app, 0 - unlimited")
+	var appRateBytes = flag.Float64("app-rate-bytes", 0, "bytes per second from an app, 0 - unlimited")
+	var ipRateMessages = flag.Float64("ip-rate-messages", 0, "messages per second from an ip, 0 - unlimited")
+	var ipRateBytes = flag.Float64("ip-rate-bytes", 0, "bytes per second from an ip, 0 - unlimited")
+	var rateViolations = flag.Int("rate-violations", 100, "throttled messages in a row to disconnect, 0 - never")
+	var userMaxMessageSize = flag.Int64("user-max-message-size", 65536, "user message size limit in bytes, 0 - unlimited")
+	var appMaxMessageSize = flag.Int64("app-max-message-size", 1048576, "app message size limit in bytes, 0 - unlimited")
+	var userMaxJsonDepth = flag.Int("user-max-json-depth", 32, "user message json nesting limit, 0 - unlimited")
+	var appMaxJsonDepth = flag.Int("app-max-json-depth", 64, "app message json nesting limit, 0 - unlimited")
+	var oversize = flag.String("oversize", "reject", "too big or complex message policy: reject, close")
+	var appMultiInstance = flag.Bool("app-multi-instance", false, "allow several app connections tagged by instance")
+	var userMaxConnections = flag.Int("user-max-connections", 0, "connections limit per user, 0 - unlimited")
+	var userConnectionsOverflow = flag.String("user-connections-overflow", "reject-newest", "policy on user connections limit: reject-newest, evict-oldest")
+	var clusterRedis = flag.String("cluster-redis", "", "redis address for cluster backplane, empty - single node")
+	var clusterNode = flag.String("cluster-node", "", "unique node name, random if empty")
+	var clusterHeartbeat = flag.Int64("cluster-heartbeat", 5, "cluster presence interval in seconds")
+	var natsUrl = flag.String("nats", "", "nats server url, empty - disabled")
+	var natsExport = flag.Bool("nats-export", false, "publish messages and lifecycle events to nats")
+	var natsInject = flag.Bool("nats-inject", false, "send messages published to nats wsbro.to.* subjects")
+	var natsQueue = flag.String("nats-queue", "wsbro", "nats queue group of injecting nodes, a message is taken by one node")
+	var clusterNats = flag.Bool("cluster-nats", false, "use nats as cluster backplane")
+	var hiveShards = flag.Int("hive-shards", hive.HiveShards, "event loops per hive, defaults to cpu count")
+	var netpoll = flag.Bool("netpoll", false, "serve connections by epoll workers instead of goroutines, linux only")
+	var netpollWorkers = flag.Int("netpoll-workers", 64, "netpoll workers reading and writing connections")
+	var userMaxHandshakes = flag.Int("user-max-handshakes", 0, "concurrent user handshakes, 0 - unlimited")
+	var userHandshakeRate = flag.Float64("user-handshake-rate", 0, "new user connections per second, 0 - unlimited")
+	var appMaxHandshakes = flag.Int("app-max-handshakes", 0, "concurrent app handshakes, 0 - unlimited")
+	var appHandshakeRate = flag.Float64("app-handshake-rate", 0, "new app connections per second, 0 - unlimited")
+	var admissionRetryAfter = flag.Int64("admission-retry-after", endpoint.AdmissionRetryAfter, "retry delay suggested to refused handshakes in seconds, jittered up to twice as much")
+	var uidsApiRate = flag.Float64("uids-api-rate", 0, "uids api requests per second, 0 - unlimited")
+	var uidsQueueLimit = flag.Int("uids-queue-limit", 0, "refuse app handshakes while more uids requests wait, 0 - unlimited")
+	var drainTimeout = flag.Int64("drain-timeout", 10, "shutdown deadline for closing connections and flushing queues in seconds")
+	var drainReconnectDelay = flag.Int64("drain-reconnect-delay", hive.DrainReconnectDelay, "reconnect delay suggested on shutdown in seconds, jittered up to twice as much")
+	var drainWindow = flag.Int64("drain-window", 30, "spread closing connections over seconds after handoff to a new process")
+	var handoffSocket = flag.String("handoff-socket", "", "unix socket path to take over the listener from a running process and hand it off to the next one, linux only")
 	var devPageTemplate = flag.String("dev-page-template", "", "dev page template path")
 	var logLevel = flag.Int64("log-level", log.DEBUG, "log level")
 	flag.Parse()
@@ -56,11 +112,97 @@ func main() {
 		log.Info("  api-key: not set")
 	}
 	log.Info("  uids-api-url: %v", *uidsApiUrl)
+	log.Info("  control-lease-ttl: %v", *controlLeaseTTL)
+	log.Info("  user-compression: %v", *userCompression)
+	log.Info("  user-compression-level: %v", *userCompressionLevel)
+	log.Info("  user-compression-threshold: %v", *userCompressionThreshold)
+	log.Info("  app-compression: %v", *appCompression)
+	log.Info("  app-compression-level: %v", *appCompressionLevel)
+	log.Info("  app-compression-threshold: %v", *appCompressionThreshold)
+	log.Info("  user-send-buffer: %v", *userSendBuffer)
+	log.Info("  user-spill-buffer: %v", *userSpillBuffer)
+	log.Info("  user-backpressure: %v", *userBackpressure)
+	log.Info("  app-send-buffer: %v", *appSendBuffer)
+	log.Info("  app-spill-buffer: %v", *appSpillBuffer)
+	log.Info("  app-backpressure: %v", *appBackpressure)
+	log.Info("  user-rate-messages: %v", *userRateMessages)
+	log.Info("  user-rate-bytes: %v", *userRateBytes)
+	log.Info("  app-rate-messages: %v", *appRateMessages)
+	log.Info("  app-rate-bytes: %v", *appRateBytes)
+	log.Info("  ip-rate-messages: %v", *ipRateMessages)
+	log.Info("  ip-rate-bytes: %v", *ipRateBytes)
+	log.Info("  rate-violations: %v", *rateViolations)
+	log.Info("  user-max-message-size: %v", *userMaxMessageSize)
+	log.Info("  app-max-message-size: %v", *appMaxMessageSize)
+	log.Info("  user-max-json-depth: %v", *userMaxJsonDepth)
+	log.Info("  app-max-json-depth: %v", *appMaxJsonDepth)
+	log.Info("  oversize: %v", *oversize)
+	log.Info("  app-multi-instance: %v", *appMultiInstance)
+	log.Info("  user-max-connections: %v", *userMaxConnections)
+	log.Info("  user-connections-overflow: %v", *userConnectionsOverflow)
+	log.Info("  cluster-redis: %v", *clusterRedis)
+	log.Info("  cluster-node: %v", *clusterNode)
+	log.Info("  cluster-heartbeat: %v", *clusterHeartbeat)
+	log.Info("  nats: %v", *natsUrl)
+	log.Info("  nats-export: %v", *natsExport)
+	log.Info("  nats-inject: %v", *natsInject)
+	log.Info("  nats-queue: %v", *natsQueue)
+	log.Info("  cluster-nats: %v", *clusterNats)
+	log.Info("  hive-shards: %v", *hiveShards)
+	log.Info("  netpoll: %v", *netpoll)
+	log.Info("  netpoll-workers: %v", *netpollWorkers)
+	log.Info("  user-max-handshakes: %v", *userMaxHandshakes)
+	log.Info("  user-handshake-rate: %v", *userHandshakeRate)
+	log.Info("  app-max-handshakes: %v", *appMaxHandshakes)
+	log.Info("  app-handshake-rate: %v", *appHandshakeRate)
+	log.Info("  admission-retry-after: %v", *admissionRetryAfter)
+	log.Info("  uids-api-rate: %v", *uidsApiRate)
+	log.Info("  uids-queue-limit: %v", *uidsQueueLimit)
+	log.Info("  drain-timeout: %v", *drainTimeout)
+	log.Info("  drain-reconnect-delay: %v", *drainReconnectDelay)
+	log.Info("  drain-window: %v", *drainWindow)
+	log.Info("  handoff-socket: %v", *handoffSocket)
 	log.Info("  dev-page-template: %v", *devPageTemplate)
 	log.Info("  log-level: %v, used: %v", *logLevel, logLevelValue)
 
 	endpoint.UserAuthSignTTL = *userAuthSignTTL
 	endpoint.AppAuthSignTTL = *appAuthSignTTL
+	endpoint.AppMultiInstance = *appMultiInstance
+	endpoint.AdmissionRetryAfter = *admissionRetryAfter
+	hive.ControlLeaseTTL = *controlLeaseTTL
+	hive.ClusterHeartbeat = *clusterHeartbeat
+	hive.HiveShards = *hiveShards
+	hive.DrainReconnectDelay = *drainReconnectDelay
+	hive.UidsApiRate = *uidsApiRate
+
+	userBackpressureValue, ok := hive.BackpressureParse(*userBackpressure)
+	if !ok {
+		log.Emergency("Invalid user-backpressure: %v", *userBackpressure)
+		os.Exit(1)
+	}
+	appBackpressureValue, ok := hive.BackpressureParse(*appBackpressure)
+	if !ok {
+		log.Emergency("Invalid app-backpressure: %v", *appBackpressure)
+		os.Exit(1)
+	}
+
+	hive.UserMaxConnections = *userMaxConnections
+	hive.UserConnectionsOverflow, ok = hive.OverflowParse(*userConnectionsOverflow)
+	if !ok {
+		log.Emergency("Invalid user-connections-overflow: %v", *userConnectionsOverflow)
+		os.Exit(1)
+	}
+
+	if *netpoll && (*userCompression || *appCompression) {
+		log.Emergency("Compression is not supported with netpoll")
+		os.Exit(1)
+	}
+
+	oversizeValue, ok := hive.OversizeParse(*oversize)
+	if !ok {
+		log.Emergency("Invalid oversize: %v", *oversize)
+		os.Exit(1)
+	}
 
 	if *authKey == "" {
 		// Create auth key id empty
@@ -73,39 +215,186 @@ func main() {
 	usersStats := hive.NewUsersStats()
 	appsStats := hive.NewAppsStats()
 
-	users := hive.NewUsers(usersStats)
-	apps := hive.NewApps(*uidsApiUrl, appsStats)
-	hive.RouterStart(users, apps)
+	// hive goroutines run until connections are drained
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	ipLimiter := hive.NewRateLimiter(ctx, *ipRateMessages, *ipRateBytes)
+
+	users := hive.NewUsers(ctx, usersStats)
+	apps := hive.NewApps(ctx, *uidsApiUrl, appsStats)
+	hive.RouterStart(ctx, users, apps)
+
+	var natsConn *nats.Conn
+	if *natsUrl != "" {
+		var err error
+		natsConn, err = nats.Connect(*natsUrl, nats.MaxReconnects(-1))
+		if err != nil {
+			log.Emergency("Fail connect nats: %v", err)
+			os.Exit(1)
+		}
+		defer natsConn.Close()
+		if *natsExport {
+			exporter := endpoint.NewNatsExporter(natsConn)
+			users.SetExporter(exporter)
+			apps.SetExporter(exporter)
+		}
+		if *natsInject {
+			err = endpoint.BindNats(users, apps, natsConn, *natsQueue)
+			if err != nil {
+				log.Emergency("Fail subscribe nats: %v", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	var bus backplane.ABackplane
+	if *clusterRedis != "" {
+		redisBus, err := backplane.NewRedis(*clusterRedis)
+		if err != nil {
+			log.Emergency("Fail connect cluster backplane: %v", err)
+			os.Exit(1)
+		}
+		bus = redisBus
+	} else if *clusterNats {
+		if natsConn == nil {
+			log.Emergency("Nats cluster backplane requires -nats")
+			os.Exit(1)
+		}
+		bus = backplane.NewNats(natsConn)
+	}
+	if bus != nil {
+		defer bus.Close()
+		if *clusterNode == "" {
+			*clusterNode = uuid.New().String()
+		}
+		_, err := hive.NewCluster(ctx, *clusterNode, bus, users, apps)
+		if err != nil {
+			log.Emergency("Fail join cluster: %v", err)
+			os.Exit(1)
+		}
+	}
 
 	if len(*devPageTemplate) > 0 {
 		log.Alert("Binding dev page handler - don't use in production - secrets leak!")
 		endpoint.BindDevPage("/dev", *devPageTemplate, *apiKey)
 	}
+	if *netpoll {
+		poll, err := hive.NewNetpoll(ctx, *netpollWorkers)
+		if err != nil {
+			log.Emergency("Netpoll error: %v", err)
+			os.Exit(1)
+		}
+		endpoint.Netpoll = poll
+	}
 	endpoint.BindStats(usersStats, appsStats, "/stats")
 	endpoint.BindMetrics(usersStats, appsStats, "/metrics")
 	endpoint.BindApi(users, apps, "/api", *apiKey, *authKey)
-	endpoint.BindUsers(users, "/bro", *allowedOrigins, *authKey)
-	endpoint.BindApps(apps, "/app", *authKey)
+	endpoint.BindUsers(users, apps, "/bro", *allowedOrigins, *authKey, hive.ConnectionOptions{
+		Compression:          *userCompression,
+		CompressionLevel:     *userCompressionLevel,
+		CompressionThreshold: *userCompressionThreshold,
+		SendBuffer:           *userSendBuffer,
+		SpillBuffer:          *userSpillBuffer,
+		Backpressure:         userBackpressureValue,
+		Limiter:              hive.NewRateLimiter(ctx, *userRateMessages, *userRateBytes),
+		IpLimiter:            ipLimiter,
+		RateViolations:       *rateViolations,
+		MaxMessageSize:       *userMaxMessageSize,
+		MaxJsonDepth:         *userMaxJsonDepth,
+		Oversize:             oversizeValue,
+		Stats:                usersStats,
+	}, endpoint.NewAdmission(ctx, *userMaxHandshakes, *userHandshakeRate, 0, nil))
+	endpoint.BindApps(apps, "/app", *authKey, hive.ConnectionOptions{
+		Compression:          *appCompression,
+		CompressionLevel:     *appCompressionLevel,
+		CompressionThreshold: *appCompressionThreshold,
+		SendBuffer:           *appSendBuffer,
+		SpillBuffer:          *appSpillBuffer,
+		Backpressure:         appBackpressureValue,
+		Limiter:              hive.NewRateLimiter(ctx, *appRateMessages, *appRateBytes),
+		IpLimiter:            ipLimiter,
+		RateViolations:       *rateViolations,
+		MaxMessageSize:       *appMaxMessageSize,
+		MaxJsonDepth:         *appMaxJsonDepth,
+		Oversize:             oversizeValue,
+		Stats:                appsStats,
+	}, endpoint.NewAdmission(ctx, *appMaxHandshakes, *appHandshakeRate, *uidsQueueLimit, apps.UidsQueueLen))
+
+	// loaded before a running process is asked to hand off the listener
+	cert, err := tls.LoadX509KeyPair(*certFilename, *privKeyFilename)
+	if err != nil {
+		log.Emergency("Fail load certificate: %v", err)
+		os.Exit(1)
+	}
+	srv := &http.Server{Addr: *addr, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
 
-	srv := &http.Server{Addr: *addr}
+	var listener net.Listener
+	handoffs := make(chan bool, 1)
+	if *handoffSocket != "" {
+		listener, err = endpoint.ListenHandoff(*handoffSocket, *addr, func() {
+			handoffs <- true
+		})
+	} else {
+		listener, err = net.Listen("tcp", *addr)
+	}
+	if err != nil {
+		log.Emergency("Listen error: %v", err)
+		os.Exit(1)
+	}
 
+	drained := make(chan bool)
 	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt)
-		<-sigint
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-		// We received an interrupt signal, shut down.
-		err := srv.Shutdown(context.Background())
+		var window time.Duration
+		select {
+		case sig := <-signals:
+			// We received an interrupt signal, refuse handshakes and drain connections.
+			log.Info("Draining, signal: %v", sig)
+		case <-handoffs:
+			// The next process accepts connections, clients move to it gradually.
+			window = time.Duration(*drainWindow) * time.Second
+			log.Info("Draining over: %v", window)
+		}
+		endpoint.Drain()
+		deadline := time.Now().Add(time.Duration(*drainTimeout) * time.Second)
+		shutdownCtx, cancel := context.WithDeadline(context.Background(), deadline)
+		err := srv.Shutdown(shutdownCtx)
+		cancel()
 		if err != nil {
 			// Error from closing listeners, or context timeout:
 			log.Error("Server shutdown: %v", err)
 		}
+
+		// Websocket connections are hijacked, the server does not close them
+		users.Drain(window)
+		apps.Drain(window)
+		if !waitDrained(usersStats, appsStats, deadline.Add(window)) {
+			log.Warning("Drain timeout, users connections: %d, apps: %d",
+				usersStats.GetData().CurrentConnections, appsStats.GetData().CurrentConnections)
+		}
+		stop()
+		close(drained)
 	}()
 
-	err := srv.ListenAndServeTLS(*certFilename, *privKeyFilename)
+	err = srv.ServeTLS(listener, "", "")
 	if err != http.ErrServerClosed {
 		log.Emergency("Server error: %v", err)
 		os.Exit(1)
 	}
+	<-drained
 	log.Info("Stopped")
 }
+
+// Wait for connections to be closed, false on deadline
+func waitDrained(usersStats *hive.UsersStats, appsStats *hive.AppsStats, deadline time.Time) bool {
+	for time.Now().Before(deadline) {
+		if usersStats.GetData().CurrentConnections == 0 && appsStats.GetData().CurrentConnections == 0 {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}